@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// capacityPlanWeeks is how many weeks the capacity plan covers when no range is given
+const capacityPlanWeeks = 8
+
+// Allocation staffs an employee on a project for a number of hours each week from the start date through the end
+// date. Allocations are prorated by weekday in weeks they only partly cover.
+type Allocation struct {
+	gorm.Model
+	EmployeeID   uint      `json:"employee_id" gorm:"index"`
+	ProjectID    uint      `json:"project_id" gorm:"index"`
+	HoursPerWeek float64   `json:"hours_per_week"`
+	StartDate    time.Time `json:"start_date"`
+	EndDate      time.Time `json:"end_date"`
+	Notes        string    `json:"notes"`
+}
+
+// weekHours returns the hours an allocation contributes to the week starting on the given Monday
+func (allocation Allocation) weekHours(week time.Time) float64 {
+	start, end := week, week.AddDate(0, 0, 7)
+	if allocation.StartDate.After(start) {
+		start = allocation.StartDate
+	}
+	if allocationEnd := allocation.EndDate.AddDate(0, 0, 1); allocationEnd.Before(end) {
+		end = allocationEnd
+	}
+	return allocation.HoursPerWeek * float64(workdays(start, end, cronos.Employee{})) / 5
+}
+
+// ProjectWeek compares the hours allocated to a project in a week with the hours logged to it
+type ProjectWeek struct {
+	ProjectID      uint    `json:"project_id"`
+	ProjectName    string  `json:"project_name"`
+	AllocatedHours float64 `json:"allocated_hours"`
+	ActualHours    float64 `json:"actual_hours"`
+	Variance       float64 `json:"variance"`
+}
+
+// CapacityWeek is an employee's capacity, allocations and logged time for one week
+type CapacityWeek struct {
+	WeekStart      time.Time     `json:"week_start"`
+	CapacityHours  float64       `json:"capacity_hours"`
+	AllocatedHours float64       `json:"allocated_hours"`
+	AvailableHours float64       `json:"available_hours"`
+	ActualHours    float64       `json:"actual_hours"`
+	OverAllocated  bool          `json:"over_allocated"`
+	Projects       []ProjectWeek `json:"projects"`
+}
+
+// CapacityPlan is the week by week capacity of an employee
+type CapacityPlan struct {
+	EmployeeID   uint           `json:"employee_id"`
+	EmployeeName string         `json:"employee_name"`
+	WeeklyHours  float64        `json:"weekly_hours"`
+	Weeks        []CapacityWeek `json:"weeks"`
+	Warnings     []string       `json:"warnings"`
+}
+
+// overAllocationWarning describes a week in which an employee is allocated beyond their capacity
+func overAllocationWarning(name string, week CapacityWeek) string {
+	return fmt.Sprintf("%s is allocated %.1f hours in the week of %s against a capacity of %.1f hours",
+		name, week.AllocatedHours, week.WeekStart.Format("January 2, 2006"), week.CapacityHours)
+}
+
+// CapacityPlans computes the capacity plan of each employee for every week from the week containing start up to
+// end. Actual hours are the billable, non-void entries logged in each week.
+func (a *App) CapacityPlans(employees []cronos.Employee, start, end time.Time) []CapacityPlan {
+	employeeIDs := make([]uint, len(employees))
+	for i, employee := range employees {
+		employeeIDs[i] = employee.ID
+	}
+	capacities := a.weeklyCapacities(employeeIDs)
+	firstWeek := weekStart(start)
+
+	var allocations []Allocation
+	a.cronosApp.DB.Where("employee_id in ? and start_date < ? and end_date >= ?", employeeIDs, end, firstWeek).Find(&allocations)
+	var entries []cronos.Entry
+	a.cronosApp.DB.Where("(impersonate_as_user_id in ? or (employee_id in ? and impersonate_as_user_id is null)) and start >= ? and start < ? and state != ? and internal = ?",
+		employeeIDs, employeeIDs, firstWeek, end, cronos.EntryStateVoid.String(), false).Find(&entries)
+	projectNames := make(map[uint]string)
+	var projects []cronos.Project
+	a.cronosApp.DB.Find(&projects)
+	for _, project := range projects {
+		projectNames[project.ID] = project.Name
+	}
+
+	plans := make([]CapacityPlan, len(employees))
+	for i, employee := range employees {
+		plan := CapacityPlan{
+			EmployeeID:   employee.ID,
+			EmployeeName: employee.FirstName + " " + employee.LastName,
+			WeeklyHours:  capacities[employee.ID],
+			Weeks:        []CapacityWeek{},
+			Warnings:     []string{},
+		}
+		for week := firstWeek; week.Before(end); week = week.AddDate(0, 0, 7) {
+			projectWeeks := make(map[uint]*ProjectWeek)
+			projectWeek := func(projectID uint) *ProjectWeek {
+				if projectWeeks[projectID] == nil {
+					projectWeeks[projectID] = &ProjectWeek{ProjectID: projectID, ProjectName: projectNames[projectID]}
+				}
+				return projectWeeks[projectID]
+			}
+			capacityWeek := CapacityWeek{
+				WeekStart:     week,
+				CapacityHours: capacities[employee.ID] * float64(workdays(week, week.AddDate(0, 0, 7), employee)) / 5,
+				Projects:      []ProjectWeek{},
+			}
+			for _, allocation := range allocations {
+				if allocation.EmployeeID != employee.ID {
+					continue
+				}
+				if hours := allocation.weekHours(week); hours > 0 {
+					capacityWeek.AllocatedHours += hours
+					projectWeek(allocation.ProjectID).AllocatedHours += hours
+				}
+			}
+			for j := range entries {
+				if entryWorkerID(&entries[j]) != employee.ID || !weekStart(entries[j].Start).Equal(week) {
+					continue
+				}
+				hours := entries[j].Duration().Hours()
+				capacityWeek.ActualHours += hours
+				projectWeek(entries[j].ProjectID).ActualHours += hours
+			}
+			for _, project := range projectWeeks {
+				project.Variance = project.ActualHours - project.AllocatedHours
+				capacityWeek.Projects = append(capacityWeek.Projects, *project)
+			}
+			sort.Slice(capacityWeek.Projects, func(x, y int) bool {
+				return capacityWeek.Projects[x].ProjectName < capacityWeek.Projects[y].ProjectName
+			})
+			capacityWeek.AvailableHours = capacityWeek.CapacityHours - capacityWeek.AllocatedHours
+			if capacityWeek.AvailableHours < 0 {
+				capacityWeek.OverAllocated = true
+				plan.Warnings = append(plan.Warnings, overAllocationWarning(plan.EmployeeName, capacityWeek))
+			}
+			plan.Weeks = append(plan.Weeks, capacityWeek)
+		}
+		plans[i] = plan
+	}
+	return plans
+}
+
+// capacityRange reads the `start` and `end` dates of the capacity plan, defaulting to the coming weeks
+func capacityRange(r *http.Request) (time.Time, time.Time, ValidationErrors) {
+	if r.URL.Query().Get("start") == "" && r.URL.Query().Get("end") == "" {
+		thisWeek := weekStart(time.Now())
+		return thisWeek, thisWeek.AddDate(0, 0, 7*capacityPlanWeeks), nil
+	}
+	return reportRange(r)
+}
+
+// CapacityPlanHandler provides the week by week capacity plan of every active employee, or of one `employee_id`,
+// over the `start` and `end` dates. With `over_allocated=true` only employees with an over-allocated week are shown.
+func (a *App) CapacityPlanHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	start, end, errs := capacityRange(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	var employees []cronos.Employee
+	query := a.cronosApp.DB.Order("last_name ASC, first_name ASC")
+	if employeeID := r.URL.Query().Get("employee_id"); employeeID != "" {
+		query = query.Where("id = ?", employeeID)
+	} else {
+		query = query.Where("is_active = ?", true)
+	}
+	query.Find(&employees)
+
+	plans := a.CapacityPlans(employees, start, end)
+	if r.URL.Query().Get("over_allocated") == "true" {
+		overAllocated := []CapacityPlan{}
+		for _, plan := range plans {
+			if len(plan.Warnings) > 0 {
+				overAllocated = append(overAllocated, plan)
+			}
+		}
+		plans = overAllocated
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&plans)
+}
+
+// setOverAllocationWarning attaches a Warning header to the response when the allocation leaves its employee
+// over-allocated in any week it covers
+func (a *App) setOverAllocationWarning(w http.ResponseWriter, allocation *Allocation) {
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("id = ?", allocation.EmployeeID).Limit(1).Find(&employee).RowsAffected == 0 {
+		return
+	}
+	plans := a.CapacityPlans([]cronos.Employee{employee}, allocation.StartDate, allocation.EndDate.AddDate(0, 0, 1))
+	if len(plans[0].Warnings) > 0 {
+		w.Header().Set("Warning", fmt.Sprintf("199 cronos %q", strings.Join(plans[0].Warnings, "; ")))
+	}
+}
+
+// validateAllocation checks that an allocation refers to an existing employee and project and has a sensible range
+func (a *App) validateAllocation(allocation Allocation) ValidationErrors {
+	var errs ValidationErrors
+	if a.cronosApp.DB.Where("id = ?", allocation.EmployeeID).Limit(1).Find(&cronos.Employee{}).RowsAffected == 0 {
+		errs.Add("employee_id", "Employee does not exist")
+	}
+	if a.cronosApp.DB.Where("id = ?", allocation.ProjectID).Limit(1).Find(&cronos.Project{}).RowsAffected == 0 {
+		errs.Add("project_id", "Project does not exist")
+	}
+	if allocation.HoursPerWeek <= 0 || allocation.HoursPerWeek > 168 {
+		errs.Add("hours_per_week", "Expected a number of hours between 0 and 168")
+	}
+	if allocation.StartDate.IsZero() {
+		errs.Add("start_date", "Expected a date in the format YYYY-MM-DD")
+	}
+	if allocation.EndDate.IsZero() {
+		errs.Add("end_date", "Expected a date in the format YYYY-MM-DD")
+	} else if allocation.EndDate.Before(allocation.StartDate) {
+		errs.Add("end_date", "End date must not be before the start date")
+	}
+	return errs
+}
+
+// AllocationsListHandler lists allocations, optionally for one `employee_id` or `project_id`, that are current on
+// or after an optional `from` date
+func (a *App) AllocationsListHandler(w http.ResponseWriter, r *http.Request) {
+	var allocations []Allocation
+	query := a.cronosApp.DB.Order("start_date ASC")
+	if employeeID := r.URL.Query().Get("employee_id"); employeeID != "" {
+		query = query.Where("employee_id = ?", employeeID)
+	}
+	if projectID := r.URL.Query().Get("project_id"); projectID != "" {
+		query = query.Where("project_id = ?", projectID)
+	}
+	if from, err := time.Parse("2006-01-02", r.URL.Query().Get("from")); err == nil {
+		query = query.Where("end_date >= ?", from)
+	}
+	query.Find(&allocations)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&allocations)
+}
+
+// AllocationHandler Provides CRUD interface for the allocation object. Saving an allocation that over-allocates
+// the employee succeeds with a Warning header describing the over-allocated weeks.
+func (a *App) AllocationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var allocation Allocation
+	if r.Method != "GET" && !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.First(&allocation, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&allocation)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.First(&allocation, vars["id"])
+		if r.FormValue("employee_id") != "" {
+			employeeID, _ := strconv.ParseUint(r.FormValue("employee_id"), 10, 64)
+			allocation.EmployeeID = uint(employeeID)
+		}
+		if r.FormValue("project_id") != "" {
+			projectID, _ := strconv.ParseUint(r.FormValue("project_id"), 10, 64)
+			allocation.ProjectID = uint(projectID)
+		}
+		if r.FormValue("hours_per_week") != "" {
+			allocation.HoursPerWeek, _ = strconv.ParseFloat(r.FormValue("hours_per_week"), 64)
+		}
+		if r.FormValue("start_date") != "" {
+			allocation.StartDate, _ = time.Parse("2006-01-02", r.FormValue("start_date"))
+		}
+		if r.FormValue("end_date") != "" {
+			allocation.EndDate, _ = time.Parse("2006-01-02", r.FormValue("end_date"))
+		}
+		if r.FormValue("notes") != "" {
+			allocation.Notes = r.FormValue("notes")
+		}
+		if errs := a.validateAllocation(allocation); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Save(&allocation)
+		a.setOverAllocationWarning(w, &allocation)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&allocation)
+		return
+	case r.Method == "POST":
+		employeeID, _ := strconv.ParseUint(r.FormValue("employee_id"), 10, 64)
+		projectID, _ := strconv.ParseUint(r.FormValue("project_id"), 10, 64)
+		allocation.EmployeeID = uint(employeeID)
+		allocation.ProjectID = uint(projectID)
+		allocation.HoursPerWeek, _ = strconv.ParseFloat(r.FormValue("hours_per_week"), 64)
+		allocation.StartDate, _ = time.Parse("2006-01-02", r.FormValue("start_date"))
+		allocation.EndDate, _ = time.Parse("2006-01-02", r.FormValue("end_date"))
+		allocation.Notes = r.FormValue("notes")
+		if errs := a.validateAllocation(allocation); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Create(&allocation)
+		a.setOverAllocationWarning(w, &allocation)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&allocation)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&Allocation{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
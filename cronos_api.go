@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -72,8 +73,6 @@ func (a *App) ActiveBillingCodesListHandler(w http.ResponseWriter, r *http.Reque
 
 // EntriesListHandler provides a list of Entries that are available
 func (a *App) EntriesListHandler(w http.ResponseWriter, r *http.Request) {
-	var entries []cronos.Entry
-
 	var employee cronos.Employee
 	userIDInt := r.Context().Value("user_id")
 	a.cronosApp.DB.Where("user_id = ?", userIDInt).First(&employee)
@@ -81,24 +80,10 @@ func (a *App) EntriesListHandler(w http.ResponseWriter, r *http.Request) {
 	// Modified query to include entries where:
 	// 1. Current user created the entry (employee_id = employee.ID)
 	// 2. Current user is being impersonated by others (impersonate_as_user_id = employee.ID)
-	a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").
-		Preload("Employee").Preload("ImpersonateAsUser").
-		Where("employee_id = ? OR impersonate_as_user_id = ?", employee.ID, employee.ID).
-		Find(&entries)
-
-	apiEntries := make([]cronos.ApiEntry, len(entries))
-	for i, entry := range entries {
-		apiEntry := entry.GetAPIEntry()
-		// Set a flag for UI to identify if this entry was created by someone else impersonating this user
-		if entry.ImpersonateAsUserID != nil && *entry.ImpersonateAsUserID == employee.ID && entry.EmployeeID != employee.ID {
-			apiEntry.IsBeingImpersonated = true
-			apiEntry.EmployeeName = entry.Employee.FirstName + " " + entry.Employee.LastName
-		}
-		apiEntries[i] = apiEntry
-	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(&apiEntries)
+	// Filtering, sorting and pagination are applied by writeEntryPage
+	query := a.cronosApp.DB.Model(&cronos.Entry{}).
+		Where("(entries.employee_id = ? OR entries.impersonate_as_user_id = ?)", employee.ID, employee.ID)
+	a.writeEntryPage(w, r, query, employee)
 }
 
 // DraftInvoiceListHandler provides a list of Draft Invoices that are available and associated entries
@@ -209,6 +194,9 @@ func (a *App) ProjectHandler(w http.ResponseWriter, r *http.Request) {
 			project.SDRID = nil
 		}
 		a.cronosApp.DB.Save(&project)
+		if r.FormValue("lead_id") != "" {
+			a.setProjectLead(project.ID, r.FormValue("lead_id"))
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(&project)
 		return
@@ -238,12 +226,18 @@ func (a *App) ProjectHandler(w http.ResponseWriter, r *http.Request) {
 		project.AccountID = account.ID
 		project.Account = account
 		a.cronosApp.DB.Create(&project)
+		if r.FormValue("lead_id") != "" {
+			a.setProjectLead(project.ID, r.FormValue("lead_id"))
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusCreated)
 		_ = json.NewEncoder(w).Encode(&project)
 		return
 	case r.Method == "DELETE":
+		if !a.canArchive(w, r, ArchiveKindProject, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.Project{})
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
@@ -325,6 +319,9 @@ func (a *App) AccountHandler(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(&account)
 		return
 	case r.Method == "DELETE":
+		if !a.canArchive(w, r, ArchiveKindAccount, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.Account{})
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
@@ -345,9 +342,13 @@ func (a *App) BillingCodeHandler(w http.ResponseWriter, r *http.Request) {
 		a.cronosApp.DB.First(&billingCode, vars["id"])
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(&billingCode)
+		_ = json.NewEncoder(w).Encode(BillingCodeDetail{billingCode, a.roundingModes([]uint{billingCode.ID})[billingCode.ID]})
 		return
 	case r.Method == "PUT":
+		if mode := r.FormValue("rounding_mode"); mode != "" && !validRoundingMode(mode) {
+			writeValidationErrors(w, roundingModeError(mode))
+			return
+		}
 		a.cronosApp.DB.First(&billingCode, vars["id"])
 		if r.FormValue("name") != "" {
 			billingCode.Name = r.FormValue("name")
@@ -401,10 +402,17 @@ func (a *App) BillingCodeHandler(w http.ResponseWriter, r *http.Request) {
 			billingCode.InternalRate = internalRate
 		}
 		a.cronosApp.DB.Save(&billingCode)
+		if r.FormValue("rounding_mode") != "" {
+			a.setBillingCodeRounding(billingCode.ID, r.FormValue("rounding_mode"))
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		_ = json.NewEncoder(w).Encode(&billingCode)
+		_ = json.NewEncoder(w).Encode(BillingCodeDetail{billingCode, a.roundingModes([]uint{billingCode.ID})[billingCode.ID]})
 		return
 	case r.Method == "POST":
+		if mode := r.FormValue("rounding_mode"); mode != "" && !validRoundingMode(mode) {
+			writeValidationErrors(w, roundingModeError(mode))
+			return
+		}
 		billingCode.Name = r.FormValue("name")
 		billingCode.RateType = r.FormValue("type")
 		billingCode.Category = r.FormValue("category")
@@ -423,12 +431,19 @@ func (a *App) BillingCodeHandler(w http.ResponseWriter, r *http.Request) {
 		billingCode.InternalRateID = uint(internalRateID)
 
 		a.cronosApp.DB.Create(&billingCode)
+		if r.FormValue("rounding_mode") != "" {
+			a.setBillingCodeRounding(billingCode.ID, r.FormValue("rounding_mode"))
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusCreated)
-		_ = json.NewEncoder(w).Encode(&billingCode)
+		_ = json.NewEncoder(w).Encode(BillingCodeDetail{billingCode, a.roundingModes([]uint{billingCode.ID})[billingCode.ID]})
 		return
 	case r.Method == "DELETE":
+		if !a.canArchive(w, r, ArchiveKindBillingCode, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.BillingCode{})
+		a.cronosApp.DB.Where("billing_code_id = ?", vars["id"]).Delete(&BillingCodeRounding{})
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
 	default:
@@ -495,6 +510,9 @@ func (a *App) RateHandler(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(&rate)
 		return
 	case r.Method == "DELETE":
+		if !a.canArchive(w, r, ArchiveKindRate, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.Rate{})
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
@@ -530,7 +548,7 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(apiEntry)
+		_ = json.NewEncoder(w).Encode(a.billedEntry(entry, apiEntry))
 		return
 	case r.Method == "PUT":
 		a.cronosApp.DB.First(&entry, vars["id"])
@@ -550,6 +568,19 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Entries in a closed accounting period are locked until an admin reopens the period
+		if period, closed := a.closedPeriod(entry.Start); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+
+		// Entries in a submitted or approved timesheet are locked until the timesheet is rejected
+		if a.entryTimesheetLocked(&entry) {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "This entry is on a submitted timesheet and cannot be edited"})
+			return
+		}
+
 		if r.FormValue("billing_code_id") != "" {
 			var billingCode cronos.BillingCode
 			a.cronosApp.DB.Preload("Rate").Preload("InternalRate").Where("id = ?", r.FormValue("billing_code_id")).First(&billingCode)
@@ -561,21 +592,22 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 				entry.ProjectID = billingCode.ProjectID
 			}
 		}
+		var parseErrors ValidationErrors
 		if r.FormValue("start") != "" {
 			// first convert the string to a time.Time object
-			start, err := time.Parse("2006-01-02T15:04", r.FormValue("start"))
-			if err != nil {
-				fmt.Println(err)
+			if start, ok := parseEntryTime(r.FormValue("start"), "start", &parseErrors); ok {
+				entry.Start = start
 			}
-			entry.Start = start
 		}
 		if r.FormValue("end") != "" {
 			// first convert the string to a time.Time object
-			endtime, err := time.Parse("2006-01-02T15:04", r.FormValue("end"))
-			if err != nil {
-				fmt.Println(err)
+			if endtime, ok := parseEntryTime(r.FormValue("end"), "end", &parseErrors); ok {
+				entry.End = endtime
 			}
-			entry.End = endtime
+		}
+		if len(parseErrors) > 0 {
+			writeValidationErrors(w, parseErrors)
+			return
 		}
 		if r.FormValue("notes") != "" {
 			entry.Notes = r.FormValue("notes")
@@ -595,7 +627,14 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if errs := a.ValidateEntry(&entry); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
 		a.cronosApp.DB.Save(&entry)
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
+		a.setOverlapWarning(w, &entry)
 
 		// Get the updated entry with all relationships loaded
 		a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser").First(&entry, entry.ID)
@@ -608,11 +647,16 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		_ = json.NewEncoder(w).Encode(apiEntry)
+		_ = json.NewEncoder(w).Encode(a.billedEntry(entry, apiEntry))
 		return
 	case r.Method == "POST":
-		entry.Start, _ = time.Parse("2006-01-02T15:04", r.FormValue("start"))
-		entry.End, _ = time.Parse("2006-01-02T15:04", r.FormValue("end"))
+		var parseErrors ValidationErrors
+		entry.Start, _ = parseEntryTime(r.FormValue("start"), "start", &parseErrors)
+		entry.End, _ = parseEntryTime(r.FormValue("end"), "end", &parseErrors)
+		if len(parseErrors) > 0 {
+			writeValidationErrors(w, parseErrors)
+			return
+		}
 		var employee cronos.Employee
 		userID := r.Context().Value("user_id")
 		a.cronosApp.DB.Where("user_id = ?", userID).First(&employee)
@@ -642,13 +686,20 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if errs := a.ValidateEntry(&entry); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
 		// Need to first create the entries before we can associate them
 		a.cronosApp.DB.Create(&entry)
 
-		err := a.cronosApp.AssociateEntry(&entry, entry.ProjectID)
+		err := a.AssociateApprovedEntry(&entry)
 		if err != nil {
 			fmt.Println(err)
 		}
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
+		a.setOverlapWarning(w, &entry)
 
 		// Get the created entry with all relationships loaded
 		a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser").First(&entry, entry.ID)
@@ -662,13 +713,28 @@ func (a *App) EntryHandler(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusCreated)
-		err = json.NewEncoder(w).Encode(apiEntry)
+		err = json.NewEncoder(w).Encode(a.billedEntry(entry, apiEntry))
 		if err != nil {
 			fmt.Println(err)
 		}
 		return
 	case r.Method == "DELETE":
+		a.cronosApp.DB.First(&entry, vars["id"])
+		if period, closed := a.closedPeriod(entry.Start); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+		if a.entryTimesheetLocked(&entry) {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "This entry is on a submitted timesheet and cannot be deleted"})
+			return
+		}
+		if !a.canArchive(w, r, ArchiveKindEntry, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.Entry{})
+		entryID, _ := strconv.ParseUint(vars["id"], 10, 64)
+		a.SnapshotDraftInvoiceForEntry(uint(entryID), contextUserID(r))
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
 	default:
@@ -685,9 +751,14 @@ func (a *App) BillHandler(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.Method == "GET":
 		a.cronosApp.DB.Preload("Employee").First(&bill, vars["id"])
+		// Staff can see the breakdown of their own bills
+		if !a.canViewBill(r, bill) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(&bill)
+		_ = json.NewEncoder(w).Encode(a.billDetail(bill))
 		return
 	default:
 		fmt.Println("Fatal Error")
@@ -697,8 +768,18 @@ func (a *App) BillHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) BillListHandler(w http.ResponseWriter, r *http.Request) {
+	// Staff list their own bills through MyBillsListHandler
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	var bills []cronos.Bill
-	a.cronosApp.DB.Preload("Employee").Order("period_end DESC").Find(&bills)
+	query := a.cronosApp.DB.Preload("Employee").Order("period_end DESC")
+	// Voided bills are kept for their history but left out unless asked for
+	if r.URL.Query().Get("include_void") != "true" {
+		query = query.Where("id not in (?)", a.voidBillIDs())
+	}
+	query.Find(&bills)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(&bills)
@@ -706,42 +787,103 @@ func (a *App) BillListHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// BillStateHandler moves a bill through admin approval and payment. Only approved bills can be paid. Voiding keeps
+// the bill and its history and voids its entries, and requires a `reason`. A paid bill can only be voided along
+// with the `reversal_reference` of the transaction that recovered the payment, and voiding it adds a credit
+// adjustment to the bill that reverses the amount paid.
 func (a *App) BillStateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	var bill cronos.Bill
-	a.cronosApp.DB.First(&bill, vars["id"])
-	status := vars["state"]
-	switch {
-	case status == "void":
-		// Void all the entries associated with the bill
-		a.cronosApp.DB.Model(&bill).Association("Entries").Find(&bill.Entries)
-		for _, entry := range bill.Entries {
-			entry.State = cronos.EntryStateVoid.String()
-			a.cronosApp.DB.Save(&entry)
-		}
-		bill.TotalFees = 0
-		bill.TotalAdjustments = 0
-		bill.TotalAmount = 0
-		bill.TotalHours = 0
-		timeNow := time.Now()
-		bill.ClosedAt = &timeNow
-		a.cronosApp.DB.Delete(&bill)
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		_ = json.NewEncoder(w).Encode(http.StatusOK)
+	if a.cronosApp.DB.Where("id = ?", vars["id"]).Limit(1).Find(&bill).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
 		return
-	case status == "paid":
-		// Mark the bill as paid
-		a.cronosApp.MarkBillPaid(&bill)
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		_ = json.NewEncoder(w).Encode(http.StatusOK)
+	}
+	action := vars["state"]
+	status := a.billStatus(bill)
+	toState, err := billTransition(action, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
+	}
+	if action == BillActionVoid || action == BillActionPaid {
+		// Voiding changes the entries the bill pays for, while paying it books the payment today
+		bookedAt := time.Now()
+		if action == BillActionVoid {
+			bookedAt = bill.PeriodEnd
+		}
+		if period, closed := a.closedPeriod(bookedAt); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+		// The bank may already have the payout file, so the batch decides whether the bill was paid
+		if batch, found := a.generatedPayoutBatch(bill.ID); found {
+			http.Error(w, fmt.Sprintf("This bill is in payout batch %d, which must be confirmed or cancelled first", batch.ID), http.StatusConflict)
+			return
+		}
+	}
+	if action == BillActionVoid {
+		var errs ValidationErrors
+		if r.FormValue("reason") == "" {
+			errs.Add("reason", "A reason is required to void a bill")
+		}
+		if status.State == BillStatePaid && r.FormValue("reversal_reference") == "" {
+			errs.Add("reversal_reference", "A paid bill can only be voided with the reference of the reversal that recovered the payment")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+	}
 
-	default:
-		fmt.Println("Fatal Error")
-		w.WriteHeader(http.StatusInternalServerError)
+	if action == BillActionPaid {
+		if err := a.markBillPaid(&bill); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if action == BillActionVoid {
+			// Void all the entries associated with the bill, the bill itself is kept with its totals
+			if err := tx.Model(&bill).Association("Entries").Find(&bill.Entries); err != nil {
+				return err
+			}
+			for _, entry := range bill.Entries {
+				entry.State = cronos.EntryStateVoid.String()
+				if err := tx.Save(&entry).Error; err != nil {
+					return err
+				}
+			}
+			if status.State == BillStatePaid {
+				reversal := cronos.Adjustment{
+					BillID: &bill.ID,
+					Type:   adjustmentTypeCredit,
+					Amount: bill.TotalAmount,
+					Notes:  fmt.Sprintf("Reversal of payment %s: %s", r.FormValue("reversal_reference"), r.FormValue("reason")),
+					State:  cronos.AdjustmentStateApproved.String(),
+				}
+				if err := tx.Create(&reversal).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return a.recordBillTransition(tx, &status, action, toState, r)
+	})
+	if err != nil {
+		if action == BillActionPaid {
+			log.Printf("Bill %d was marked paid but its status could not be recorded: %v", bill.ID, err)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.billStatus(bill))
 }
 
 func (a *App) RegenerateBillHandler(w http.ResponseWriter, r *http.Request) {
@@ -749,6 +891,14 @@ func (a *App) RegenerateBillHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var bill cronos.Bill
 	a.cronosApp.DB.First(&bill, vars["id"])
+	if period, closed := a.closedPeriod(bill.PeriodEnd); closed {
+		writePeriodClosed(w, period)
+		return
+	}
+	if a.billStatus(bill).State == BillStateVoid {
+		http.Error(w, "This bill is void", http.StatusConflict)
+		return
+	}
 	err := a.cronosApp.RegeneratePDF(&bill)
 	if err != nil {
 		fmt.Println(err)
@@ -791,28 +941,78 @@ func (a *App) EntryStateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var entry cronos.Entry
 	a.cronosApp.DB.First(&entry, vars["id"])
+	if period, closed := a.closedPeriod(entry.Start); closed {
+		writePeriodClosed(w, period)
+		return
+	}
 	status := vars["state"]
 	switch {
 	case status == "approve":
 		entry.State = cronos.EntryStateApproved.String()
 		a.cronosApp.DB.Save(&entry)
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.EntryStateVoid.String()})
 		return
 	case status == "void":
 		entry.State = cronos.EntryStateVoid.String()
 		a.cronosApp.DB.Save(&entry)
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.EntryStateVoid.String()})
 		return
 	case status == "draft":
 		entry.State = cronos.EntryStateDraft.String()
 		a.cronosApp.DB.Save(&entry)
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.EntryStateDraft.String()})
 	}
 }
 
+// errInvoiceReload is returned by MarkInvoicePaid when the invoice was paid but could not be read back
+var errInvoiceReload = errors.New("error reloading invoice after marking it paid")
+
+// MarkInvoicePaid moves an invoice to paid. It is shared by the paid state transition and the payment webhook so
+// that bills, commissions, journal entries and history are handled the same way regardless of how we learn of a
+// payment.
+func (a *App) MarkInvoicePaid(invoice *cronos.Invoice, userID uint) error {
+	// The payment and the bills it generates are booked today. Invoices are usually paid after the period they bill
+	// has closed, so that period is not checked.
+	if period, closed := a.closedPeriod(time.Now()); closed {
+		return PeriodClosedError{Period: period}
+	}
+	err := a.cronosApp.MarkInvoicePaid(invoice.ID) // This handles setting the state, saving, and generating bills/commissions
+	if err != nil {
+		return err
+	}
+
+	// Reload the invoice to get the updated state
+	if err := a.cronosApp.DB.First(invoice, invoice.ID).Error; err != nil {
+		log.Printf("Error reloading invoice after MarkInvoicePaid: %v", err)
+		return errInvoiceReload
+	}
+
+	// Verify the invoice state was updated
+	if invoice.State != cronos.InvoiceStatePaid.String() {
+		log.Printf("Warning: Invoice state not set to PAID after MarkInvoicePaid: %s", invoice.State)
+		// Force the correct state
+		invoice.State = cronos.InvoiceStatePaid.String()
+		if err := a.cronosApp.DB.Save(invoice).Error; err != nil {
+			log.Printf("Error saving corrected invoice state: %v", err)
+		} else {
+			log.Printf("Successfully forced invoice state to PAID")
+		}
+	}
+
+	a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerPaid, userID)
+
+	// Note: MarkInvoicePaid already calls GenerateBills and AddCommissionsToBills
+	// so we only need to add journal entries here
+	go a.cronosApp.AddJournalEntries(invoice)
+	return nil
+}
+
 // InvoiceStateHandler allows us to accept invoices
 func (a *App) InvoiceStateHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the invoice and entries
@@ -821,6 +1021,13 @@ func (a *App) InvoiceStateHandler(w http.ResponseWriter, r *http.Request) {
 	var invoice cronos.Invoice
 	a.cronosApp.DB.Preload("Entries").First(&invoice, vars["id"])
 	state := vars["state"]
+	// Approving, voiding and sending change the entries and adjustments of the period the invoice bills
+	if state == "approve" || state == "void" || state == "send" {
+		if period, closed := a.closedPeriod(invoice.PeriodEnd); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+	}
 	switch {
 	case state == "approve":
 		// Set the invoice state to approved and mark the time
@@ -846,6 +1053,7 @@ func (a *App) InvoiceStateHandler(w http.ResponseWriter, r *http.Request) {
 		a.cronosApp.DB.Save(&invoice.Adjustments)
 		// Update the invoice totals from the associated entries
 		a.cronosApp.UpdateInvoiceTotals(&invoice)
+		a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerApprove, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct {
 			State string
@@ -863,6 +1071,7 @@ func (a *App) InvoiceStateHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		// Save the entries
 		a.cronosApp.DB.Save(&entries)
+		a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerVoid, contextUserID(r))
 		// Save the invoice
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct {
@@ -894,48 +1103,46 @@ func (a *App) InvoiceStateHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Reload the invoice total before saving
 		a.cronosApp.UpdateInvoiceTotals(&invoice)
+		a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerSend, contextUserID(r))
 
 		// Save the locked file to GCS
 		err := a.cronosApp.SaveInvoiceToGCS(&invoice)
 		if err != nil {
 			fmt.Println(err)
 		}
+		// Apply any payments received while the invoice was approved but not yet sent
+		a.settleInvoicePayments(&invoice)
+		if invoice.State == cronos.InvoiceStateSent.String() {
+			// Generate a hosted payment link and send it to the client along with the invoice
+			link, err := a.CreateInvoicePaymentLink(&invoice)
+			if err != nil {
+				log.Printf("Error creating payment link for invoice %d: %v", invoice.ID, err)
+			} else {
+				go a.emailInvoicePaymentLink(&invoice, link)
+			}
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct {
 			State string
 			ID    uint
-		}{cronos.InvoiceStateSent.String(), invoice.ID})
+		}{invoice.State, invoice.ID})
 
 	case state == "paid":
-		err := a.cronosApp.MarkInvoicePaid(invoice.ID) // This handles setting the state, saving, and generating bills/commissions
-		if err != nil {
+		// Shared with the payment webhook so both paths generate bills, commissions and journal entries
+		if err := a.MarkInvoicePaid(&invoice, contextUserID(r)); err != nil {
+			var closedErr PeriodClosedError
+			if errors.As(err, &closedErr) {
+				writePeriodClosed(w, closedErr.Period)
+				return
+			}
+			if errors.Is(err, errInvoiceReload) {
+				http.Error(w, "Error updating invoice", http.StatusInternalServerError)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Reload the invoice to get the updated state
-		if err := a.cronosApp.DB.First(&invoice, invoice.ID).Error; err != nil {
-			log.Printf("Error reloading invoice after MarkInvoicePaid: %v", err)
-			http.Error(w, "Error updating invoice", http.StatusInternalServerError)
-			return
-		}
-
-		// Verify the invoice state was updated
-		if invoice.State != cronos.InvoiceStatePaid.String() {
-			log.Printf("Warning: Invoice state not set to PAID after MarkInvoicePaid: %s", invoice.State)
-			// Force the correct state
-			invoice.State = cronos.InvoiceStatePaid.String()
-			if err := a.cronosApp.DB.Save(&invoice).Error; err != nil {
-				log.Printf("Error saving corrected invoice state: %v", err)
-			} else {
-				log.Printf("Successfully forced invoice state to PAID")
-			}
-		}
-
-		// Note: MarkInvoicePaid already calls GenerateBills and AddCommissionsToBills
-		// so we only need to add journal entries here
-		go a.cronosApp.AddJournalEntries(&invoice)
-
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct {
 			State string
@@ -958,6 +1165,10 @@ func (a *App) AdjustmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	case r.Method == "PUT":
 		a.cronosApp.DB.First(&adjustment, vars["id"])
+		if period, closed := a.invoicePeriodClosed(adjustment.InvoiceID); closed {
+			writePeriodClosed(w, period)
+			return
+		}
 		if r.FormValue("amount") != "" {
 			amountFloat, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
 			adjustment.Amount = amountFloat
@@ -966,24 +1177,40 @@ func (a *App) AdjustmentHandler(w http.ResponseWriter, r *http.Request) {
 			adjustment.Notes = r.FormValue("notes")
 		}
 		a.cronosApp.DB.Save(&adjustment)
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(&adjustment)
 		return
 	case r.Method == "POST":
 		invoiceID, _ := strconv.Atoi(r.FormValue("invoice_id"))
-		*adjustment.InvoiceID = uint(invoiceID)
+		invoiceIDUint := uint(invoiceID)
+		adjustment.InvoiceID = &invoiceIDUint
+		if period, closed := a.invoicePeriodClosed(adjustment.InvoiceID); closed {
+			writePeriodClosed(w, period)
+			return
+		}
 		adjustment.Type = r.FormValue("type")
 		amountFloat, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
 		adjustment.Amount = amountFloat
 		adjustment.Notes = r.FormValue("notes")
 		adjustment.State = cronos.AdjustmentStateDraft.String()
 		a.cronosApp.DB.Create(&adjustment)
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusCreated)
 		_ = json.NewEncoder(w).Encode(&adjustment)
 		return
 	case r.Method == "DELETE":
+		a.cronosApp.DB.First(&adjustment, vars["id"])
+		if period, closed := a.invoicePeriodClosed(adjustment.InvoiceID); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+		if !a.canArchive(w, r, ArchiveKindAdjustment, vars["id"]) {
+			return
+		}
 		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&cronos.Adjustment{})
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		_ = json.NewEncoder(w).Encode("Deleted Record")
 		return
 	default:
@@ -998,23 +1225,30 @@ func (a *App) AdjustmentStateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var adjustment cronos.Adjustment
 	a.cronosApp.DB.First(&adjustment, vars["id"])
+	if period, closed := a.invoicePeriodClosed(adjustment.InvoiceID); closed {
+		writePeriodClosed(w, period)
+		return
+	}
 	status := vars["state"]
 	switch {
 	case status == "approve":
 		adjustment.State = cronos.AdjustmentStateApproved.String()
 		a.cronosApp.DB.Save(&adjustment)
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.AdjustmentStateApproved.String()})
 		return
 	case status == "void":
 		adjustment.State = cronos.AdjustmentStateVoid.String()
 		a.cronosApp.DB.Save(&adjustment)
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.AdjustmentStateVoid.String()})
 		return
 	case status == "draft":
 		adjustment.State = cronos.AdjustmentStateDraft.String()
 		a.cronosApp.DB.Save(&adjustment)
+		a.SnapshotDraftInvoiceForAdjustment(&adjustment, contextUserID(r))
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		_ = json.NewEncoder(w).Encode(struct{ State string }{cronos.AdjustmentStateDraft.String()})
 		return
@@ -1025,7 +1259,8 @@ func (a *App) BackfillProjectInvoicesHandler(w http.ResponseWriter, r *http.Requ
 	// Retrieve the project and backfill all the invoices
 	vars := mux.Vars(r)
 	projectID := vars["id"]
-	go a.cronosApp.BackfillEntriesForProject(projectID)
+	// Only entries in approved timesheets may reach draft invoices, so backfill through the same gate
+	go a.BackfillApprovedEntriesForProject(projectID)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	return
@@ -1049,9 +1284,14 @@ func (a *App) ClientInvoiceHandler(w http.ResponseWriter, r *http.Request) {
 	// Find the invoices associated with these projects
 	var invoices []cronos.Invoice
 	a.cronosApp.DB.Preload("Project").Where("project_id in ? and state != ? and type = ?", projectIDs, cronos.InvoiceStateVoid, cronos.InvoiceTypeAR).Find(&invoices)
+	// Attach the payment link to each invoice so clients can pay directly from the portal
+	clientInvoices := make([]ClientInvoice, len(invoices))
+	for i, invoice := range invoices {
+		clientInvoices[i] = ClientInvoice{Invoice: invoice, PaymentURL: a.invoicePaymentURL(invoice.ID)}
+	}
 	// Retrieve the draft invoices associated with this company
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	_ = json.NewEncoder(w).Encode(invoices)
+	_ = json.NewEncoder(w).Encode(clientInvoices)
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Kinds of record that can be archived, named after their API routes
+const (
+	ArchiveKindProject     = "projects"
+	ArchiveKindAccount     = "accounts"
+	ArchiveKindRate        = "rates"
+	ArchiveKindBillingCode = "billing_codes"
+	ArchiveKindEntry       = "entries"
+	ArchiveKindAdjustment  = "adjustments"
+)
+
+// archiveKind describes how to find, name and check the references of one kind of archivable record
+type archiveKind struct {
+	model      func() interface{}
+	nameColumn string
+	// blockers explains why a record cannot be archived, or is empty when archiving it is safe
+	blockers func(a *App, id string) []string
+	// restoreBlockers explains why an archived record cannot be restored, or is empty when it can be
+	restoreBlockers func(a *App, id string) []string
+}
+
+// issuedInvoiceStates are the states of an invoice that has been approved for sending to a client
+var issuedInvoiceStates = []string{cronos.InvoiceStateApproved.String(), cronos.InvoiceStateSent.String(), cronos.InvoiceStatePaid.String()}
+
+// archiveKinds lists every archivable kind of record. Archiving uses the soft delete of gorm.Model, so an archived
+// record is hidden from every list and lookup until it is restored.
+var archiveKinds = map[string]archiveKind{
+	ArchiveKindProject: {
+		model:      func() interface{} { return &cronos.Project{} },
+		nameColumn: "name",
+		blockers: func(a *App, id string) []string {
+			var reasons []string
+			reasons = appendCount(reasons, a.cronosApp.DB.Model(&cronos.Invoice{}).
+				Where("project_id = ? and type = ? and state in ?", id, cronos.InvoiceTypeAR.String(), issuedInvoiceStates),
+				"The project has %d approved, sent or paid invoices")
+			reasons = appendCount(reasons, a.cronosApp.DB.Model(&cronos.BillingCode{}).Where("project_id = ?", id),
+				"The project has %d billing codes that must be archived first")
+			return reasons
+		},
+		restoreBlockers: func(a *App, id string) []string {
+			return archivedParent(a, &cronos.Project{}, id, "account_id", &cronos.Account{}, "account")
+		},
+	},
+	ArchiveKindAccount: {
+		model:      func() interface{} { return &cronos.Account{} },
+		nameColumn: "name",
+		blockers: func(a *App, id string) []string {
+			var reasons []string
+			reasons = appendCount(reasons, a.cronosApp.DB.Model(&cronos.Invoice{}).
+				Where("account_id = ? and type = ? and state in ?", id, cronos.InvoiceTypeAR.String(), issuedInvoiceStates),
+				"The account has %d approved, sent or paid invoices")
+			reasons = appendCount(reasons, a.cronosApp.DB.Model(&cronos.Project{}).Where("account_id = ?", id),
+				"The account has %d projects that must be archived first")
+			return reasons
+		},
+		restoreBlockers: func(a *App, id string) []string { return nil },
+	},
+	ArchiveKindRate: {
+		model:      func() interface{} { return &cronos.Rate{} },
+		nameColumn: "name",
+		blockers: func(a *App, id string) []string {
+			return appendCount(nil, a.cronosApp.DB.Model(&cronos.BillingCode{}).Where("rate_id = ? or internal_rate_id = ?", id, id),
+				"The rate is used by %d billing codes")
+		},
+		restoreBlockers: func(a *App, id string) []string { return nil },
+	},
+	ArchiveKindBillingCode: {
+		model:      func() interface{} { return &cronos.BillingCode{} },
+		nameColumn: "code",
+		blockers: func(a *App, id string) []string {
+			return appendCount(nil, a.cronosApp.DB.Model(&cronos.Entry{}).Where("billing_code_id = ? and state != ?", id, cronos.EntryStateVoid.String()),
+				"The billing code has %d entries that are not void")
+		},
+		restoreBlockers: func(a *App, id string) []string {
+			reasons := archivedParent(a, &cronos.BillingCode{}, id, "project_id", &cronos.Project{}, "project")
+			reasons = append(reasons, archivedParent(a, &cronos.BillingCode{}, id, "rate_id", &cronos.Rate{}, "rate")...)
+			return append(reasons, archivedParent(a, &cronos.BillingCode{}, id, "internal_rate_id", &cronos.Rate{}, "internal rate")...)
+		},
+	},
+	ArchiveKindEntry: {
+		model:      func() interface{} { return &cronos.Entry{} },
+		nameColumn: "notes",
+		blockers: func(a *App, id string) []string {
+			var entry cronos.Entry
+			a.cronosApp.DB.Where("id = ?", id).Limit(1).Find(&entry)
+			if entry.State != cronos.EntryStateDraft.String() && entry.State != cronos.EntryStateVoid.String() {
+				return []string{"The entry is on an approved, sent or paid invoice and must be voided instead"}
+			}
+			return nil
+		},
+		restoreBlockers: func(a *App, id string) []string {
+			var entry cronos.Entry
+			a.cronosApp.DB.Unscoped().Where("id = ?", id).Limit(1).Find(&entry)
+			reasons := archivedParent(a, &cronos.Entry{}, id, "billing_code_id", &cronos.BillingCode{}, "billing code")
+			if len(reasons) > 0 {
+				return reasons
+			}
+			if entry.State == cronos.EntryStateVoid.String() {
+				if period, closed := a.closedPeriod(entry.Start); closed {
+					reasons = append(reasons, closedPeriodMessage(period))
+				}
+				return reasons
+			}
+			// A restored entry counts again, so it is held to the same checks as a new one, including budgets,
+			// overlaps and locked timesheets
+			for _, err := range a.ValidateEntry(&entry) {
+				reasons = append(reasons, err.Message)
+			}
+			return reasons
+		},
+	},
+	ArchiveKindAdjustment: {
+		model:      func() interface{} { return &cronos.Adjustment{} },
+		nameColumn: "notes",
+		blockers: func(a *App, id string) []string {
+			var issued int64
+			a.cronosApp.DB.Model(&cronos.Adjustment{}).
+				Joins("JOIN invoices ON invoices.id = adjustments.invoice_id").
+				Where("adjustments.id = ? and adjustments.state != ? and invoices.state in ?", id, cronos.AdjustmentStateVoid.String(), issuedInvoiceStates).
+				Count(&issued)
+			if issued > 0 {
+				return []string{"The adjustment is on an approved, sent or paid invoice and must be voided instead"}
+			}
+			var adjustment cronos.Adjustment
+			a.cronosApp.DB.Where("id = ?", id).Limit(1).Find(&adjustment)
+			if adjustment.State != cronos.AdjustmentStateVoid.String() && a.billAdjustmentLocked(adjustment) {
+				return []string{"The adjustment is on an approved or paid bill and must be voided instead"}
+			}
+			return nil
+		},
+		restoreBlockers: func(a *App, id string) []string {
+			var adjustment cronos.Adjustment
+			a.cronosApp.DB.Unscoped().Where("id = ?", id).Limit(1).Find(&adjustment)
+			if period, closed := a.invoicePeriodClosed(adjustment.InvoiceID); closed {
+				return []string{closedPeriodMessage(period)}
+			}
+			if a.billAdjustmentLocked(adjustment) {
+				return []string{"The adjustment is on an approved or paid bill, which can no longer change"}
+			}
+			return nil
+		},
+	},
+}
+
+// billAdjustmentLocked reports whether an adjustment is on a bill that has been approved or paid, whose total can no
+// longer change
+func (a *App) billAdjustmentLocked(adjustment cronos.Adjustment) bool {
+	if adjustment.BillID == nil {
+		return false
+	}
+	var bill cronos.Bill
+	if a.cronosApp.DB.Where("id = ?", *adjustment.BillID).Limit(1).Find(&bill).RowsAffected == 0 {
+		return false
+	}
+	state := a.billStatus(bill).State
+	return state == BillStateApproved || state == BillStatePaid
+}
+
+// appendCount adds a reason when the query counts any rows, with the count formatted into the message
+func appendCount(reasons []string, query *gorm.DB, message string) []string {
+	var count int64
+	query.Count(&count)
+	if count > 0 {
+		reasons = append(reasons, fmt.Sprintf(message, count))
+	}
+	return reasons
+}
+
+// archivedParent explains that a record cannot be restored while the record its column refers to is archived
+func archivedParent(a *App, model interface{}, id string, column string, parent interface{}, parentName string) []string {
+	var parentID uint
+	a.cronosApp.DB.Unscoped().Model(model).Where("id = ?", id).Pluck(column, &parentID)
+	if parentID == 0 {
+		return nil
+	}
+	if a.cronosApp.DB.Where("id = ?", parentID).Limit(1).Find(parent).RowsAffected == 0 {
+		return []string{fmt.Sprintf("The %s %d is archived and must be restored first", parentName, parentID)}
+	}
+	return nil
+}
+
+// writeArchiveConflict responds with a 409 listing the reasons the action is unsafe
+func writeArchiveConflict(w http.ResponseWriter, reasons []string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"errors": reasons})
+}
+
+// canArchive checks that the user is an admin and that nothing still depends on the record, writing a 403 or 409
+// and returning false if the record cannot be archived. The caller's Delete then archives the record.
+func (a *App) canArchive(w http.ResponseWriter, r *http.Request, kind string, id string) bool {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	if reasons := archiveKinds[kind].blockers(a, id); len(reasons) > 0 {
+		writeArchiveConflict(w, reasons)
+		return false
+	}
+	return true
+}
+
+// TrashItem is an archived record
+type TrashItem struct {
+	Kind      string    `json:"kind"`
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// TrashListHandler lists archived records for admins, most recently archived first, optionally of one `kind`
+func (a *App) TrashListHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	trash := []TrashItem{}
+	for name, kind := range archiveKinds {
+		if filter := r.URL.Query().Get("kind"); filter != "" && filter != name {
+			continue
+		}
+		var items []TrashItem
+		a.cronosApp.DB.Unscoped().Model(kind.model()).Select("id, " + kind.nameColumn + " as name, deleted_at").
+			Where("deleted_at is not null").Scan(&items)
+		for i := range items {
+			items[i].Kind = name
+		}
+		trash = append(trash, items...)
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.After(trash[j].DeletedAt)
+	})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&trash)
+}
+
+// RestoreHandler lets an admin restore an archived record, as long as the records it belongs to are not archived
+// and it is not dated in a closed period. Entries must also pass the same validation as a new entry.
+func (a *App) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	kind, ok := archiveKinds[vars["kind"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if a.cronosApp.DB.Unscoped().Model(kind.model()).Where("id = ? and deleted_at is not null", vars["id"]).Limit(1).Find(kind.model()).RowsAffected == 0 {
+		http.Error(w, "No archived record with that ID", http.StatusNotFound)
+		return
+	}
+	if reasons := kind.restoreBlockers(a, vars["id"]); len(reasons) > 0 {
+		writeArchiveConflict(w, reasons)
+		return
+	}
+	a.cronosApp.DB.Unscoped().Model(kind.model()).Where("id = ?", vars["id"]).Update("deleted_at", nil)
+
+	record := kind.model()
+	a.cronosApp.DB.First(record, vars["id"])
+	// A restored entry or adjustment counts towards its draft invoice again
+	switch restored := record.(type) {
+	case *cronos.Entry:
+		a.SnapshotDraftInvoiceForEntry(restored.ID, contextUserID(r))
+	case *cronos.Adjustment:
+		a.SnapshotDraftInvoiceForAdjustment(restored, contextUserID(r))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(record)
+}
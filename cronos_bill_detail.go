@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+)
+
+// BillEntryLine is an entry paid on a bill at the employee's internal rate
+type BillEntryLine struct {
+	EntryID      uint      `json:"entry_id"`
+	Date         time.Time `json:"date"`
+	ProjectID    uint      `json:"project_id"`
+	ProjectName  string    `json:"project_name"`
+	BillingCode  string    `json:"billing_code"`
+	Notes        string    `json:"notes"`
+	Hours        float64   `json:"hours"`
+	InternalRate float64   `json:"internal_rate"`
+	Amount       float64   `json:"amount"`
+}
+
+// BillAdjustmentLine is a commission or other adjustment added to a bill
+type BillAdjustmentLine struct {
+	AdjustmentID uint    `json:"adjustment_id"`
+	Type         string  `json:"type"`
+	Notes        string  `json:"notes"`
+	Amount       float64 `json:"amount"`
+}
+
+// BillDetail is a bill along with the entries, commissions and adjustments that make up its totals
+type BillDetail struct {
+	cronos.Bill
+	Status          BillStatus           `json:"status"`
+	Lines           []BillEntryLine      `json:"lines"`
+	Commissions     []BillAdjustmentLine `json:"commissions"`
+	Adjustments     []BillAdjustmentLine `json:"adjustments"`
+	EntriesTotal    float64              `json:"entries_total"`
+	CommissionTotal float64              `json:"commission_total"`
+}
+
+// billDetail loads the breakdown of a bill. Commission adjustments are told apart from other adjustments by type.
+func (a *App) billDetail(bill cronos.Bill) BillDetail {
+	detail := BillDetail{
+		Bill:        bill,
+		Status:      a.billStatus(bill),
+		Lines:       []BillEntryLine{},
+		Commissions: []BillAdjustmentLine{},
+		Adjustments: []BillAdjustmentLine{},
+	}
+
+	var entries []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode.InternalRate").Where("bill_id = ?", bill.ID).Order("start ASC").Find(&entries)
+	projectNames := make(map[uint]string)
+	for _, entry := range entries {
+		if _, ok := projectNames[entry.ProjectID]; !ok {
+			var project cronos.Project
+			a.cronosApp.DB.Unscoped().Where("id = ?", entry.ProjectID).Limit(1).Find(&project)
+			projectNames[entry.ProjectID] = project.Name
+		}
+		hours := entry.Duration().Hours()
+		line := BillEntryLine{
+			EntryID:      entry.ID,
+			Date:         entry.Start,
+			ProjectID:    entry.ProjectID,
+			ProjectName:  projectNames[entry.ProjectID],
+			BillingCode:  entry.BillingCode.Code,
+			Notes:        entry.Notes,
+			Hours:        hours,
+			InternalRate: entry.BillingCode.InternalRate.Amount,
+			Amount:       hours * entry.BillingCode.InternalRate.Amount,
+		}
+		detail.EntriesTotal += line.Amount
+		detail.Lines = append(detail.Lines, line)
+	}
+
+	var adjustments []cronos.Adjustment
+	a.cronosApp.DB.Where("bill_id = ? and state != ?", bill.ID, cronos.AdjustmentStateVoid.String()).Order("created_at ASC").Find(&adjustments)
+	for _, adjustment := range adjustments {
+		line := BillAdjustmentLine{AdjustmentID: adjustment.ID, Type: adjustment.Type, Notes: adjustment.Notes, Amount: adjustment.Amount}
+		if strings.Contains(strings.ToUpper(adjustment.Type), "COMMISSION") {
+			detail.CommissionTotal += line.Amount
+			detail.Commissions = append(detail.Commissions, line)
+		} else {
+			detail.Adjustments = append(detail.Adjustments, line)
+		}
+	}
+	return detail
+}
+
+// contextEmployee loads the employee record of the user making the request
+func (a *App) contextEmployee(r *http.Request) (cronos.Employee, bool) {
+	var employee cronos.Employee
+	found := a.cronosApp.DB.Where("user_id = ?", contextUserID(r)).Limit(1).Find(&employee).RowsAffected > 0
+	return employee, found
+}
+
+// canViewBill reports whether the user making the request is an admin or the employee the bill pays
+func (a *App) canViewBill(r *http.Request, bill cronos.Bill) bool {
+	if a.contextUserIsAdmin(r) {
+		return true
+	}
+	employee, found := a.contextEmployee(r)
+	return found && employee.ID == bill.Employee.ID
+}
+
+// writeBillCSV responds with the bill breakdown as a CSV attachment, one row per entry followed by commissions and
+// adjustments
+func writeBillCSV(w http.ResponseWriter, detail BillDetail) {
+	rows := [][]string{{"type", "date", "project", "billing_code", "notes", "hours", "internal_rate", "amount"}}
+	for _, line := range detail.Lines {
+		rows = append(rows, []string{"entry", line.Date.Format("2006-01-02"), line.ProjectName, line.BillingCode, line.Notes,
+			formatDecimal(line.Hours), formatDecimal(line.InternalRate), formatDecimal(line.Amount)})
+	}
+	for _, line := range detail.Commissions {
+		rows = append(rows, []string{"commission", "", "", "", line.Notes, "", "", formatDecimal(line.Amount)})
+	}
+	for _, line := range detail.Adjustments {
+		rows = append(rows, []string{"adjustment", "", "", "", line.Notes, "", "", formatDecimal(line.Amount)})
+	}
+	rows = append(rows, []string{"total", "", "", "", "", formatDecimal(detail.TotalHours), "", formatDecimal(detail.TotalAmount)})
+	writeCSV(w, "bill_"+strconv.Itoa(int(detail.ID)), detail.PeriodStart, detail.PeriodEnd.AddDate(0, 0, 1), rows)
+}
+
+// MyBillsListHandler lists the bills paying the employee making the request, leaving out voided bills
+func (a *App) MyBillsListHandler(w http.ResponseWriter, r *http.Request) {
+	bills := []cronos.Bill{}
+	if employee, found := a.contextEmployee(r); found {
+		a.cronosApp.DB.Preload("Employee").Where("employee_id = ? and id not in (?)", employee.ID, a.voidBillIDs()).
+			Order("period_end DESC").Find(&bills)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&bills)
+}
+
+// BillCSVHandler downloads the breakdown of a bill as CSV, for admins or the employee the bill pays
+func (a *App) BillCSVHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var bill cronos.Bill
+	if a.cronosApp.DB.Preload("Employee").Where("id = ?", vars["id"]).Limit(1).Find(&bill).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !a.canViewBill(r, bill) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	writeBillCSV(w, a.billDetail(bill))
+}
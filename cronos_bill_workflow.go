@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Bill states. Bills are generated as drafts, approved by an admin and then paid, and can be voided without being
+// deleted so that their history is kept.
+const (
+	BillStateDraft    = "draft"
+	BillStateApproved = "approved"
+	BillStatePaid     = "paid"
+	BillStateVoid     = "void"
+)
+
+// Bill actions recorded in a bill's history
+const (
+	BillActionApprove     = "approve"
+	BillActionAcknowledge = "acknowledge"
+	BillActionPaid        = "paid"
+	BillActionVoid        = "void"
+)
+
+// BillStatus tracks the approval state of a cronos bill. Bills without a status are drafts, unless cronos has
+// already closed them as paid.
+type BillStatus struct {
+	gorm.Model
+	BillID         uint        `json:"bill_id" gorm:"uniqueIndex"`
+	State          string      `json:"state"`
+	ApprovedAt     *time.Time  `json:"approved_at"`
+	AcknowledgedAt *time.Time  `json:"acknowledged_at"`
+	PaidAt         *time.Time  `json:"paid_at"`
+	VoidedAt       *time.Time  `json:"voided_at"`
+	Events         []BillEvent `json:"events" gorm:"foreignKey:BillID;references:BillID"`
+}
+
+// BillEvent records who moved a bill between states and why. Voiding a paid bill records the reference of the
+// reversal that recovered the payment.
+type BillEvent struct {
+	gorm.Model
+	BillID    uint   `json:"bill_id" gorm:"index"`
+	Action    string `json:"action"`
+	FromState string `json:"from_state"`
+	ToState   string `json:"to_state"`
+	UserID    uint   `json:"user_id"`
+	UserName  string `json:"user_name"`
+	Reason    string `json:"reason"`
+	Reference string `json:"reference"`
+}
+
+// billStatus loads the status of a bill along with its history
+func (a *App) billStatus(bill cronos.Bill) BillStatus {
+	status := BillStatus{BillID: bill.ID, State: BillStateDraft}
+	a.cronosApp.DB.Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC")
+	}).Where("bill_id = ?", bill.ID).Limit(1).Find(&status)
+	if status.ID == 0 && bill.ClosedAt != nil {
+		status.State = BillStatePaid
+		status.PaidAt = bill.ClosedAt
+	}
+	if status.Events == nil {
+		status.Events = []BillEvent{}
+	}
+	return status
+}
+
+// voidBillIDs selects the bills that have been voided, so that they can be left out of bill lists
+func (a *App) voidBillIDs() *gorm.DB {
+	return a.cronosApp.DB.Model(&BillStatus{}).Select("bill_id").Where("state = ?", BillStateVoid)
+}
+
+// billTransition checks that an action can be taken on a bill in its current state and returns the new state
+func billTransition(action string, status BillStatus) (string, error) {
+	switch action {
+	case BillActionApprove:
+		if status.State != BillStateDraft {
+			return "", fmt.Errorf("only draft bills can be approved, this bill is %s", status.State)
+		}
+		return BillStateApproved, nil
+	case BillActionAcknowledge:
+		if status.State != BillStateApproved && status.State != BillStatePaid {
+			return "", fmt.Errorf("only approved or paid bills can be acknowledged, this bill is %s", status.State)
+		}
+		if status.AcknowledgedAt != nil {
+			return "", fmt.Errorf("this bill was already acknowledged")
+		}
+		return status.State, nil
+	case BillActionPaid:
+		if status.State != BillStateApproved {
+			return "", fmt.Errorf("only approved bills can be paid, this bill is %s", status.State)
+		}
+		return BillStatePaid, nil
+	case BillActionVoid:
+		if status.State == BillStateVoid {
+			return "", fmt.Errorf("this bill is already void")
+		}
+		return BillStateVoid, nil
+	}
+	return "", fmt.Errorf("unknown bill action %q", action)
+}
+
+// markBillPaid closes a bill and books its journal entries through cronos, then reads the bill back to check that it
+// was closed. cronos does this outside of our transactions, so the paid transition is only recorded once it succeeds.
+func (a *App) markBillPaid(bill *cronos.Bill) error {
+	a.cronosApp.MarkBillPaid(bill)
+	var paid cronos.Bill
+	if a.cronosApp.DB.Where("id = ?", bill.ID).Limit(1).Find(&paid).RowsAffected == 0 || paid.ClosedAt == nil {
+		return fmt.Errorf("bill %d could not be marked paid", bill.ID)
+	}
+	*bill = paid
+	return nil
+}
+
+// recordBillTransition saves the bill's new state and adds the action to its history
+func (a *App) recordBillTransition(tx *gorm.DB, status *BillStatus, action, toState string, r *http.Request) error {
+	var user cronos.User
+	tx.Where("id = ?", contextUserID(r)).Limit(1).Find(&user)
+	userName, _ := a.userDisplayName(user)
+	event := BillEvent{
+		BillID:    status.BillID,
+		Action:    action,
+		FromState: status.State,
+		ToState:   toState,
+		UserID:    user.ID,
+		UserName:  userName,
+		Reason:    r.FormValue("reason"),
+		Reference: r.FormValue("reversal_reference"),
+	}
+	now := time.Now()
+	switch action {
+	case BillActionApprove:
+		status.ApprovedAt = &now
+	case BillActionAcknowledge:
+		status.AcknowledgedAt = &now
+	case BillActionPaid:
+		status.PaidAt = &now
+	case BillActionVoid:
+		status.VoidedAt = &now
+	}
+	status.State = toState
+	if err := tx.Omit("Events").Save(status).Error; err != nil {
+		return err
+	}
+	return tx.Create(&event).Error
+}
+
+// BillAcknowledgeHandler lets the employee a bill pays acknowledge that they agree with it once it is approved
+func (a *App) BillAcknowledgeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var bill cronos.Bill
+	if a.cronosApp.DB.Preload("Employee").Where("id = ?", vars["id"]).Limit(1).Find(&bill).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if employee, found := a.contextEmployee(r); !found || employee.ID != bill.Employee.ID {
+		http.Error(w, "Only the employee paid by a bill can acknowledge it", http.StatusForbidden)
+		return
+	}
+	status := a.billStatus(bill)
+	toState, err := billTransition(BillActionAcknowledge, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		return a.recordBillTransition(tx, &status, BillActionAcknowledge, toState, r)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.billStatus(bill))
+}
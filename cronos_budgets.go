@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// budgetVelocityDays is the window of recent work used to project when a budget will run out
+const budgetVelocityDays = 28
+
+// budgetAlertThresholds are the percentages of a budget at which the AE and project lead are alerted
+var budgetAlertThresholds = []int{50, 80, 100}
+
+// Budget scopes and metrics used to record which alerts have been sent
+const (
+	BudgetScopeProject  = "project"
+	BudgetScopeAccount  = "account"
+	BudgetMetricHours   = "hours"
+	BudgetMetricDollars = "dollars"
+)
+
+// ProjectLead records the employee who leads delivery on a project and receives its budget alerts with the AE
+type ProjectLead struct {
+	gorm.Model
+	ProjectID  uint `json:"project_id" gorm:"uniqueIndex"`
+	EmployeeID uint `json:"employee_id"`
+}
+
+// BudgetAlert records that a budget threshold alert was sent so that each threshold is only alerted once
+type BudgetAlert struct {
+	gorm.Model
+	Scope     string `json:"scope" gorm:"uniqueIndex:idx_budget_alert"`
+	ScopeID   uint   `json:"scope_id" gorm:"uniqueIndex:idx_budget_alert"`
+	Metric    string `json:"metric" gorm:"uniqueIndex:idx_budget_alert"`
+	Threshold int    `json:"threshold" gorm:"uniqueIndex:idx_budget_alert"`
+}
+
+// BudgetMetric is the burn of a single budget, in hours or dollars
+type BudgetMetric struct {
+	Budget            float64    `json:"budget"`
+	Consumed          float64    `json:"consumed"`
+	Remaining         float64    `json:"remaining"`
+	PercentBurned     float64    `json:"percent_burned"`
+	DailyVelocity     float64    `json:"daily_velocity"`
+	ProjectedExhausts *time.Time `json:"projected_exhausts"`
+}
+
+// BudgetStatus reports the hours and dollars consumed against a project or account budget. A metric is omitted
+// when no budget is set for it.
+type BudgetStatus struct {
+	Scope   string        `json:"scope"`
+	ScopeID uint          `json:"scope_id"`
+	Name    string        `json:"name"`
+	Hours   *BudgetMetric `json:"hours,omitempty"`
+	Dollars *BudgetMetric `json:"dollars,omitempty"`
+}
+
+// budgetMetric computes the burn of a budget given everything consumed and what was consumed in the velocity window
+func budgetMetric(budget int, consumed, recent float64, now time.Time) *BudgetMetric {
+	if budget <= 0 {
+		return nil
+	}
+	metric := &BudgetMetric{
+		Budget:        float64(budget),
+		Consumed:      consumed,
+		Remaining:     float64(budget) - consumed,
+		PercentBurned: consumed / float64(budget) * 100,
+		DailyVelocity: recent / budgetVelocityDays,
+	}
+	if metric.Remaining <= 0 {
+		metric.ProjectedExhausts = &now
+	} else if metric.DailyVelocity > 0 {
+		exhausts := now.Add(time.Duration(metric.Remaining / metric.DailyVelocity * float64(24*time.Hour)))
+		metric.ProjectedExhausts = &exhausts
+	}
+	return metric
+}
+
+// budgetEntries loads the non-void, non-internal entries that count towards the budgets of the projects, leaving out
+// the given entry so that an edit is not counted twice. Pass 0 to load every entry.
+func (a *App) budgetEntries(projectIDs []uint, excludeEntryID uint) []cronos.Entry {
+	var entries []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode.Rate").
+		Where("project_id in ? and id != ? and state != ? and internal = ?", projectIDs, excludeEntryID, cronos.EntryStateVoid.String(), false).
+		Find(&entries)
+	return entries
+}
+
+// budgetUsage is the hours and external dollars an entry takes out of its project's budget
+func budgetUsage(entry *cronos.Entry) (hours, dollars float64) {
+	hours = entry.Duration().Hours()
+	return hours, hours * entry.BillingCode.Rate.Amount
+}
+
+// budgetConsumption sums the hours and external dollars of the budgeted entries on the projects, both in total and
+// over the recent velocity window
+func (a *App) budgetConsumption(projectIDs []uint, now time.Time) (hours, dollars, recentHours, recentDollars float64) {
+	entries := a.budgetEntries(projectIDs, 0)
+	windowStart := now.AddDate(0, 0, -budgetVelocityDays)
+	for i := range entries {
+		entryHours, entryDollars := budgetUsage(&entries[i])
+		hours += entryHours
+		dollars += entryDollars
+		if !entries[i].Start.Before(windowStart) && entries[i].Start.Before(now) {
+			recentHours += entryHours
+			recentDollars += entryDollars
+		}
+	}
+	return hours, dollars, recentHours, recentDollars
+}
+
+// ProjectBudgetStatus computes the budget burn of a project
+func (a *App) ProjectBudgetStatus(project cronos.Project, now time.Time) BudgetStatus {
+	hours, dollars, recentHours, recentDollars := a.budgetConsumption([]uint{project.ID}, now)
+	return BudgetStatus{
+		Scope:   BudgetScopeProject,
+		ScopeID: project.ID,
+		Name:    project.Name,
+		Hours:   budgetMetric(project.BudgetHours, hours, recentHours, now),
+		Dollars: budgetMetric(project.BudgetDollars, dollars, recentDollars, now),
+	}
+}
+
+// AccountBudgetStatus computes the budget burn of an account across all of its projects
+func (a *App) AccountBudgetStatus(account cronos.Account, now time.Time) BudgetStatus {
+	var projectIDs []uint
+	a.cronosApp.DB.Model(&cronos.Project{}).Where("account_id = ?", account.ID).Pluck("id", &projectIDs)
+	hours, dollars, recentHours, recentDollars := a.budgetConsumption(projectIDs, now)
+	return BudgetStatus{
+		Scope:   BudgetScopeAccount,
+		ScopeID: account.ID,
+		Name:    account.Name,
+		Hours:   budgetMetric(account.BudgetHours, hours, recentHours, now),
+		Dollars: budgetMetric(account.BudgetDollars, dollars, recentDollars, now),
+	}
+}
+
+// ProjectBudgetHandler provides the budget burn of a project
+func (a *App) ProjectBudgetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var project cronos.Project
+	if a.cronosApp.DB.First(&project, vars["id"]).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.ProjectBudgetStatus(project, time.Now()))
+}
+
+// AccountBudgetHandler provides the budget burn of an account
+func (a *App) AccountBudgetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var account cronos.Account
+	if a.cronosApp.DB.First(&account, vars["id"]).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.AccountBudgetStatus(account, time.Now()))
+}
+
+// setProjectLead assigns the project lead from a submitted `lead_id`, where "null" or 0 removes the lead
+func (a *App) setProjectLead(projectID uint, leadID string) {
+	employeeID, _ := strconv.ParseUint(leadID, 10, 64)
+	if employeeID == 0 {
+		a.cronosApp.DB.Unscoped().Where("project_id = ?", projectID).Delete(&ProjectLead{})
+		return
+	}
+	lead := ProjectLead{ProjectID: projectID}
+	a.cronosApp.DB.Where("project_id = ?", projectID).Limit(1).Find(&lead)
+	lead.EmployeeID = uint(employeeID)
+	a.cronosApp.DB.Save(&lead)
+}
+
+// budgetAlertRecipients finds the AEs and project leads of the projects, without duplicates
+func (a *App) budgetAlertRecipients(projects []cronos.Project) []cronos.Employee {
+	employeeIDs := make(map[uint]bool)
+	for _, project := range projects {
+		if project.AEID != nil {
+			employeeIDs[*project.AEID] = true
+		}
+		var lead ProjectLead
+		if a.cronosApp.DB.Where("project_id = ?", project.ID).Limit(1).Find(&lead).RowsAffected > 0 {
+			employeeIDs[lead.EmployeeID] = true
+		}
+	}
+	var employees []cronos.Employee
+	for id := range employeeIDs {
+		var employee cronos.Employee
+		if a.cronosApp.DB.Where("id = ?", id).Limit(1).Find(&employee).RowsAffected > 0 {
+			employees = append(employees, employee)
+		}
+	}
+	return employees
+}
+
+// crossedThresholds returns the alert thresholds a metric has reached that have not yet been alerted, recording
+// them as alerted
+func (a *App) crossedThresholds(status BudgetStatus, metricName string, metric *BudgetMetric) []int {
+	if metric == nil {
+		return nil
+	}
+	var crossed []int
+	for _, threshold := range budgetAlertThresholds {
+		if metric.PercentBurned < float64(threshold) {
+			continue
+		}
+		alert := BudgetAlert{Scope: status.Scope, ScopeID: status.ScopeID, Metric: metricName, Threshold: threshold}
+		if a.cronosApp.DB.Where(&alert).Limit(1).Find(&BudgetAlert{}).RowsAffected > 0 {
+			continue
+		}
+		a.cronosApp.DB.Create(&alert)
+		crossed = append(crossed, threshold)
+	}
+	return crossed
+}
+
+// sendBudgetAlert emails the recipients and posts to Slack that a budget has passed a threshold
+func (a *App) sendBudgetAlert(status BudgetStatus, metricName string, metric *BudgetMetric, threshold int, recipients []cronos.Employee) {
+	unit := func(value float64) string {
+		if metricName == BudgetMetricDollars {
+			return fmt.Sprintf("$%.2f", value)
+		}
+		return fmt.Sprintf("%.2f hours", value)
+	}
+	message := fmt.Sprintf("The %s %s has used %.0f%% of its %s budget: %s of %s consumed, %s remaining.",
+		status.Scope, status.Name, math.Floor(metric.PercentBurned), metricName, unit(metric.Consumed), unit(metric.Budget), unit(metric.Remaining))
+	if metric.ProjectedExhausts != nil && metric.Remaining > 0 {
+		message += fmt.Sprintf(" At the current pace it will be exhausted on %s.", metric.ProjectedExhausts.Format("January 2, 2006"))
+	}
+
+	for _, recipient := range recipients {
+		email := a.employeeEmail(recipient)
+		if email == "" {
+			continue
+		}
+		err := a.cronosApp.SendTextEmail(cronos.Email{
+			SenderEmail:      "accounts@snowpack-data.io",
+			SenderName:       "Cronos",
+			RecipientEmail:   email,
+			RecipientName:    recipient.FirstName + " " + recipient.LastName,
+			Subject:          fmt.Sprintf("%s has reached %d%% of its %s budget", status.Name, threshold, metricName),
+			PlainTextContent: message,
+		})
+		if err != nil {
+			log.Printf("Error emailing budget alert for %s %d: %v", status.Scope, status.ScopeID, err)
+		}
+	}
+
+	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
+	if webhookURL != "" {
+		names := make([]string, len(recipients))
+		for i, recipient := range recipients {
+			names[i] = recipient.FirstName + " " + recipient.LastName
+		}
+		if len(names) > 0 {
+			message += " cc " + strings.Join(names, ", ")
+		}
+		a.sendSlackNotification(map[string]string{"text": message}, webhookURL)
+	}
+}
+
+// alertBudget sends an alert for the highest newly crossed threshold of each metric
+func (a *App) alertBudget(status BudgetStatus, recipients []cronos.Employee) {
+	metrics := map[string]*BudgetMetric{BudgetMetricHours: status.Hours, BudgetMetricDollars: status.Dollars}
+	for metricName, metric := range metrics {
+		// When several thresholds are crossed at once only the highest is worth telling anyone about
+		if crossed := a.crossedThresholds(status, metricName, metric); len(crossed) > 0 {
+			a.sendBudgetAlert(status, metricName, metric, crossed[len(crossed)-1], recipients)
+		}
+	}
+}
+
+// CheckBudgetAlerts alerts the AE and project lead of every active project, and of every project on an account,
+// whose budget has crossed an alert threshold since the last check
+func (a *App) CheckBudgetAlerts(now time.Time) {
+	var projects []cronos.Project
+	a.cronosApp.DB.Where("budget_hours > 0 or budget_dollars > 0").Find(&projects)
+	for _, project := range projects {
+		if !project.ActiveEnd.IsZero() && project.ActiveEnd.Before(now.AddDate(0, 0, -budgetVelocityDays)) {
+			continue
+		}
+		a.alertBudget(a.ProjectBudgetStatus(project, now), a.budgetAlertRecipients([]cronos.Project{project}))
+	}
+
+	var accounts []cronos.Account
+	a.cronosApp.DB.Where("budget_hours > 0 or budget_dollars > 0").Find(&accounts)
+	for _, account := range accounts {
+		var accountProjects []cronos.Project
+		a.cronosApp.DB.Where("account_id = ?", account.ID).Find(&accountProjects)
+		a.alertBudget(a.AccountBudgetStatus(account, now), a.budgetAlertRecipients(accountProjects))
+	}
+}
+
+// RunBudgetAlerts checks budgets for alerts on a fixed interval until the process exits
+func (a *App) RunBudgetAlerts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.CheckBudgetAlerts(time.Now())
+		<-ticker.C
+	}
+}
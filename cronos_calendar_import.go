@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// maxCalendarSize caps the size of an uploaded or fetched calendar
+const maxCalendarSize = 10 << 20
+
+// maxRecurrences bounds how many instances of a single recurring event are expanded
+const maxRecurrences = 5000
+
+// sharedAddressSpace is the carrier grade NAT range, which is not routable on the public internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// errCalendarAddress is returned when a calendar url resolves to an address on our own network
+var errCalendarAddress = errors.New("calendar url must be on the public internet")
+
+// checkCalendarAddress is called with the resolved address of every connection made to fetch a calendar, including
+// those made to follow redirects, and rejects anything that is not a public address
+var checkCalendarAddress = func(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) ||
+		ip.To4() != nil && ip.To4()[0] == 0 {
+		return errCalendarAddress
+	}
+	return nil
+}
+
+// calendarClient fetches subscribed calendars. The address is checked once it has been resolved, as the dialer is
+// about to connect, so that neither a redirect nor a host that resolves to an internal address can reach our network.
+// Proxies are not used as the dialer would only see the proxy's address.
+var calendarClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				return checkCalendarAddress(address)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("calendar url must be an http, https or webcal url")
+		}
+		return nil
+	},
+}
+
+// icsWeekdays maps iCalendar BYDAY weekday codes to their weekday
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// CalendarEvent is a single timed occurrence of a calendar event. Recurring events are expanded into one
+// CalendarEvent per occurrence, each with its own key.
+type CalendarEvent struct {
+	Key           string    `json:"key"`
+	UID           string    `json:"uid"`
+	Summary       string    `json:"summary"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Attendees     []string  `json:"attendees"`
+	BillingCodeID uint      `json:"billing_code_id"`
+	RuleID        uint      `json:"rule_id"`
+	Imported      bool      `json:"imported"`
+	override      bool
+	cancelled     bool
+}
+
+// CalendarMappingRule suggests a billing code for calendar events by attendee email domain, title keyword, or both.
+// Rules are tried in priority order, lowest first, and the first match wins.
+type CalendarMappingRule struct {
+	gorm.Model
+	EmployeeID     uint   `json:"employee_id" gorm:"index"`
+	BillingCodeID  uint   `json:"billing_code_id"`
+	AttendeeDomain string `json:"attendee_domain"`
+	TitleKeyword   string `json:"title_keyword"`
+	Priority       int    `json:"priority"`
+}
+
+// CalendarImportedEvent records an event occurrence that has been turned into an entry so it is only imported once
+type CalendarImportedEvent struct {
+	gorm.Model
+	EmployeeID uint   `json:"employee_id" gorm:"uniqueIndex:idx_calendar_event"`
+	EventKey   string `json:"event_key" gorm:"uniqueIndex:idx_calendar_event"`
+	EntryID    uint   `json:"entry_id"`
+}
+
+// icsProperty is a content line from an iCalendar file split into its name, parameters and value
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// readICSProperties unfolds the content lines of an iCalendar file and parses each into a property
+func readICSProperties(r io.Reader) ([]icsProperty, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCalendarSize)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	properties := make([]icsProperty, 0, len(lines))
+	for _, line := range lines {
+		nameAndParams, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		parts := strings.Split(nameAndParams, ";")
+		property := icsProperty{Name: strings.ToUpper(parts[0]), Params: make(map[string]string), Value: value}
+		for _, param := range parts[1:] {
+			if key, paramValue, ok := strings.Cut(param, "="); ok {
+				property.Params[strings.ToUpper(key)] = strings.Trim(paramValue, "\"")
+			}
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// parseICSTime converts a DTSTART, DTEND or similar property to wall clock time in the importer's time zone, which
+// is how entry times are stored. All day dates return an error as they cannot become time entries.
+func parseICSTime(property icsProperty, loc *time.Location) (time.Time, error) {
+	if property.Params["VALUE"] == "DATE" || len(property.Value) == 8 {
+		return time.Time{}, errors.New("all day event")
+	}
+	var t time.Time
+	var err error
+	switch {
+	case strings.HasSuffix(property.Value, "Z"):
+		t, err = time.Parse("20060102T150405Z", property.Value)
+		t = t.In(loc)
+	case property.Params["TZID"] != "":
+		eventLoc, locErr := time.LoadLocation(property.Params["TZID"])
+		if locErr != nil {
+			eventLoc = loc
+		}
+		t, err = time.ParseInLocation("20060102T150405", property.Value, eventLoc)
+		t = t.In(loc)
+	default:
+		t, err = time.ParseInLocation("20060102T150405", property.Value, loc)
+	}
+	if err != nil {
+		return t, err
+	}
+	return wallClock(t, loc), nil
+}
+
+// wallClock returns the wall clock time of t in loc as a UTC time, which is how entry times are stored
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// parseICSDuration parses the subset of iCalendar durations used by meeting invites, such as PT1H30M or P1D
+func parseICSDuration(value string) (time.Duration, error) {
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	var duration time.Duration
+	number := ""
+	inTime := false
+	for _, c := range value[1:] {
+		switch {
+		case c == 'T':
+			inTime = true
+		case c >= '0' && c <= '9':
+			number += string(c)
+		default:
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			number = ""
+			switch {
+			case c == 'W':
+				duration += time.Duration(n) * 7 * 24 * time.Hour
+			case c == 'D':
+				duration += time.Duration(n) * 24 * time.Hour
+			case c == 'H' && inTime:
+				duration += time.Duration(n) * time.Hour
+			case c == 'M' && inTime:
+				duration += time.Duration(n) * time.Minute
+			case c == 'S' && inTime:
+				duration += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+		}
+	}
+	return duration, nil
+}
+
+// expandRecurrence lists the start times of a recurring event that begin before `until`. Daily and weekly rules
+// with INTERVAL, COUNT, UNTIL and weekly BYDAY are supported, which covers standing meetings. Other rules only
+// produce the first occurrence.
+func expandRecurrence(start time.Time, rrule string, until time.Time, loc *time.Location) []time.Time {
+	parts := make(map[string]string)
+	for _, part := range strings.Split(rrule, ";") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			parts[strings.ToUpper(key)] = value
+		}
+	}
+	interval, _ := strconv.Atoi(parts["INTERVAL"])
+	if interval < 1 {
+		interval = 1
+	}
+	count, _ := strconv.Atoi(parts["COUNT"])
+	if parts["UNTIL"] != "" {
+		if ruleUntil, err := parseICSTime(icsProperty{Value: parts["UNTIL"], Params: map[string]string{}}, loc); err == nil && ruleUntil.Before(until) {
+			until = ruleUntil.Add(time.Second)
+		} else if ruleDate, err := time.Parse("20060102", parts["UNTIL"]); err == nil && ruleDate.AddDate(0, 0, 1).Before(until) {
+			until = ruleDate.AddDate(0, 0, 1)
+		}
+	}
+
+	var weekdays map[time.Weekday]bool
+	if parts["BYDAY"] != "" {
+		weekdays = make(map[time.Weekday]bool)
+		for _, day := range strings.Split(parts["BYDAY"], ",") {
+			// Ordinal prefixes such as 1MO only apply to monthly rules so only the weekday code is read
+			if len(day) >= 2 {
+				if weekday, ok := icsWeekdays[strings.ToUpper(day[len(day)-2:])]; ok {
+					weekdays[weekday] = true
+				}
+			}
+		}
+	}
+
+	var starts []time.Time
+	switch parts["FREQ"] {
+	case "DAILY":
+		for t := start; t.Before(until) && len(starts) < maxRecurrences && (count == 0 || len(starts) < count); t = t.AddDate(0, 0, interval) {
+			starts = append(starts, t)
+		}
+	case "WEEKLY":
+		if weekdays == nil {
+			weekdays = map[time.Weekday]bool{start.Weekday(): true}
+		}
+		week := weekStart(start)
+		for ; week.Before(until) && len(starts) < maxRecurrences; week = week.AddDate(0, 0, 7*interval) {
+			for i := 0; i < 7; i++ {
+				day := week.AddDate(0, 0, i)
+				t := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+				if !weekdays[t.Weekday()] || t.Before(start) || !t.Before(until) || (count > 0 && len(starts) >= count) {
+					continue
+				}
+				starts = append(starts, t)
+			}
+			if count > 0 && len(starts) >= count {
+				break
+			}
+		}
+	default:
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// ParseCalendar reads the timed events in an iCalendar file that start within [from, to), expanding recurring
+// events and skipping cancelled occurrences and all day events. Times are converted to wall clock time in loc.
+func ParseCalendar(r io.Reader, from, to time.Time, loc *time.Location) ([]CalendarEvent, error) {
+	properties, err := readICSProperties(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []CalendarEvent
+	var current []icsProperty
+	inEvent := false
+	for _, property := range properties {
+		switch {
+		case property.Name == "BEGIN" && property.Value == "VEVENT":
+			inEvent = true
+			current = nil
+		case property.Name == "END" && property.Value == "VEVENT":
+			inEvent = false
+			events = append(events, calendarEventOccurrences(current, from, to, loc)...)
+		case inEvent:
+			current = append(current, property)
+		}
+	}
+
+	// Occurrences that were rescheduled or cancelled appear as separate events with a RECURRENCE-ID, which replace
+	// the occurrence expanded from the recurring event
+	unique := make(map[string]CalendarEvent)
+	for _, event := range events {
+		if existing, ok := unique[event.Key]; !ok || event.override || !existing.override {
+			unique[event.Key] = event
+		}
+	}
+	events = events[:0]
+	for _, event := range unique {
+		if !event.cancelled && !event.Start.Before(from) && event.Start.Before(to) {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events, nil
+}
+
+// calendarEventOccurrences converts the properties of one VEVENT into its occurrences
+func calendarEventOccurrences(properties []icsProperty, from, to time.Time, loc *time.Location) []CalendarEvent {
+	var event CalendarEvent
+	var start, end, recurrenceID time.Time
+	var duration time.Duration
+	var rrule string
+	cancelled := false
+	excluded := make(map[time.Time]bool)
+	for _, property := range properties {
+		switch property.Name {
+		case "UID":
+			event.UID = property.Value
+		case "SUMMARY":
+			event.Summary = strings.NewReplacer("\\,", ",", "\\;", ";", "\\n", " ", "\\\\", "\\").Replace(property.Value)
+		case "STATUS":
+			cancelled = strings.EqualFold(property.Value, "CANCELLED")
+		case "DTSTART":
+			var err error
+			if start, err = parseICSTime(property, loc); err != nil {
+				return nil
+			}
+		case "DTEND":
+			end, _ = parseICSTime(property, loc)
+		case "DURATION":
+			duration, _ = parseICSDuration(property.Value)
+		case "RRULE":
+			rrule = property.Value
+		case "RECURRENCE-ID":
+			recurrenceID, _ = parseICSTime(property, loc)
+		case "EXDATE":
+			for _, value := range strings.Split(property.Value, ",") {
+				if exdate, err := parseICSTime(icsProperty{Value: value, Params: property.Params}, loc); err == nil {
+					excluded[exdate] = true
+				}
+			}
+		case "ATTENDEE", "ORGANIZER":
+			if email := strings.TrimPrefix(strings.ToLower(property.Value), "mailto:"); strings.Contains(email, "@") {
+				event.Attendees = append(event.Attendees, email)
+			}
+		}
+	}
+	if start.IsZero() || (cancelled && recurrenceID.IsZero()) {
+		return nil
+	}
+	if duration == 0 && !end.IsZero() {
+		duration = end.Sub(start)
+	}
+	if duration <= 0 && !cancelled {
+		return nil
+	}
+
+	starts := []time.Time{start}
+	if rrule != "" && recurrenceID.IsZero() {
+		starts = expandRecurrence(start, rrule, to, loc)
+	}
+	var occurrences []CalendarEvent
+	for _, occurrenceStart := range starts {
+		if excluded[occurrenceStart] || occurrenceStart.Add(duration).Before(from) {
+			continue
+		}
+		occurrence := event
+		keyTime := occurrenceStart
+		if !recurrenceID.IsZero() {
+			keyTime = recurrenceID
+			occurrence.override = true
+			occurrence.cancelled = cancelled
+		}
+		occurrence.Key = event.UID + "/" + keyTime.Format("20060102T150405")
+		occurrence.Start = occurrenceStart
+		occurrence.End = occurrenceStart.Add(duration)
+		occurrences = append(occurrences, occurrence)
+	}
+	return occurrences
+}
+
+// matchCalendarRule returns the first rule that matches an event
+func matchCalendarRule(event CalendarEvent, rules []CalendarMappingRule) (CalendarMappingRule, bool) {
+	for _, rule := range rules {
+		if rule.AttendeeDomain == "" && rule.TitleKeyword == "" {
+			continue
+		}
+		if rule.TitleKeyword != "" && !strings.Contains(strings.ToLower(event.Summary), strings.ToLower(rule.TitleKeyword)) {
+			continue
+		}
+		if rule.AttendeeDomain != "" {
+			domain := "@" + strings.TrimPrefix(strings.ToLower(rule.AttendeeDomain), "@")
+			matched := false
+			for _, attendee := range event.Attendees {
+				if strings.HasSuffix(attendee, domain) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		return rule, true
+	}
+	return CalendarMappingRule{}, false
+}
+
+// readCalendarSource opens the calendar uploaded as `file`, or fetches the calendar subscription at `url`, which
+// must be on the public internet
+func readCalendarSource(r *http.Request) (io.ReadCloser, error) {
+	if file, _, err := r.FormFile("file"); err == nil {
+		return file, nil
+	}
+	source := r.FormValue("url")
+	if source == "" {
+		return nil, errors.New("an .ics file or calendar url is required")
+	}
+	parsed, err := url.Parse(strings.Replace(source, "webcal://", "https://", 1))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, errors.New("calendar url must be an http, https or webcal url")
+	}
+	resp, err := calendarClient.Get(parsed.String())
+	if err != nil {
+		if errors.Is(err, errCalendarAddress) {
+			return nil, errCalendarAddress
+		}
+		return nil, fmt.Errorf("failed to fetch calendar: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch calendar: status %d", resp.StatusCode)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxCalendarSize), resp.Body}, nil
+}
+
+// calendarEventsForRequest parses the calendar in the request for the current employee, restricted to the `start`
+// and `end` dates (YYYY-MM-DD, end inclusive) and the `timezone` the employee logs time in, defaulting to UTC.
+// Each event is annotated with the billing code suggested by the employee's rules and whether it has been imported.
+func (a *App) calendarEventsForRequest(r *http.Request, employee cronos.Employee) ([]CalendarEvent, ValidationErrors, error) {
+	var errs ValidationErrors
+	from, err := time.Parse("2006-01-02", r.FormValue("start"))
+	if err != nil {
+		errs.Add("start", "Expected a date in the format YYYY-MM-DD")
+	}
+	to, err := time.Parse("2006-01-02", r.FormValue("end"))
+	if err != nil {
+		errs.Add("end", "Expected a date in the format YYYY-MM-DD")
+	}
+	loc := time.UTC
+	if r.FormValue("timezone") != "" {
+		if loc, err = time.LoadLocation(r.FormValue("timezone")); err != nil {
+			errs.Add("timezone", "Unknown time zone")
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs, nil
+	}
+
+	source, err := readCalendarSource(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer source.Close()
+	events, err := ParseCalendar(source, from, to.AddDate(0, 0, 1), loc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+
+	var rules []CalendarMappingRule
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Order("priority ASC, id ASC").Find(&rules)
+	var imported []CalendarImportedEvent
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Find(&imported)
+	importedKeys := make(map[string]bool, len(imported))
+	for _, event := range imported {
+		importedKeys[event.EventKey] = true
+	}
+	for i := range events {
+		if rule, ok := matchCalendarRule(events[i], rules); ok {
+			events[i].BillingCodeID = rule.BillingCodeID
+			events[i].RuleID = rule.ID
+		}
+		events[i].Imported = importedKeys[events[i].Key]
+	}
+	return events, nil, nil
+}
+
+// CalendarEventsHandler lists the events in an uploaded .ics `file` or subscribed calendar `url` between the
+// `start` and `end` dates, with the billing code suggested for each by the employee's mapping rules
+func (a *App) CalendarEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff can import calendars", http.StatusForbidden)
+		return
+	}
+	_ = r.ParseMultipartForm(maxCalendarSize)
+	events, errs, err := a.calendarEventsForRequest(r, employee)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if events == nil {
+		events = []CalendarEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&events)
+}
+
+// CalendarImportHandler creates draft entries from the selected events of a calendar. It accepts the same calendar
+// and date range as CalendarEventsHandler along with an `event` value for each selected event key. The billing code
+// suggested by the mapping rules can be overridden per event with a `billing_code:<key>` value. Events that have
+// already been imported are skipped.
+func (a *App) CalendarImportHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff can import calendars", http.StatusForbidden)
+		return
+	}
+	_ = r.ParseMultipartForm(maxCalendarSize)
+	events, errs, err := a.calendarEventsForRequest(r, employee)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selected := make(map[string]bool)
+	for _, key := range r.Form["event"] {
+		selected[key] = true
+	}
+
+	results := []GeneratedEntry{}
+	for _, event := range events {
+		if !selected[event.Key] || event.Imported {
+			continue
+		}
+		billingCodeID := event.BillingCodeID
+		if override := r.FormValue("billing_code:" + event.Key); override != "" {
+			parsed, _ := strconv.ParseUint(override, 10, 64)
+			billingCodeID = uint(parsed)
+		}
+		entry := cronos.Entry{
+			EmployeeID:    employee.ID,
+			BillingCodeID: billingCodeID,
+			Notes:         event.Summary,
+			Start:         event.Start,
+			End:           event.End,
+		}
+		generated := a.createDraftEntry(&entry, contextUserID(r))
+		if generated.EntryID != 0 {
+			a.cronosApp.DB.Create(&CalendarImportedEvent{EmployeeID: employee.ID, EventKey: event.Key, EntryID: generated.EntryID})
+		}
+		results = append(results, generated)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&results)
+}
+
+// CalendarRulesListHandler provides the current employee's calendar mapping rules in the order they are applied
+func (a *App) CalendarRulesListHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).First(&employee)
+	var rules []CalendarMappingRule
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Order("priority ASC, id ASC").Find(&rules)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&rules)
+}
+
+// CalendarRuleHandler is the CRUD handler for the current employee's calendar mapping rules
+func (a *App) CalendarRuleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var rule CalendarMappingRule
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff can import calendars", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		if a.cronosApp.DB.Where("id = ? and employee_id = ?", vars["id"], employee.ID).Limit(1).Find(&rule).RowsAffected == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&rule)
+		return
+	case r.Method == "PUT" || r.Method == "POST":
+		if r.Method == "POST" {
+			rule = CalendarMappingRule{EmployeeID: employee.ID}
+		}
+		var errs ValidationErrors
+		if r.FormValue("billing_code_id") != "" {
+			var billingCode cronos.BillingCode
+			if a.cronosApp.DB.Where("id = ?", r.FormValue("billing_code_id")).Limit(1).Find(&billingCode).RowsAffected == 0 {
+				errs.Add("billing_code_id", "Billing code does not exist")
+			}
+			rule.BillingCodeID = billingCode.ID
+		}
+		if _, ok := r.Form["attendee_domain"]; ok {
+			rule.AttendeeDomain = strings.TrimSpace(r.FormValue("attendee_domain"))
+		}
+		if _, ok := r.Form["title_keyword"]; ok {
+			rule.TitleKeyword = strings.TrimSpace(r.FormValue("title_keyword"))
+		}
+		if r.FormValue("priority") != "" {
+			rule.Priority, _ = strconv.Atoi(r.FormValue("priority"))
+		}
+		if rule.BillingCodeID == 0 {
+			errs.Add("billing_code_id", "Billing code is required")
+		}
+		if rule.AttendeeDomain == "" && rule.TitleKeyword == "" {
+			errs.Add("title_keyword", "An attendee domain or title keyword is required")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		a.cronosApp.DB.Save(&rule)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(&rule)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Delete(&rule)
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCalendar is a weekly standup on Mondays and Wednesdays with one occurrence excluded, one moved and one cancelled
+const testCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@example.com\r\n" +
+	"SUMMARY:Client standup\r\n" +
+	"DTSTART:20240101T090000Z\r\n" +
+	"DTEND:20240101T093000Z\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=6\r\n" +
+	"EXDATE:20240103T090000Z\r\n" +
+	"ATTENDEE;CN=Client:mailto:pm@client.com\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@example.com\r\n" +
+	"SUMMARY:Client standup (moved)\r\n" +
+	"RECURRENCE-ID:20240108T090000Z\r\n" +
+	"DTSTART:20240108T140000Z\r\n" +
+	"DTEND:20240108T143000Z\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@example.com\r\n" +
+	"RECURRENCE-ID:20240110T090000Z\r\n" +
+	"DTSTART:20240110T090000Z\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+// allowCalendarAddresses lets the calendar client reach the given test servers for the duration of a test
+func allowCalendarAddresses(t *testing.T, servers ...*httptest.Server) {
+	t.Helper()
+	allowed := make(map[string]bool)
+	for _, server := range servers {
+		allowed[server.Listener.Addr().String()] = true
+	}
+	check := checkCalendarAddress
+	checkCalendarAddress = func(address string) error {
+		if allowed[address] {
+			return nil
+		}
+		return check(address)
+	}
+	t.Cleanup(func() { checkCalendarAddress = check })
+}
+
+// calendarRequest builds a calendar request for the subscription at source
+func calendarRequest(source string) *http.Request {
+	request := httptest.NewRequest("POST", "/calendar/events", strings.NewReader(url.Values{"url": {source}}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestReadCalendarSourceExpandsSubscription(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/calendar")
+		_, _ = w.Write([]byte(testCalendar))
+	}))
+	defer server.Close()
+	allowCalendarAddresses(t, server)
+
+	request := calendarRequest(server.URL + "/calendar.ics")
+	source, err := readCalendarSource(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	events, err := ParseCalendar(source, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		key, summary, start string
+	}{
+		{"standup@example.com/20240101T090000", "Client standup", "2024-01-01 09:00"},
+		{"standup@example.com/20240108T090000", "Client standup (moved)", "2024-01-08 14:00"},
+		{"standup@example.com/20240115T090000", "Client standup", "2024-01-15 09:00"},
+		{"standup@example.com/20240117T090000", "Client standup", "2024-01-17 09:00"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		if event.Key != want[i].key || event.Summary != want[i].summary || event.Start.Format("2006-01-02 15:04") != want[i].start {
+			t.Errorf("event %d: got %s %q at %s, want %s %q at %s", i, event.Key, event.Summary, event.Start.Format("2006-01-02 15:04"),
+				want[i].key, want[i].summary, want[i].start)
+		}
+		if event.End.Sub(event.Start) != 30*time.Minute {
+			t.Errorf("event %d: got duration %s, want 30m", i, event.End.Sub(event.Start))
+		}
+	}
+}
+
+func TestReadCalendarSourceRejectsInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testCalendar))
+	}))
+	defer server.Close()
+
+	for _, source := range []string{server.URL, "http://169.254.169.254/latest/meta-data", "http://10.0.0.1/calendar.ics", "http://[::1]/calendar.ics"} {
+		request := calendarRequest(source)
+		if _, err := readCalendarSource(request); !errors.Is(err, errCalendarAddress) {
+			t.Errorf("%s: got error %v, want %v", source, err, errCalendarAddress)
+		}
+	}
+}
+
+func TestReadCalendarSourceRejectsRedirectToInternalAddress(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testCalendar))
+	}))
+	defer internal.Close()
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/calendar.ics", http.StatusFound)
+	}))
+	defer public.Close()
+	allowCalendarAddresses(t, public)
+
+	request := calendarRequest(public.URL)
+	if _, err := readCalendarSource(request); !errors.Is(err, errCalendarAddress) {
+		t.Errorf("got error %v, want %v", err, errCalendarAddress)
+	}
+}
+
+func TestCheckCalendarAddress(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:443":          true,
+		"[2606:2800:220:1::248]:443": true,
+		"127.0.0.1:80":               false,
+		"192.168.1.10:443":           false,
+		"172.16.0.1:443":             false,
+		"100.64.0.1:443":             false,
+		"0.0.0.0:80":                 false,
+		"[fe80::1]:443":              false,
+		"[fd00::1]:443":              false,
+		"[::ffff:127.0.0.1]:80":      false,
+	} {
+		if err := checkCalendarAddress(address); (err == nil) != allowed {
+			t.Errorf("%s: got error %v, want allowed %v", address, err, allowed)
+		}
+	}
+}
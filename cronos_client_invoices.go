@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Client review statuses for an invoice
+const (
+	InvoiceReviewApproved = "approved"
+	InvoiceReviewDisputed = "disputed"
+)
+
+// InvoiceClientReview records a client approving or disputing an invoice before it is sent
+type InvoiceClientReview struct {
+	gorm.Model
+	InvoiceID     uint                 `json:"invoice_id" gorm:"index"`
+	UserID        uint                 `json:"user_id"`
+	Status        string               `json:"status"`
+	Comment       string               `json:"comment" gorm:"type:text"`
+	DisputedItems []InvoiceDisputeItem `json:"disputed_items" gorm:"foreignKey:ReviewID"`
+}
+
+// InvoiceDisputeItem is a single line item (entry) that a client has disputed as part of a review
+type InvoiceDisputeItem struct {
+	gorm.Model
+	ReviewID uint `json:"review_id" gorm:"index"`
+	EntryID  uint `json:"entry_id"`
+}
+
+// InvoiceComment is a threaded comment on an invoice shared between the client and staff. Comments may optionally
+// reference a specific line item and reply to another comment through ParentID.
+type InvoiceComment struct {
+	gorm.Model
+	InvoiceID  uint   `json:"invoice_id" gorm:"index"`
+	ParentID   *uint  `json:"parent_id"`
+	EntryID    *uint  `json:"entry_id"`
+	UserID     uint   `json:"user_id"`
+	AuthorName string `json:"author_name"`
+	IsStaff    bool   `json:"is_staff"`
+	Body       string `json:"body" gorm:"type:text"`
+}
+
+// ClientInvoice is an invoice as listed to clients, along with the link they can use to pay it
+type ClientInvoice struct {
+	cronos.Invoice
+	PaymentURL string `json:"payment_url,omitempty"`
+}
+
+// ClientInvoiceDetail is the client facing view of an invoice including its line items and review history
+type ClientInvoiceDetail struct {
+	Invoice    cronos.DraftInvoice   `json:"invoice"`
+	PaymentURL string                `json:"payment_url,omitempty"`
+	Reviews    []InvoiceClientReview `json:"reviews"`
+	Comments   []InvoiceComment      `json:"comments"`
+}
+
+// clientInvoice retrieves an invoice only if it belongs to the account of the requesting client user
+func (a *App) clientInvoice(r *http.Request, invoiceID string) (cronos.User, cronos.Invoice, bool) {
+	var user cronos.User
+	var invoice cronos.Invoice
+	if a.cronosApp.DB.Where("id = ?", contextUserID(r)).First(&user).RowsAffected == 0 {
+		return user, invoice, false
+	}
+	projectIDs := a.cronosApp.DB.Model(&cronos.Project{}).Select("id").Where("account_id = ?", user.AccountID)
+	result := a.cronosApp.DB.Preload("Entries", func(db *gorm.DB) *gorm.DB {
+		return db.Order("entries.start ASC")
+	}).Preload("Entries.BillingCode").Preload("Account").Preload("Project.Account").
+		Where("id = ? and project_id in (?) and state != ? and type = ?", invoiceID, projectIDs, cronos.InvoiceStateVoid, cronos.InvoiceTypeAR).
+		First(&invoice)
+	return user, invoice, result.RowsAffected != 0
+}
+
+// userDisplayName finds the name to attribute a comment to and whether the user is a member of staff
+func (a *App) userDisplayName(user cronos.User) (string, bool) {
+	if user.Role == cronos.UserRoleStaff.String() || user.Role == cronos.UserRoleAdmin.String() {
+		var employee cronos.Employee
+		a.cronosApp.DB.Where("user_id = ?", user.ID).First(&employee)
+		return strings.TrimSpace(employee.FirstName + " " + employee.LastName), true
+	}
+	var client cronos.Client
+	a.cronosApp.DB.Where("user_id = ?", user.ID).First(&client)
+	return strings.TrimSpace(client.FirstName + " " + client.LastName), false
+}
+
+// ClientInvoiceDetailHandler provides a client with a single invoice, its line items, reviews and comments
+func (a *App) ClientInvoiceDetailHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	_, invoice, ok := a.clientInvoice(r, vars["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	detail := ClientInvoiceDetail{
+		Invoice:    a.cronosApp.GetDraftInvoice(&invoice),
+		PaymentURL: a.invoicePaymentURL(invoice.ID),
+	}
+	a.cronosApp.DB.Preload("DisputedItems").Where("invoice_id = ?", invoice.ID).Order("created_at ASC").Find(&detail.Reviews)
+	a.cronosApp.DB.Where("invoice_id = ?", invoice.ID).Order("created_at ASC").Find(&detail.Comments)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&detail)
+}
+
+// ClientInvoiceReviewHandler allows a client to approve an invoice or dispute specific line items on it. Disputed
+// line items are passed as repeated `entry_id` form values alongside a `comment`.
+func (a *App) ClientInvoiceReviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user, invoice, ok := a.clientInvoice(r, vars["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Clients may only review invoices that have not yet been sent
+	if invoice.State != cronos.InvoiceStateDraft.String() && invoice.State != cronos.InvoiceStateApproved.String() {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "This invoice can no longer be reviewed"})
+		return
+	}
+	_ = r.ParseForm()
+
+	review := InvoiceClientReview{
+		InvoiceID: invoice.ID,
+		UserID:    user.ID,
+		Comment:   r.FormValue("comment"),
+	}
+	switch vars["action"] {
+	case "approve":
+		review.Status = InvoiceReviewApproved
+	case "dispute":
+		review.Status = InvoiceReviewDisputed
+		if review.Comment == "" {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "A comment is required to dispute an invoice"})
+			return
+		}
+		// Only entries that are actually on this invoice may be disputed
+		onInvoice := make(map[uint]bool, len(invoice.Entries))
+		for _, entry := range invoice.Entries {
+			onInvoice[entry.ID] = true
+		}
+		for _, value := range r.Form["entry_id"] {
+			entryID, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || !onInvoice[uint(entryID)] {
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Entry %s is not on this invoice", value)})
+				return
+			}
+			review.DisputedItems = append(review.DisputedItems, InvoiceDisputeItem{EntryID: uint(entryID)})
+		}
+	}
+
+	authorName, isStaff := a.userDisplayName(user)
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+		if review.Comment == "" {
+			return nil
+		}
+		// The review comment opens a thread on the invoice, anchored to the disputed line when only one is disputed
+		comment := InvoiceComment{
+			InvoiceID:  invoice.ID,
+			UserID:     user.ID,
+			AuthorName: authorName,
+			IsStaff:    isStaff,
+			Body:       review.Comment,
+		}
+		if len(review.DisputedItems) == 1 {
+			comment.EntryID = &review.DisputedItems[0].EntryID
+		}
+		return tx.Create(&comment).Error
+	})
+	if err != nil {
+		log.Printf("Error saving invoice review: %v", err)
+		http.Error(w, "Error saving invoice review", http.StatusInternalServerError)
+		return
+	}
+
+	if review.Status == InvoiceReviewDisputed {
+		go a.notifyStaffOfDispute(invoice, review, authorName)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(&review)
+}
+
+// notifyStaffOfDispute emails the accounts inbox and posts to Slack when a client disputes an invoice
+func (a *App) notifyStaffOfDispute(invoice cronos.Invoice, review InvoiceClientReview, clientName string) {
+	lines := make([]string, len(review.DisputedItems))
+	for i, item := range review.DisputedItems {
+		lines[i] = strconv.FormatUint(uint64(item.EntryID), 10)
+	}
+	message := fmt.Sprintf("%s (%s) disputed invoice %s (ID %d).\nDisputed line items: %s\nComment: %s",
+		clientName, invoice.Account.Name, invoice.Name, invoice.ID, strings.Join(lines, ", "), review.Comment)
+
+	email := cronos.Email{
+		SenderEmail:      "accounts@snowpack-data.io",
+		SenderName:       "Cronos",
+		RecipientEmail:   "accounts@snowpack-data.io",
+		RecipientName:    "Snowpack Data",
+		Subject:          fmt.Sprintf("Invoice %s disputed by %s", invoice.Name, invoice.Account.Name),
+		PlainTextContent: message,
+	}
+	if err := a.cronosApp.SendTextEmail(email); err != nil {
+		log.Printf("Error sending dispute email for invoice %d: %v", invoice.ID, err)
+	}
+
+	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
+	if webhookURL != "" {
+		a.sendSlackNotification(map[string]string{"text": message}, webhookURL)
+	}
+}
+
+// InvoiceCommentHandler lists or adds comments on an invoice. Clients reach it through the /user/invoices routes
+// and are limited to their own invoices, staff reach it through the /invoices routes.
+func (a *App) InvoiceCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var user cronos.User
+	var invoice cronos.Invoice
+	if strings.HasPrefix(r.URL.Path, "/api/user/") {
+		var ok bool
+		user, invoice, ok = a.clientInvoice(r, vars["id"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		a.cronosApp.DB.Where("id = ?", contextUserID(r)).First(&user)
+		if user.Role != cronos.UserRoleStaff.String() && user.Role != cronos.UserRoleAdmin.String() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if a.cronosApp.DB.First(&invoice, vars["id"]).RowsAffected == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "GET":
+		var comments []InvoiceComment
+		a.cronosApp.DB.Where("invoice_id = ?", invoice.ID).Order("created_at ASC").Find(&comments)
+		var reviews []InvoiceClientReview
+		a.cronosApp.DB.Preload("DisputedItems").Where("invoice_id = ?", invoice.ID).Order("created_at ASC").Find(&reviews)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(struct {
+			Reviews  []InvoiceClientReview `json:"reviews"`
+			Comments []InvoiceComment      `json:"comments"`
+		}{reviews, comments})
+		return
+	case r.Method == "POST":
+		comment := InvoiceComment{
+			InvoiceID: invoice.ID,
+			UserID:    user.ID,
+			Body:      strings.TrimSpace(r.FormValue("body")),
+		}
+		if comment.Body == "" {
+			http.Error(w, "Comment body is required", http.StatusBadRequest)
+			return
+		}
+		comment.AuthorName, comment.IsStaff = a.userDisplayName(user)
+		if r.FormValue("parent_id") != "" {
+			var parent InvoiceComment
+			if a.cronosApp.DB.Where("id = ? and invoice_id = ?", r.FormValue("parent_id"), invoice.ID).First(&parent).RowsAffected == 0 {
+				http.Error(w, "Parent comment not found on this invoice", http.StatusBadRequest)
+				return
+			}
+			comment.ParentID = &parent.ID
+		}
+		if r.FormValue("entry_id") != "" {
+			var entry cronos.Entry
+			if a.cronosApp.DB.Where("id = ? and invoice_id = ?", r.FormValue("entry_id"), invoice.ID).First(&entry).RowsAffected == 0 {
+				http.Error(w, "Entry not found on this invoice", http.StatusBadRequest)
+				return
+			}
+			comment.EntryID = &entry.ID
+		}
+		a.cronosApp.DB.Create(&comment)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&comment)
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
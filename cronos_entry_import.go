@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// maxImportSize caps the size of an uploaded CSV file
+const maxImportSize = 10 << 20
+
+// importDayStart is when the first entry of a day begins if a row only gives a duration. Later duration-only rows
+// for the same employee and day follow on from the previous one.
+const importDayStart = 9 * time.Hour
+
+// importColumns are the fields an import can map, with the header each is read from unless the request overrides it
+// with a `map_<field>` form value
+var importColumns = []string{"date", "start", "end", "duration", "billing_code", "notes", "employee_email"}
+
+// ImportRow is the outcome of importing one CSV row. Rows are numbered as in a spreadsheet, the header being row 1.
+type ImportRow struct {
+	Row           int          `json:"row"`
+	EmployeeEmail string       `json:"employee_email"`
+	BillingCode   string       `json:"billing_code"`
+	Start         time.Time    `json:"start"`
+	End           time.Time    `json:"end"`
+	Hours         float64      `json:"hours"`
+	Notes         string       `json:"notes"`
+	Errors        []FieldError `json:"errors,omitempty"`
+	Warnings      []string     `json:"warnings,omitempty"`
+	EntryID       uint         `json:"entry_id,omitempty"`
+	entry         cronos.Entry
+}
+
+// ImportResult summarises an import. Nothing is created unless every row is valid and the import is not a dry run.
+type ImportResult struct {
+	DryRun    bool        `json:"dry_run"`
+	Imported  bool        `json:"imported"`
+	RowCount  int         `json:"row_count"`
+	ErrorRows int         `json:"error_rows"`
+	Rows      []ImportRow `json:"rows"`
+}
+
+// parseImportDuration accepts durations as decimal hours (1.5) or hours and minutes (1:30)
+func parseImportDuration(value string) (time.Duration, error) {
+	if hours, minutes, found := strings.Cut(value, ":"); found {
+		h, err := strconv.Atoi(hours)
+		if err != nil {
+			return 0, err
+		}
+		m, err := strconv.Atoi(minutes)
+		if err != nil || m < 0 || m >= 60 {
+			return 0, fmt.Errorf("invalid minutes %q", minutes)
+		}
+		return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+	}
+	hours, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(hours * float64(time.Hour)).Round(time.Minute), nil
+}
+
+// importColumnIndexes maps each importable field to its column in the header row, returning an error if a mapped
+// column is missing or the mapping cannot describe an entry
+func importColumnIndexes(header []string, r *http.Request) (map[string]int, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	indexes := make(map[string]int)
+	for _, field := range importColumns {
+		name := field
+		if mapped := r.FormValue("map_" + field); mapped != "" {
+			name = strings.ToLower(strings.TrimSpace(mapped))
+		}
+		if i, ok := positions[name]; ok {
+			indexes[field] = i
+		} else if r.FormValue("map_"+field) != "" {
+			return nil, fmt.Errorf("column %q mapped to %s is not in the file", r.FormValue("map_"+field), field)
+		}
+	}
+	for _, required := range []string{"date", "billing_code"} {
+		if _, ok := indexes[required]; !ok {
+			return nil, fmt.Errorf("a %s column is required", required)
+		}
+	}
+	_, hasEnd := indexes["end"]
+	_, hasDuration := indexes["duration"]
+	if !hasEnd && !hasDuration {
+		return nil, errors.New("an end or duration column is required")
+	}
+	return indexes, nil
+}
+
+// buildImportRow converts a CSV record into an entry, recording any problems with the row's values
+func (a *App) buildImportRow(record []string, indexes map[string]int, importer cronos.Employee, isAdmin bool,
+	nextStart map[string]time.Time) ImportRow {
+	value := func(field string) string {
+		if i, ok := indexes[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	row := ImportRow{
+		EmployeeEmail: value("employee_email"),
+		BillingCode:   value("billing_code"),
+		Notes:         value("notes"),
+	}
+	var errs ValidationErrors
+
+	employee := importer
+	if row.EmployeeEmail != "" {
+		var user cronos.User
+		if a.cronosApp.DB.Where("lower(email) = ?", strings.ToLower(row.EmployeeEmail)).Limit(1).Find(&user).RowsAffected == 0 ||
+			a.cronosApp.DB.Where("user_id = ?", user.ID).Limit(1).Find(&employee).RowsAffected == 0 {
+			errs.Add("employee_email", fmt.Sprintf("No staff member with email %s", row.EmployeeEmail))
+		} else if employee.ID != importer.ID && !isAdmin {
+			errs.Add("employee_email", "Only admins can import entries for other staff")
+		}
+	}
+
+	var billingCode cronos.BillingCode
+	if a.cronosApp.DB.Preload("Rate").Preload("InternalRate").Where("code = ?", row.BillingCode).Limit(1).Find(&billingCode).RowsAffected == 0 {
+		errs.Add("billing_code", fmt.Sprintf("Billing code %q does not exist", row.BillingCode))
+	}
+
+	date, err := time.Parse("2006-01-02", value("date"))
+	if err != nil {
+		errs.Add("date", fmt.Sprintf("%q is not a valid date, expected YYYY-MM-DD", value("date")))
+	}
+	dayKey := fmt.Sprintf("%d/%s", employee.ID, date.Format("2006-01-02"))
+	if start := value("start"); start != "" {
+		if offset, err := time.Parse("15:04", start); err != nil {
+			errs.Add("start", fmt.Sprintf("%q is not a valid time, expected HH:MM", start))
+		} else {
+			row.Start = date.Add(time.Duration(offset.Hour())*time.Hour + time.Duration(offset.Minute())*time.Minute)
+		}
+	} else if previous, ok := nextStart[dayKey]; ok {
+		row.Start = previous
+	} else {
+		row.Start = date.Add(importDayStart)
+	}
+	if end := value("end"); end != "" {
+		if offset, err := time.Parse("15:04", end); err != nil {
+			errs.Add("end", fmt.Sprintf("%q is not a valid time, expected HH:MM", end))
+		} else {
+			row.End = date.Add(time.Duration(offset.Hour())*time.Hour + time.Duration(offset.Minute())*time.Minute)
+		}
+	} else if duration := value("duration"); duration != "" {
+		if parsed, err := parseImportDuration(duration); err != nil {
+			errs.Add("duration", fmt.Sprintf("%q is not a valid duration, expected hours such as 1.5 or 1:30", duration))
+		} else {
+			row.End = row.Start.Add(parsed)
+		}
+	} else {
+		errs.Add("end", "An end time or duration is required")
+	}
+	nextStart[dayKey] = row.End
+
+	row.entry = cronos.Entry{
+		EmployeeID:    employee.ID,
+		BillingCodeID: billingCode.ID,
+		BillingCode:   billingCode,
+		ProjectID:     billingCode.ProjectID,
+		Start:         row.Start,
+		End:           row.End,
+		Notes:         row.Notes,
+		Internal:      false,
+		State:         cronos.EntryStateDraft.String(),
+	}
+	row.Hours = row.End.Sub(row.Start).Hours()
+	if len(errs) == 0 {
+		errs = a.ValidateEntry(&row.entry)
+	}
+	if len(errs) == 0 && overlapPolicy() == OverlapPolicyWarn {
+		if overlaps := a.FindOverlappingEntries(&row.entry); len(overlaps) > 0 {
+			row.Warnings = append(row.Warnings, "Entry overlaps "+describeOverlaps(overlaps))
+		}
+	}
+	row.Errors = errs
+	return row
+}
+
+// checkImportOverlaps flags rows that overlap earlier rows in the same file for the same employee, which
+// ValidateEntry cannot see because they have not been saved yet
+func checkImportOverlaps(rows []ImportRow) {
+	for j := range rows {
+		if len(rows[j].Errors) > 0 {
+			continue
+		}
+		for i := 0; i < j; i++ {
+			if len(rows[i].Errors) > 0 || entryWorkerID(&rows[i].entry) != entryWorkerID(&rows[j].entry) {
+				continue
+			}
+			if rows[i].Start.Before(rows[j].End) && rows[i].End.After(rows[j].Start) {
+				message := fmt.Sprintf("Entry overlaps row %d", rows[i].Row)
+				if overlapPolicy() == OverlapPolicyReject {
+					rows[j].Errors = append(rows[j].Errors, FieldError{Field: "start", Message: message})
+				} else {
+					rows[j].Warnings = append(rows[j].Warnings, message)
+				}
+			}
+		}
+	}
+}
+
+// checkImportBudgets flags rows that take their project over its hour or dollar budget together with earlier rows
+// in the same file, keeping a running total per project since ValidateEntry only sees saved entries
+func (a *App) checkImportBudgets(rows []ImportRow) {
+	type budgetUsage struct {
+		hours   float64
+		dollars float64
+	}
+	projects := make(map[uint]cronos.Project)
+	used := make(map[uint]*budgetUsage)
+	for i := range rows {
+		if len(rows[i].Errors) > 0 {
+			continue
+		}
+		entry := &rows[i].entry
+		project, ok := projects[entry.ProjectID]
+		if !ok {
+			a.cronosApp.DB.Where("id = ?", entry.ProjectID).Limit(1).Find(&project)
+			projects[entry.ProjectID] = project
+		}
+		if project.BudgetHours == 0 && project.BudgetDollars == 0 {
+			continue
+		}
+		usage, ok := used[project.ID]
+		if !ok {
+			hours, dollars := a.projectBudgetUsed(project.ID, 0)
+			usage = &budgetUsage{hours: hours, dollars: dollars}
+			used[project.ID] = usage
+		}
+		hours := entry.Duration().Hours()
+		dollars := hours * entry.BillingCode.Rate.Amount
+		var errs ValidationErrors
+		validateEntryBudget(project, usage.hours, usage.dollars, hours, dollars, 0, 0, &errs)
+		if len(errs) > 0 {
+			rows[i].Errors = append(rows[i].Errors, errs...)
+			continue
+		}
+		usage.hours += hours
+		usage.dollars += dollars
+	}
+}
+
+// EntryImportHandler imports time entries from a CSV file uploaded as `file`. Columns are read by header name, with
+// `map_<field>` form values overriding the header used for date, start, end, duration, billing_code, notes and
+// employee_email. Every row is validated and reported. With `dry_run=true`, or if any row is invalid, nothing is
+// created; otherwise all entries are created in a single transaction and then associated to their draft invoices.
+func (a *App) EntryImportHandler(w http.ResponseWriter, r *http.Request) {
+	var importer cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&importer).RowsAffected == 0 {
+		http.Error(w, "Only staff can import entries", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		http.Error(w, "Expected a multipart form with a CSV file", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A CSV file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		http.Error(w, "Could not read the CSV header row", http.StatusBadRequest)
+		return
+	}
+	indexes, err := importColumnIndexes(header, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := ImportResult{DryRun: r.FormValue("dry_run") == "true", Rows: []ImportRow{}}
+	isAdmin := a.contextUserIsAdmin(r)
+	nextStart := make(map[string]time.Time)
+	for rowNumber := 2; ; rowNumber++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var row ImportRow
+		if err != nil {
+			row.Errors = []FieldError{{Field: "row", Message: err.Error()}}
+		} else {
+			row = a.buildImportRow(record, indexes, importer, isAdmin, nextStart)
+		}
+		row.Row = rowNumber
+		result.Rows = append(result.Rows, row)
+	}
+	checkImportOverlaps(result.Rows)
+	a.checkImportBudgets(result.Rows)
+	result.RowCount = len(result.Rows)
+	for _, row := range result.Rows {
+		if len(row.Errors) > 0 {
+			result.ErrorRows++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if result.ErrorRows > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(&result)
+		return
+	}
+	if result.DryRun || result.RowCount == 0 {
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&result)
+		return
+	}
+
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range result.Rows {
+			if err := tx.Create(&result.Rows[i].entry).Error; err != nil {
+				return fmt.Errorf("row %d: %w", result.Rows[i].Row, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Entries are associated once committed since AssociateEntry works outside of our transaction
+	for i := range result.Rows {
+		entry := &result.Rows[i].entry
+		if err := a.AssociateApprovedEntry(entry); err != nil {
+			fmt.Println(err)
+		}
+		a.SnapshotDraftInvoiceForEntry(entry.ID, contextUserID(r))
+		result.Rows[i].EntryID = entry.ID
+	}
+	result.Imported = true
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(&result)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// maxEntryPageSize caps the number of entries returned in a single page
+const maxEntryPageSize = 500
+
+// entrySortColumns maps the sort keys accepted by the entry listings to their columns
+var entrySortColumns = map[string]string{
+	"start":      "entries.start",
+	"end":        "entries.\"end\"",
+	"created_at": "entries.created_at",
+	"id":         "entries.id",
+}
+
+// entrySortValue returns the value of the sort column for an entry, used to build the cursor for the next page
+func entrySortValue(entry cronos.Entry, sortKey string) time.Time {
+	switch sortKey {
+	case "end":
+		return entry.End
+	case "created_at":
+		return entry.CreatedAt
+	default:
+		return entry.Start
+	}
+}
+
+// encodeEntryCursor builds an opaque cursor pointing just past an entry in the given sort order
+func encodeEntryCursor(entry cronos.Entry, sortKey string) string {
+	value := ""
+	if sortKey != "id" {
+		value = entrySortValue(entry, sortKey).Format(time.RFC3339Nano)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d", value, entry.ID)))
+}
+
+// decodeEntryCursor unpacks a cursor into the sort value and ID of the last entry on the previous page
+func decodeEntryCursor(cursor string, sortKey string) (time.Time, uint, error) {
+	var value time.Time
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return value, 0, err
+	}
+	sortValue, idValue, found := strings.Cut(string(raw), "|")
+	if !found {
+		return value, 0, fmt.Errorf("malformed cursor")
+	}
+	id, err := strconv.ParseUint(idValue, 10, 64)
+	if err != nil {
+		return value, 0, err
+	}
+	if sortKey != "id" {
+		if value, err = time.Parse(time.RFC3339Nano, sortValue); err != nil {
+			return value, 0, err
+		}
+	}
+	return value, uint(id), nil
+}
+
+// filterEntries applies the filters shared by the entry listings:
+//   - `start` and `end` dates (YYYY-MM-DD, end inclusive) bounding the entry start time
+//   - `project_id` and `billing_code_id`
+//   - `state`, a comma separated list of entry states
+//   - `impersonated`, true for only entries logged on someone else's behalf and false to exclude them
+func filterEntries(r *http.Request, query *gorm.DB) (*gorm.DB, ValidationErrors) {
+	var errs ValidationErrors
+	params := r.URL.Query()
+	if value := params.Get("start"); value != "" {
+		if start, err := time.Parse("2006-01-02", value); err != nil {
+			errs.Add("start", "Expected a date in the format YYYY-MM-DD")
+		} else {
+			query = query.Where("entries.start >= ?", start)
+		}
+	}
+	if value := params.Get("end"); value != "" {
+		if end, err := time.Parse("2006-01-02", value); err != nil {
+			errs.Add("end", "Expected a date in the format YYYY-MM-DD")
+		} else {
+			query = query.Where("entries.start < ?", end.AddDate(0, 0, 1))
+		}
+	}
+	for _, field := range []string{"project_id", "billing_code_id"} {
+		if value := params.Get(field); value != "" {
+			if id, err := strconv.ParseUint(value, 10, 64); err != nil {
+				errs.Add(field, "Expected a numeric ID")
+			} else {
+				query = query.Where("entries."+field+" = ?", id)
+			}
+		}
+	}
+	if value := params.Get("state"); value != "" {
+		query = query.Where("entries.state in ?", strings.Split(value, ","))
+	}
+	switch params.Get("impersonated") {
+	case "":
+	case "true":
+		query = query.Where("entries.impersonate_as_user_id is not null")
+	case "false":
+		query = query.Where("entries.impersonate_as_user_id is null")
+	default:
+		errs.Add("impersonated", "Expected true or false")
+	}
+	return query, errs
+}
+
+// writeEntryPage sorts and paginates a filtered entry query and writes the page. The body remains a plain list of
+// entries with their billed amounts, the total number of matching entries is returned in the X-Total-Count header
+// and the cursor for the next page, if there is one, in X-Next-Cursor. Sorting is by `sort`, one of start, end,
+// created_at or id, prefixed with a minus sign for descending order, and defaults to -start. Pages hold `limit`
+// entries, or maxEntryPageSize when no limit is given.
+func (a *App) writeEntryPage(w http.ResponseWriter, r *http.Request, query *gorm.DB, viewer cronos.Employee) {
+	params := r.URL.Query()
+	query, errs := filterEntries(r, query)
+
+	sortParam := params.Get("sort")
+	if sortParam == "" {
+		sortParam = "-start"
+	}
+	sortKey := strings.TrimPrefix(sortParam, "-")
+	descending := strings.HasPrefix(sortParam, "-")
+	column, ok := entrySortColumns[sortKey]
+	if !ok {
+		errs.Add("sort", "Expected one of start, end, created_at or id, optionally prefixed with -")
+	}
+
+	limit := maxEntryPageSize
+	if value := params.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxEntryPageSize {
+			errs.Add("limit", fmt.Sprintf("Expected a number between 1 and %d", maxEntryPageSize))
+		}
+		limit = parsed
+	}
+
+	var cursorValue time.Time
+	var cursorID uint
+	if cursor := params.Get("cursor"); cursor != "" && ok {
+		var err error
+		if cursorValue, cursorID, err = decodeEntryCursor(cursor, sortKey); err != nil {
+			errs.Add("cursor", "Invalid cursor")
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// Count every matching entry before the cursor narrows the query down to a page
+	query = query.Session(&gorm.Session{})
+	var total int64
+	query.Count(&total)
+
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+	page := query.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser")
+	if cursorID != 0 {
+		if sortKey == "id" {
+			page = page.Where("entries.id "+comparison+" ?", cursorID)
+		} else {
+			page = page.Where("("+column+" "+comparison+" ? or ("+column+" = ? and entries.id "+comparison+" ?))", cursorValue, cursorValue, cursorID)
+		}
+	}
+	page = page.Order(column + " " + direction)
+	if sortKey != "id" {
+		page = page.Order("entries.id " + direction)
+	}
+	// Fetch one extra entry to find out whether there is another page
+	page = page.Limit(limit + 1)
+	var entries []cronos.Entry
+	page.Find(&entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+		w.Header().Set("X-Next-Cursor", encodeEntryCursor(entries[limit-1], sortKey))
+	}
+
+	apiEntries := make([]cronos.ApiEntry, len(entries))
+	for i, entry := range entries {
+		apiEntry := entry.GetAPIEntry()
+		// Set a flag for UI to identify if this entry was created by someone else impersonating this user
+		if viewer.ID != 0 && entry.ImpersonateAsUserID != nil && *entry.ImpersonateAsUserID == viewer.ID && entry.EmployeeID != viewer.ID {
+			apiEntry.IsBeingImpersonated = true
+			apiEntry.EmployeeName = entry.Employee.FirstName + " " + entry.Employee.LastName
+		}
+		apiEntries[i] = apiEntry
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.billedEntries(entries, apiEntries))
+}
+
+// AdminEntriesListHandler lists entries across all employees for admins, accepting the same filters, sorting and
+// pagination as EntriesListHandler along with an optional `employee_id` to limit the list to one employee's time
+func (a *App) AdminEntriesListHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := a.cronosApp.DB.Model(&cronos.Entry{})
+	if value := r.URL.Query().Get("employee_id"); value != "" {
+		employeeID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeValidationErrors(w, ValidationErrors{{Field: "employee_id", Message: "Expected a numeric ID"}})
+			return
+		}
+		query = query.Where("(entries.impersonate_as_user_id = ? or (entries.employee_id = ? and entries.impersonate_as_user_id is null))", employeeID, employeeID)
+	}
+	a.writeEntryPage(w, r, query, cronos.Employee{})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Overlap policies control what happens when an entry overlaps another entry for the same employee
+const (
+	OverlapPolicyWarn   = "warn"
+	OverlapPolicyReject = "reject"
+)
+
+// overlapPolicy reads ENTRY_OVERLAP_POLICY, defaulting to warning so that staff are never blocked unexpectedly
+func overlapPolicy() string {
+	if os.Getenv("ENTRY_OVERLAP_POLICY") == OverlapPolicyReject {
+		return OverlapPolicyReject
+	}
+	return OverlapPolicyWarn
+}
+
+// entryWorkerID returns the employee whose time an entry records. Entries logged on someone else's behalf through
+// impersonation belong to the impersonated employee.
+func entryWorkerID(entry *cronos.Entry) uint {
+	if entry.ImpersonateAsUserID != nil {
+		return *entry.ImpersonateAsUserID
+	}
+	return entry.EmployeeID
+}
+
+// workerEntriesScope limits a query to the non-void entries that record a given employee's time, on client and
+// internal projects alike
+func workerEntriesScope(employeeID uint) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("(impersonate_as_user_id = ? or (employee_id = ? and impersonate_as_user_id is null)) and state != ?",
+			employeeID, employeeID, cronos.EntryStateVoid.String())
+	}
+}
+
+// FindOverlappingEntries returns the other entries for the same employee whose time range intersects the entry
+func (a *App) FindOverlappingEntries(entry *cronos.Entry) []cronos.Entry {
+	var overlaps []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode").Scopes(workerEntriesScope(entryWorkerID(entry))).
+		Where("id != ? and start < ? and \"end\" > ?", entry.ID, entry.End, entry.Start).
+		Order("start ASC").Find(&overlaps)
+	return overlaps
+}
+
+// describeOverlaps summarises overlapping entries for error and warning messages
+func describeOverlaps(overlaps []cronos.Entry) string {
+	descriptions := make([]string, len(overlaps))
+	for i, overlap := range overlaps {
+		descriptions[i] = fmt.Sprintf("#%d %s %s-%s", overlap.ID, overlap.BillingCode.Code,
+			overlap.Start.Format("2006-01-02 15:04"), overlap.End.Format("15:04"))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// validateEntryOverlaps adds a field error for overlapping entries when the overlap policy rejects them
+func (a *App) validateEntryOverlaps(entry *cronos.Entry, errs *ValidationErrors) {
+	if overlapPolicy() != OverlapPolicyReject {
+		return
+	}
+	if overlaps := a.FindOverlappingEntries(entry); len(overlaps) > 0 {
+		errs.Add("start", "Entry overlaps "+describeOverlaps(overlaps))
+	}
+}
+
+// setOverlapWarning attaches a Warning header to the response when the entry overlaps others under the warn policy
+func (a *App) setOverlapWarning(w http.ResponseWriter, entry *cronos.Entry) {
+	if overlapPolicy() != OverlapPolicyWarn {
+		return
+	}
+	if overlaps := a.FindOverlappingEntries(entry); len(overlaps) > 0 {
+		w.Header().Set("Warning", fmt.Sprintf("199 cronos %q", "Entry overlaps "+describeOverlaps(overlaps)))
+	}
+}
+
+// EntryOverlap is a pair of entries for the same employee whose time ranges intersect
+type EntryOverlap struct {
+	EmployeeID      uint            `json:"employee_id"`
+	EmployeeName    string          `json:"employee_name"`
+	First           cronos.ApiEntry `json:"first"`
+	Second          cronos.ApiEntry `json:"second"`
+	OverlapStart    time.Time       `json:"overlap_start"`
+	OverlapEnd      time.Time       `json:"overlap_end"`
+	OverlapDuration float64         `json:"overlap_hours"`
+}
+
+// findOverlapPairs sweeps the entries of a single employee, sorted by start time, and returns every overlapping pair
+func findOverlapPairs(entries []cronos.Entry) [][2]int {
+	var pairs [][2]int
+	for i := range entries {
+		for j := i + 1; j < len(entries) && entries[j].Start.Before(entries[i].End); j++ {
+			if entries[j].End.After(entries[i].Start) {
+				pairs = append(pairs, [2]int{i, j})
+			}
+		}
+	}
+	return pairs
+}
+
+// EntryOverlapsListHandler lists all overlapping entries across staff for the period given by the `start` and
+// `end` dates (YYYY-MM-DD, end inclusive) so that they can be reviewed before invoicing
+func (a *App) EntryOverlapsListHandler(w http.ResponseWriter, r *http.Request) {
+	var errs ValidationErrors
+	periodStart, err := time.Parse("2006-01-02", r.URL.Query().Get("start"))
+	if err != nil {
+		errs.Add("start", "Start date is required, expected YYYY-MM-DD")
+	}
+	periodEnd, err := time.Parse("2006-01-02", r.URL.Query().Get("end"))
+	if err != nil {
+		errs.Add("end", "End date is required, expected YYYY-MM-DD")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	var entries []cronos.Entry
+	query := a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser").
+		Where("start < ? and \"end\" > ? and state != ?", periodEnd.AddDate(0, 0, 1), periodStart, cronos.EntryStateVoid.String())
+	if employeeID := r.URL.Query().Get("employee_id"); employeeID != "" {
+		query = query.Where("(impersonate_as_user_id = ? or (employee_id = ? and impersonate_as_user_id is null))", employeeID, employeeID)
+	}
+	query.Order("start ASC").Find(&entries)
+
+	// Group the entries by the employee whose time they record, preserving start order within each group
+	byWorker := make(map[uint][]cronos.Entry)
+	for _, entry := range entries {
+		workerID := entryWorkerID(&entry)
+		byWorker[workerID] = append(byWorker[workerID], entry)
+	}
+
+	overlaps := []EntryOverlap{}
+	for workerID, workerEntries := range byWorker {
+		for _, pair := range findOverlapPairs(workerEntries) {
+			first, second := workerEntries[pair[0]], workerEntries[pair[1]]
+			overlap := EntryOverlap{
+				EmployeeID:   workerID,
+				First:        first.GetAPIEntry(),
+				Second:       second.GetAPIEntry(),
+				OverlapStart: second.Start,
+				OverlapEnd:   first.End,
+			}
+			if second.End.Before(first.End) {
+				overlap.OverlapEnd = second.End
+			}
+			if first.ImpersonateAsUser != nil {
+				overlap.EmployeeName = first.ImpersonateAsUser.FirstName + " " + first.ImpersonateAsUser.LastName
+			} else {
+				overlap.EmployeeName = first.Employee.FirstName + " " + first.Employee.LastName
+			}
+			overlap.OverlapDuration = overlap.OverlapEnd.Sub(overlap.OverlapStart).Hours()
+			overlaps = append(overlaps, overlap)
+		}
+	}
+	sort.Slice(overlaps, func(i, j int) bool { return overlaps[i].OverlapStart.Before(overlaps[j].OverlapStart) })
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&overlaps)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// recurringMu prevents the scheduler and an on-demand run from generating the same day twice
+var recurringMu sync.Mutex
+
+// weekdayNames maps the weekday abbreviations accepted in a template pattern to their weekday
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// RecurringEntryTemplate describes an entry an employee logs on the same weekdays every week, such as a standing
+// meeting. Weekdays is a comma separated list of day abbreviations, for example "mon,wed,fri".
+type RecurringEntryTemplate struct {
+	gorm.Model
+	EmployeeID      uint      `json:"employee_id" gorm:"index"`
+	BillingCodeID   uint      `json:"billing_code_id"`
+	Weekdays        string    `json:"weekdays"`
+	StartTime       string    `json:"start_time"`
+	DurationMinutes int       `json:"duration_minutes"`
+	Notes           string    `json:"notes"`
+	StartDate       time.Time `json:"start_date"`
+	EndDate         time.Time `json:"end_date"`
+	Active          bool      `json:"active"`
+}
+
+// RecurringEntryRun records that a template was generated for a day so that it is only generated once, along with
+// the resulting entry or the reason no entry could be created. A run that ended in an error is retried on the next
+// generation and keeps the latest error until an entry is created.
+type RecurringEntryRun struct {
+	gorm.Model
+	TemplateID uint      `json:"template_id" gorm:"uniqueIndex:idx_recurring_run"`
+	Date       time.Time `json:"date" gorm:"uniqueIndex:idx_recurring_run"`
+	EntryID    *uint     `json:"entry_id"`
+	Error      string    `json:"error"`
+}
+
+// GeneratedEntry reports the outcome of generating one entry from a template or a copied entry
+type GeneratedEntry struct {
+	SourceEntryID uint         `json:"source_entry_id,omitempty"`
+	TemplateID    uint         `json:"template_id,omitempty"`
+	Start         time.Time    `json:"start"`
+	End           time.Time    `json:"end"`
+	EntryID       uint         `json:"entry_id,omitempty"`
+	Errors        []FieldError `json:"errors,omitempty"`
+	Warnings      []string     `json:"warnings,omitempty"`
+}
+
+// parseWeekdays validates a weekday pattern and returns the weekdays it contains
+func parseWeekdays(pattern string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, name := range strings.Split(pattern, ",") {
+		day, ok := weekdayNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a weekday, expected a list such as mon,wed,fri", name)
+		}
+		days[day] = true
+	}
+	return days, nil
+}
+
+// createDraftEntry validates and creates a draft entry the same way EntryHandler does, associating it with its
+// draft invoice once its timesheet is approved. Overlaps are reported as warnings under the warn policy.
+func (a *App) createDraftEntry(entry *cronos.Entry, userID uint) GeneratedEntry {
+	generated := GeneratedEntry{Start: entry.Start, End: entry.End}
+	entry.Internal = false
+	entry.State = cronos.EntryStateDraft.String()
+	a.cronosApp.DB.Preload("Rate").Preload("InternalRate").Where("id = ?", entry.BillingCodeID).Limit(1).Find(&entry.BillingCode)
+	entry.ProjectID = entry.BillingCode.ProjectID
+	if errs := a.ValidateEntry(entry); len(errs) > 0 {
+		generated.Errors = errs
+		return generated
+	}
+	if overlapPolicy() == OverlapPolicyWarn {
+		if overlaps := a.FindOverlappingEntries(entry); len(overlaps) > 0 {
+			generated.Warnings = append(generated.Warnings, "Entry overlaps "+describeOverlaps(overlaps))
+		}
+	}
+	a.cronosApp.DB.Create(entry)
+	if err := a.AssociateApprovedEntry(entry); err != nil {
+		fmt.Println(err)
+	}
+	a.SnapshotDraftInvoiceForEntry(entry.ID, userID)
+	generated.EntryID = entry.ID
+	return generated
+}
+
+// CopyWeekHandler copies the current employee's entries from the previous week into the week containing `week`
+// (YYYY-MM-DD, defaulting to today). Entries that have already been copied are skipped, and each copy is validated
+// so that inactive billing codes, locked periods and overlaps are reported rather than created.
+func (a *App) CopyWeekHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff can copy entries", http.StatusForbidden)
+		return
+	}
+	target := time.Now()
+	if r.FormValue("week") != "" {
+		var err error
+		if target, err = time.Parse("2006-01-02", r.FormValue("week")); err != nil {
+			writeValidationErrors(w, ValidationErrors{{Field: "week", Message: "Expected a date in the format YYYY-MM-DD"}})
+			return
+		}
+	}
+	targetWeek := weekStart(time.Date(target.Year(), target.Month(), target.Day(), 0, 0, 0, 0, time.UTC))
+	sourceWeek := targetWeek.AddDate(0, 0, -7)
+
+	var entries []cronos.Entry
+	a.cronosApp.DB.Where("employee_id = ? and impersonate_as_user_id is null and state != ? and internal = ?",
+		employee.ID, cronos.EntryStateVoid.String(), false).
+		Where("start >= ? and start < ?", sourceWeek, targetWeek).
+		Order("start ASC").Find(&entries)
+
+	results := []GeneratedEntry{}
+	for _, source := range entries {
+		entry := cronos.Entry{
+			EmployeeID:    employee.ID,
+			BillingCodeID: source.BillingCodeID,
+			Notes:         source.Notes,
+			Start:         source.Start.AddDate(0, 0, 7),
+			End:           source.End.AddDate(0, 0, 7),
+		}
+		var existing int64
+		a.cronosApp.DB.Model(&cronos.Entry{}).Where("employee_id = ? and billing_code_id = ? and start = ? and state != ?",
+			employee.ID, entry.BillingCodeID, entry.Start, cronos.EntryStateVoid.String()).Count(&existing)
+		if existing > 0 {
+			continue
+		}
+		generated := a.createDraftEntry(&entry, contextUserID(r))
+		generated.SourceEntryID = source.ID
+		results = append(results, generated)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&results)
+}
+
+// generateTemplateDay creates the entry for a template on a day, recording the run so that it is not repeated once
+// an entry has been created
+func (a *App) generateTemplateDay(template RecurringEntryTemplate, day time.Time, userID uint) (GeneratedEntry, bool) {
+	run := RecurringEntryRun{TemplateID: template.ID, Date: day}
+	a.cronosApp.DB.Where("template_id = ? and date = ?", template.ID, day).Limit(1).Find(&run)
+	if run.EntryID != nil {
+		return GeneratedEntry{}, false
+	}
+	startTime, _ := time.Parse("15:04", template.StartTime)
+	start := day.Add(time.Duration(startTime.Hour())*time.Hour + time.Duration(startTime.Minute())*time.Minute)
+	entry := cronos.Entry{
+		EmployeeID:    template.EmployeeID,
+		BillingCodeID: template.BillingCodeID,
+		Notes:         template.Notes,
+		Start:         start,
+		End:           start.Add(time.Duration(template.DurationMinutes) * time.Minute),
+	}
+	generated := a.createDraftEntry(&entry, userID)
+	generated.TemplateID = template.ID
+
+	if generated.EntryID != 0 {
+		run.EntryID = &generated.EntryID
+		run.Error = ""
+	} else {
+		run.Error = ValidationErrors(generated.Errors).Error()
+	}
+	a.cronosApp.DB.Save(&run)
+	return generated, true
+}
+
+// GenerateRecurringEntries creates entries for every active template, optionally limited to one employee, on each
+// matching weekday from `from` up to and including `to`
+func (a *App) GenerateRecurringEntries(employeeID uint, from, to time.Time, userID uint) []GeneratedEntry {
+	recurringMu.Lock()
+	defer recurringMu.Unlock()
+
+	var templates []RecurringEntryTemplate
+	query := a.cronosApp.DB.Where("active = ?", true)
+	if employeeID != 0 {
+		query = query.Where("employee_id = ?", employeeID)
+	}
+	query.Find(&templates)
+
+	results := []GeneratedEntry{}
+	for _, template := range templates {
+		weekdays, err := parseWeekdays(template.Weekdays)
+		if err != nil {
+			log.Printf("Recurring entry template %d: %v", template.ID, err)
+			continue
+		}
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			if !weekdays[day.Weekday()] || day.Before(template.StartDate) ||
+				(!template.EndDate.IsZero() && day.After(template.EndDate)) {
+				continue
+			}
+			if generated, created := a.generateTemplateDay(template, day, userID); created {
+				results = append(results, generated)
+			}
+		}
+	}
+	return results
+}
+
+// RunRecurringEntries generates recurring entries for the past week up to today on a fixed interval until the
+// process exits. Looking back a week catches up on any days missed while the server was down.
+func (a *App) RunRecurringEntries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		a.GenerateRecurringEntries(0, today.AddDate(0, 0, -6), today, 0)
+		<-ticker.C
+	}
+}
+
+// GenerateRecurringEntriesHandler generates the current employee's recurring entries on demand for the dates
+// `start` to `end` (YYYY-MM-DD), defaulting to the current week up to today
+func (a *App) GenerateRecurringEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff have recurring entries", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := weekStart(to)
+	var errs ValidationErrors
+	if r.FormValue("start") != "" {
+		var err error
+		if from, err = time.Parse("2006-01-02", r.FormValue("start")); err != nil {
+			errs.Add("start", "Expected a date in the format YYYY-MM-DD")
+		}
+	}
+	if r.FormValue("end") != "" {
+		var err error
+		if to, err = time.Parse("2006-01-02", r.FormValue("end")); err != nil {
+			errs.Add("end", "Expected a date in the format YYYY-MM-DD")
+		}
+	}
+	if len(errs) == 0 && (to.Before(from) || to.Sub(from) > 31*24*time.Hour) {
+		errs.Add("end", "End must be on or after start and within 31 days of it")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	results := a.GenerateRecurringEntries(employee.ID, from, to, contextUserID(r))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&results)
+}
+
+// EntryTemplatesListHandler provides the current employee's recurring entry templates
+func (a *App) EntryTemplatesListHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).First(&employee)
+	var templates []RecurringEntryTemplate
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Order("created_at ASC").Find(&templates)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&templates)
+}
+
+// EntryTemplateHandler is the CRUD handler for the current employee's recurring entry templates
+func (a *App) EntryTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var template RecurringEntryTemplate
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff have recurring entries", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		if a.cronosApp.DB.Where("id = ? and employee_id = ?", vars["id"], employee.ID).Limit(1).Find(&template).RowsAffected == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&template)
+		return
+	case r.Method == "PUT" || r.Method == "POST":
+		if r.Method == "POST" {
+			// Without a start date the scheduler would look back a week and repeat time already logged by hand
+			now := time.Now()
+			template = RecurringEntryTemplate{EmployeeID: employee.ID, Active: true,
+				StartDate: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+		}
+		var errs ValidationErrors
+		if r.FormValue("billing_code_id") != "" {
+			var billingCode cronos.BillingCode
+			if a.cronosApp.DB.Where("id = ?", r.FormValue("billing_code_id")).Limit(1).Find(&billingCode).RowsAffected == 0 {
+				errs.Add("billing_code_id", "Billing code does not exist")
+			}
+			template.BillingCodeID = billingCode.ID
+		}
+		if r.FormValue("weekdays") != "" {
+			template.Weekdays = r.FormValue("weekdays")
+		}
+		if r.FormValue("start_time") != "" {
+			template.StartTime = r.FormValue("start_time")
+		}
+		if r.FormValue("duration_minutes") != "" {
+			template.DurationMinutes, _ = strconv.Atoi(r.FormValue("duration_minutes"))
+		}
+		if r.FormValue("notes") != "" {
+			template.Notes = r.FormValue("notes")
+		}
+		if r.FormValue("start_date") != "" {
+			startDate, err := time.Parse("2006-01-02", r.FormValue("start_date"))
+			if err != nil {
+				errs.Add("start_date", "Expected a date in the format YYYY-MM-DD")
+			}
+			template.StartDate = startDate
+		}
+		if r.FormValue("end_date") != "" {
+			endDate, err := time.Parse("2006-01-02", r.FormValue("end_date"))
+			if err != nil {
+				errs.Add("end_date", "Expected a date in the format YYYY-MM-DD")
+			}
+			template.EndDate = endDate
+		}
+		if r.FormValue("active") != "" {
+			template.Active = r.FormValue("active") == "true"
+		}
+
+		if template.BillingCodeID == 0 {
+			errs.Add("billing_code_id", "Billing code is required")
+		}
+		if _, err := parseWeekdays(template.Weekdays); err != nil {
+			errs.Add("weekdays", err.Error())
+		}
+		if _, err := time.Parse("15:04", template.StartTime); err != nil {
+			errs.Add("start_time", "Expected a time in the format HH:MM")
+		}
+		if template.DurationMinutes <= 0 || time.Duration(template.DurationMinutes)*time.Minute > maxEntryDuration() {
+			errs.Add("duration_minutes", fmt.Sprintf("Duration must be between 1 minute and %g hours", maxEntryDuration().Hours()))
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		a.cronosApp.DB.Save(&template)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(&template)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Delete(&template)
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+)
+
+// entryTimeLayout is the format the cronos UI submits entry start and end times in
+const entryTimeLayout = "2006-01-02T15:04"
+
+// defaultMaxEntryHours is the longest single entry we accept unless ENTRY_MAX_HOURS overrides it
+const defaultMaxEntryHours = 12
+
+// FieldError describes a problem with a single submitted field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every field level problem found with a submission
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, fieldError := range v {
+		messages[i] = fieldError.Field + ": " + fieldError.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Add appends a field error to the collection
+func (v *ValidationErrors) Add(field, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+// writeValidationErrors responds with a 422 and the field level errors
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "Validation failed", "errors": errs})
+}
+
+// parseEntryTime parses a submitted entry time, recording a field error if it is malformed
+func parseEntryTime(value string, field string, errs *ValidationErrors) (time.Time, bool) {
+	parsed, err := time.Parse(entryTimeLayout, value)
+	if err != nil {
+		errs.Add(field, fmt.Sprintf("%q is not a valid time, expected YYYY-MM-DDTHH:MM", value))
+		return parsed, false
+	}
+	return parsed, true
+}
+
+// maxEntryDuration returns the longest duration a single entry may span
+func maxEntryDuration() time.Duration {
+	hours, err := strconv.ParseFloat(os.Getenv("ENTRY_MAX_HOURS"), 64)
+	if err != nil || hours <= 0 {
+		hours = defaultMaxEntryHours
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// withinActiveWindow reports whether [start, end] falls inside an active window defined by dates. A zero bound is
+// open ended and the end date is inclusive of the whole day.
+func withinActiveWindow(start, end, activeStart, activeEnd time.Time) bool {
+	if !activeStart.IsZero() && start.Before(activeStart) {
+		return false
+	}
+	if !activeEnd.IsZero() && !end.Before(activeEnd.AddDate(0, 0, 1)) {
+		return false
+	}
+	return true
+}
+
+// ValidateEntry checks an entry that is about to be created or updated. It verifies time ordering and duration,
+// that the billing code exists and is active for the entry, that the project is active, that neither the accounting
+// period nor the week's timesheet is locked, and that the entry does not take the project over its hour or dollar
+// budget or overlap the employee's other entries.
+func (a *App) ValidateEntry(entry *cronos.Entry) ValidationErrors {
+	var errs ValidationErrors
+
+	if entry.Start.IsZero() {
+		errs.Add("start", "Start time is required")
+	}
+	if entry.End.IsZero() {
+		errs.Add("end", "End time is required")
+	}
+	if !entry.Start.IsZero() && !entry.End.IsZero() {
+		if !entry.End.After(entry.Start) {
+			errs.Add("end", "End time must be after the start time")
+		} else if maxDuration := maxEntryDuration(); entry.End.Sub(entry.Start) > maxDuration {
+			errs.Add("end", fmt.Sprintf("Entries may not be longer than %g hours", maxDuration.Hours()))
+		}
+	}
+
+	var billingCode cronos.BillingCode
+	if entry.BillingCodeID == 0 || a.cronosApp.DB.Preload("Rate").Where("id = ?", entry.BillingCodeID).First(&billingCode).RowsAffected == 0 {
+		errs.Add("billing_code_id", "Billing code does not exist")
+		return errs
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if !withinActiveWindow(entry.Start, entry.End, billingCode.ActiveStart, billingCode.ActiveEnd) {
+		errs.Add("billing_code_id", fmt.Sprintf("Billing code %s is only active from %s to %s", billingCode.Code,
+			billingCode.ActiveStart.Format("2006-01-02"), billingCode.ActiveEnd.Format("2006-01-02")))
+	}
+
+	var project cronos.Project
+	if a.cronosApp.DB.First(&project, billingCode.ProjectID).RowsAffected == 0 {
+		errs.Add("billing_code_id", "Billing code is not attached to a project")
+		return errs
+	}
+	if !withinActiveWindow(entry.Start, entry.End, project.ActiveStart, project.ActiveEnd) {
+		errs.Add("start", fmt.Sprintf("Project %s is only active from %s to %s", project.Name,
+			project.ActiveStart.Format("2006-01-02"), project.ActiveEnd.Format("2006-01-02")))
+	}
+
+	a.validateEntryPeriod(entry, &errs)
+	a.validateEntryTimesheet(entry, &errs)
+
+	if project.BudgetHours > 0 || project.BudgetDollars > 0 {
+		usedHours, usedDollars := a.projectBudgetUsed(project.ID, entry.ID)
+		// An edit is only held to the budget when it adds hours or dollars, so that the entries of a project that is
+		// already over budget can still be corrected
+		var previousHours, previousDollars float64
+		if entry.ID != 0 {
+			var previous cronos.Entry
+			if a.cronosApp.DB.Preload("BillingCode.Rate").Where("id = ? and state != ? and internal = ?", entry.ID, cronos.EntryStateVoid.String(), false).
+				Limit(1).Find(&previous).RowsAffected != 0 {
+				previousHours = previous.Duration().Hours()
+				previousDollars = previousHours * previous.BillingCode.Rate.Amount
+			}
+		}
+		entryHours := entry.End.Sub(entry.Start).Hours()
+		validateEntryBudget(project, usedHours, usedDollars, entryHours, entryHours*billingCode.Rate.Amount, previousHours, previousDollars, &errs)
+	}
+	if len(errs) == 0 {
+		a.validateEntryOverlaps(entry, &errs)
+	}
+	return errs
+}
+
+// projectBudgetUsed sums the hours and dollars of the billable entries already on a project, excluding the given
+// entry so that edits are not double counted
+func (a *App) projectBudgetUsed(projectID uint, excludeEntryID uint) (float64, float64) {
+	var usedHours, usedDollars float64
+	for _, entry := range a.budgetEntries([]uint{projectID}, excludeEntryID) {
+		entryHours, entryDollars := budgetUsage(&entry)
+		usedHours += entryHours
+		usedDollars += entryDollars
+	}
+	return usedHours, usedDollars
+}
+
+// validateEntryBudget records an error when an entry takes a project over its hour or dollar budget, given what the
+// project's other entries use and what the entry used before this change. Only a change that adds hours or dollars
+// is rejected.
+func validateEntryBudget(project cronos.Project, usedHours, usedDollars, entryHours, entryDollars, previousHours, previousDollars float64,
+	errs *ValidationErrors) {
+	if project.BudgetHours > 0 && entryHours > previousHours && usedHours+entryHours > float64(project.BudgetHours) {
+		errs.Add("end", fmt.Sprintf("Entry would exceed the project budget of %d hours (%.2f hours remaining)",
+			project.BudgetHours, float64(project.BudgetHours)-usedHours))
+	}
+	if project.BudgetDollars > 0 && entryDollars > previousDollars && usedDollars+entryDollars > float64(project.BudgetDollars) {
+		errs.Add("end", fmt.Sprintf("Entry would exceed the project budget of $%d ($%.2f remaining)",
+			project.BudgetDollars, float64(project.BudgetDollars)-usedDollars))
+	}
+}
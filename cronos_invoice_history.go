@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Invoice version triggers record why a snapshot of an invoice was captured
+const (
+	InvoiceVersionTriggerApprove          = "approve"
+	InvoiceVersionTriggerSend             = "send"
+	InvoiceVersionTriggerPaid             = "paid"
+	InvoiceVersionTriggerVoid             = "void"
+	InvoiceVersionTriggerEntryChange      = "entry_change"
+	InvoiceVersionTriggerAdjustmentChange = "adjustment_change"
+)
+
+// InvoiceVersion is a point-in-time snapshot of an invoice, its line items and its adjustments. A version is
+// captured on every state transition and on every entry or adjustment change while the invoice is a draft so that
+// we can explain how an invoice changed over its lifetime.
+type InvoiceVersion struct {
+	gorm.Model
+	InvoiceID        uint    `json:"invoice_id" gorm:"uniqueIndex:idx_invoice_versions_invoice_version"`
+	Version          int     `json:"version" gorm:"uniqueIndex:idx_invoice_versions_invoice_version"`
+	Trigger          string  `json:"trigger"`
+	State            string  `json:"state"`
+	UserID           uint    `json:"user_id"`
+	TotalHours       float64 `json:"total_hours"`
+	TotalFees        float64 `json:"total_fees"`
+	TotalAdjustments float64 `json:"total_adjustments"`
+	TotalAmount      float64 `json:"total_amount"`
+	Snapshot         string  `json:"-" gorm:"type:text"`
+}
+
+// InvoiceSnapshot is the serialized content of an InvoiceVersion
+type InvoiceSnapshot struct {
+	State            string                      `json:"state"`
+	TotalHours       float64                     `json:"total_hours"`
+	TotalFees        float64                     `json:"total_fees"`
+	TotalAdjustments float64                     `json:"total_adjustments"`
+	TotalAmount      float64                     `json:"total_amount"`
+	Lines            []InvoiceSnapshotLine       `json:"lines"`
+	Adjustments      []InvoiceSnapshotAdjustment `json:"adjustments"`
+}
+
+// InvoiceSnapshotLine captures a single entry on the invoice as it stood at the time of the snapshot
+type InvoiceSnapshotLine struct {
+	EntryID       uint      `json:"entry_id"`
+	EmployeeID    uint      `json:"employee_id"`
+	BillingCodeID uint      `json:"billing_code_id"`
+	BillingCode   string    `json:"billing_code"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Hours         float64   `json:"hours"`
+	Fee           float64   `json:"fee"`
+	State         string    `json:"state"`
+	Notes         string    `json:"notes"`
+}
+
+// InvoiceSnapshotAdjustment captures a single adjustment on the invoice as it stood at the time of the snapshot
+type InvoiceSnapshotAdjustment struct {
+	AdjustmentID uint    `json:"adjustment_id"`
+	Type         string  `json:"type"`
+	Amount       float64 `json:"amount"`
+	State        string  `json:"state"`
+	Notes        string  `json:"notes"`
+}
+
+// FieldChange describes a single field that differs between two versions
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// InvoiceLineChange lists the changed fields of an entry or adjustment present in both versions
+type InvoiceLineChange struct {
+	ID      uint          `json:"id"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// InvoiceVersionDiff is the difference between two versions of the same invoice
+type InvoiceVersionDiff struct {
+	InvoiceID          uint                        `json:"invoice_id"`
+	FromVersion        int                         `json:"from_version"`
+	ToVersion          int                         `json:"to_version"`
+	Changes            []FieldChange               `json:"changes"`
+	AddedLines         []InvoiceSnapshotLine       `json:"added_lines"`
+	RemovedLines       []InvoiceSnapshotLine       `json:"removed_lines"`
+	ChangedLines       []InvoiceLineChange         `json:"changed_lines"`
+	AddedAdjustments   []InvoiceSnapshotAdjustment `json:"added_adjustments"`
+	RemovedAdjustments []InvoiceSnapshotAdjustment `json:"removed_adjustments"`
+	ChangedAdjustments []InvoiceLineChange         `json:"changed_adjustments"`
+}
+
+// buildInvoiceSnapshot loads the invoice with its entries and adjustments and serializes it into a snapshot
+func (a *App) buildInvoiceSnapshot(invoiceID uint) (cronos.Invoice, InvoiceSnapshot, error) {
+	var invoice cronos.Invoice
+	err := a.cronosApp.DB.Preload("Entries", func(db *gorm.DB) *gorm.DB {
+		return db.Order("entries.start ASC")
+	}).Preload("Entries.BillingCode.Rate").Preload("Adjustments").First(&invoice, invoiceID).Error
+	if err != nil {
+		return invoice, InvoiceSnapshot{}, err
+	}
+
+	snapshot := InvoiceSnapshot{
+		State:            invoice.State,
+		TotalHours:       invoice.TotalHours,
+		TotalFees:        invoice.TotalFees,
+		TotalAdjustments: invoice.TotalAdjustments,
+		TotalAmount:      invoice.TotalAmount,
+		Lines:            make([]InvoiceSnapshotLine, len(invoice.Entries)),
+		Adjustments:      make([]InvoiceSnapshotAdjustment, len(invoice.Adjustments)),
+	}
+	for i := range invoice.Entries {
+		entry := invoice.Entries[i]
+		snapshot.Lines[i] = InvoiceSnapshotLine{
+			EntryID:       entry.ID,
+			EmployeeID:    entry.EmployeeID,
+			BillingCodeID: entry.BillingCodeID,
+			BillingCode:   entry.BillingCode.Code,
+			Start:         entry.Start,
+			End:           entry.End,
+			Hours:         entry.Duration().Hours(),
+			Fee:           a.cronosApp.GetFee(&entry),
+			State:         entry.State,
+			Notes:         entry.Notes,
+		}
+	}
+	for i, adjustment := range invoice.Adjustments {
+		snapshot.Adjustments[i] = InvoiceSnapshotAdjustment{
+			AdjustmentID: adjustment.ID,
+			Type:         adjustment.Type,
+			Amount:       adjustment.Amount,
+			State:        adjustment.State,
+			Notes:        adjustment.Notes,
+		}
+	}
+	return invoice, snapshot, nil
+}
+
+// SnapshotInvoice records a new version of the invoice. If nothing has changed since the latest version, no new
+// version is written so that repeated saves of a draft do not flood the history.
+func (a *App) SnapshotInvoice(invoiceID uint, trigger string, userID uint) {
+	invoice, snapshot, err := a.buildInvoiceSnapshot(invoiceID)
+	if err != nil {
+		log.Printf("Error building snapshot for invoice %d: %v", invoiceID, err)
+		return
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("Error serializing snapshot for invoice %d: %v", invoiceID, err)
+		return
+	}
+
+	// Concurrent edits of the same draft can race for the next version number. The unique index rejects the loser,
+	// which then retries against the version the winner wrote.
+	for attempt := 0; attempt < 3; attempt++ {
+		var latest InvoiceVersion
+		if a.cronosApp.DB.Where("invoice_id = ?", invoice.ID).Order("version DESC").Limit(1).Find(&latest).RowsAffected != 0 {
+			if latest.Snapshot == string(snapshotJSON) {
+				return
+			}
+		}
+		version := InvoiceVersion{
+			InvoiceID:        invoice.ID,
+			Version:          latest.Version + 1,
+			Trigger:          trigger,
+			State:            invoice.State,
+			UserID:           userID,
+			TotalHours:       snapshot.TotalHours,
+			TotalFees:        snapshot.TotalFees,
+			TotalAdjustments: snapshot.TotalAdjustments,
+			TotalAmount:      snapshot.TotalAmount,
+			Snapshot:         string(snapshotJSON),
+		}
+		if err = a.cronosApp.DB.Create(&version).Error; err == nil {
+			return
+		}
+	}
+	log.Printf("Error saving version for invoice %d: %v", invoiceID, err)
+}
+
+// SnapshotDraftInvoiceForEntry recomputes the totals of the draft invoice an entry belongs to and records a new
+// version of it. Entries on invoices that are no longer drafts are covered by the state transition snapshots.
+func (a *App) SnapshotDraftInvoiceForEntry(entryID uint, userID uint) {
+	var invoice cronos.Invoice
+	if a.cronosApp.DB.Joins("JOIN entries ON entries.invoice_id = invoices.id").
+		Where("entries.id = ? and invoices.state = ?", entryID, cronos.InvoiceStateDraft.String()).
+		Limit(1).Find(&invoice).RowsAffected == 0 {
+		return
+	}
+	a.cronosApp.UpdateInvoiceTotals(&invoice)
+	a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerEntryChange, userID)
+}
+
+// SnapshotDraftInvoiceForAdjustment recomputes the totals of the draft invoice an adjustment belongs to and records
+// a new version of it
+func (a *App) SnapshotDraftInvoiceForAdjustment(adjustment *cronos.Adjustment, userID uint) {
+	if adjustment.InvoiceID == nil {
+		return
+	}
+	var invoice cronos.Invoice
+	if a.cronosApp.DB.Where("id = ? and state = ?", *adjustment.InvoiceID, cronos.InvoiceStateDraft.String()).
+		Limit(1).Find(&invoice).RowsAffected == 0 {
+		return
+	}
+	a.cronosApp.UpdateInvoiceTotals(&invoice)
+	a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerAdjustmentChange, userID)
+}
+
+// DiffInvoiceSnapshots compares two snapshots of the same invoice and reports totals, lines and adjustments that
+// were added, removed or changed between them
+func DiffInvoiceSnapshots(from, to InvoiceSnapshot) InvoiceVersionDiff {
+	diff := InvoiceVersionDiff{
+		Changes:            []FieldChange{},
+		AddedLines:         []InvoiceSnapshotLine{},
+		RemovedLines:       []InvoiceSnapshotLine{},
+		ChangedLines:       []InvoiceLineChange{},
+		AddedAdjustments:   []InvoiceSnapshotAdjustment{},
+		RemovedAdjustments: []InvoiceSnapshotAdjustment{},
+		ChangedAdjustments: []InvoiceLineChange{},
+	}
+	diff.Changes = appendChange(diff.Changes, "state", from.State, to.State)
+	diff.Changes = appendChange(diff.Changes, "total_hours", from.TotalHours, to.TotalHours)
+	diff.Changes = appendChange(diff.Changes, "total_fees", from.TotalFees, to.TotalFees)
+	diff.Changes = appendChange(diff.Changes, "total_adjustments", from.TotalAdjustments, to.TotalAdjustments)
+	diff.Changes = appendChange(diff.Changes, "total_amount", from.TotalAmount, to.TotalAmount)
+
+	fromLines := make(map[uint]InvoiceSnapshotLine, len(from.Lines))
+	for _, line := range from.Lines {
+		fromLines[line.EntryID] = line
+	}
+	toLines := make(map[uint]bool, len(to.Lines))
+	for _, line := range to.Lines {
+		toLines[line.EntryID] = true
+		previous, ok := fromLines[line.EntryID]
+		if !ok {
+			diff.AddedLines = append(diff.AddedLines, line)
+			continue
+		}
+		var changes []FieldChange
+		changes = appendChange(changes, "billing_code", previous.BillingCode, line.BillingCode)
+		changes = appendChange(changes, "start", previous.Start, line.Start)
+		changes = appendChange(changes, "end", previous.End, line.End)
+		changes = appendChange(changes, "hours", previous.Hours, line.Hours)
+		changes = appendChange(changes, "fee", previous.Fee, line.Fee)
+		changes = appendChange(changes, "state", previous.State, line.State)
+		changes = appendChange(changes, "notes", previous.Notes, line.Notes)
+		if len(changes) > 0 {
+			diff.ChangedLines = append(diff.ChangedLines, InvoiceLineChange{ID: line.EntryID, Changes: changes})
+		}
+	}
+	for _, line := range from.Lines {
+		if !toLines[line.EntryID] {
+			diff.RemovedLines = append(diff.RemovedLines, line)
+		}
+	}
+
+	fromAdjustments := make(map[uint]InvoiceSnapshotAdjustment, len(from.Adjustments))
+	for _, adjustment := range from.Adjustments {
+		fromAdjustments[adjustment.AdjustmentID] = adjustment
+	}
+	toAdjustments := make(map[uint]bool, len(to.Adjustments))
+	for _, adjustment := range to.Adjustments {
+		toAdjustments[adjustment.AdjustmentID] = true
+		previous, ok := fromAdjustments[adjustment.AdjustmentID]
+		if !ok {
+			diff.AddedAdjustments = append(diff.AddedAdjustments, adjustment)
+			continue
+		}
+		var changes []FieldChange
+		changes = appendChange(changes, "type", previous.Type, adjustment.Type)
+		changes = appendChange(changes, "amount", previous.Amount, adjustment.Amount)
+		changes = appendChange(changes, "state", previous.State, adjustment.State)
+		changes = appendChange(changes, "notes", previous.Notes, adjustment.Notes)
+		if len(changes) > 0 {
+			diff.ChangedAdjustments = append(diff.ChangedAdjustments, InvoiceLineChange{ID: adjustment.AdjustmentID, Changes: changes})
+		}
+	}
+	for _, adjustment := range from.Adjustments {
+		if !toAdjustments[adjustment.AdjustmentID] {
+			diff.RemovedAdjustments = append(diff.RemovedAdjustments, adjustment)
+		}
+	}
+	return diff
+}
+
+// appendChange adds a FieldChange to the list only if the two values differ
+func appendChange[T comparable](changes []FieldChange, field string, from, to T) []FieldChange {
+	if from == to {
+		return changes
+	}
+	return append(changes, FieldChange{Field: field, From: from, To: to})
+}
+
+// InvoiceVersionsListHandler lists every captured version of an invoice, oldest first
+func (a *App) InvoiceVersionsListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var versions []InvoiceVersion
+	a.cronosApp.DB.Where("invoice_id = ?", vars["id"]).Order("version ASC").Find(&versions)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&versions)
+}
+
+// InvoiceVersionDiffHandler compares two versions of an invoice given by the `from` and `to` query parameters
+func (a *App) InvoiceVersionDiffHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fromVersion, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid from version", http.StatusBadRequest)
+		return
+	}
+	toVersion, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid to version", http.StatusBadRequest)
+		return
+	}
+
+	var from, to InvoiceVersion
+	if a.cronosApp.DB.Where("invoice_id = ? and version = ?", vars["id"], fromVersion).First(&from).Error != nil {
+		http.Error(w, "From version not found", http.StatusNotFound)
+		return
+	}
+	if a.cronosApp.DB.Where("invoice_id = ? and version = ?", vars["id"], toVersion).First(&to).Error != nil {
+		http.Error(w, "To version not found", http.StatusNotFound)
+		return
+	}
+
+	var fromSnapshot, toSnapshot InvoiceSnapshot
+	if err := json.Unmarshal([]byte(from.Snapshot), &fromSnapshot); err != nil {
+		http.Error(w, "Corrupt invoice version", http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal([]byte(to.Snapshot), &toSnapshot); err != nil {
+		http.Error(w, "Corrupt invoice version", http.StatusInternalServerError)
+		return
+	}
+
+	diff := DiffInvoiceSnapshots(fromSnapshot, toSnapshot)
+	diff.InvoiceID = from.InvoiceID
+	diff.FromVersion = from.Version
+	diff.ToVersion = to.Version
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&diff)
+}
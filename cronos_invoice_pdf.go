@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/snowpackdata/cronos"
+)
+
+// renderClientInvoicePDF renders the copy of an invoice that clients download from the portal: its line items and
+// totals, followed by the link to pay it online when the invoice has one
+func (a *App) renderClientInvoicePDF(invoice cronos.Invoice, paymentURL string) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(15, 15, 15)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, "Snowpack Data", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.CellFormat(0, 6, tr("Invoice "+invoice.Name), "", 1, "L", false, 0, "")
+	accountName := invoice.Account.Name
+	if accountName == "" {
+		accountName = invoice.Project.Account.Name
+	}
+	pdf.CellFormat(0, 6, tr("Billed to "+accountName), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Period %s to %s", invoice.PeriodStart.Format("January 2, 2006"), invoice.PeriodEnd.Format("January 2, 2006")), "", 1, "L", false, 0, "")
+	if !invoice.DueAt.IsZero() {
+		pdf.CellFormat(0, 6, "Due "+invoice.DueAt.Format("January 2, 2006"), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	widths := []float64{25, 30, 85, 20, 26}
+	pdf.SetFont("Helvetica", "B", 10)
+	for i, heading := range []string{"Date", "Code", "Description", "Hours", "Amount"} {
+		align := "L"
+		if i >= 3 {
+			align = "R"
+		}
+		pdf.CellFormat(widths[i], 7, heading, "B", 0, align, false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 9)
+	for i := range invoice.Entries {
+		entry := invoice.Entries[i]
+		if entry.State == cronos.EntryStateVoid.String() {
+			continue
+		}
+		notes := []rune(entry.Notes)
+		if len(notes) > 60 {
+			notes = append(notes[:57], []rune("...")...)
+		}
+		pdf.CellFormat(widths[0], 6, entry.Start.Format("2006-01-02"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 6, tr(entry.BillingCode.Code), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, tr(string(notes)), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[3], 6, fmt.Sprintf("%.2f", entry.Duration().Hours()), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, fmt.Sprintf("$%.2f", a.cronosApp.GetFee(&entry)), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "", 10)
+	for _, total := range []struct {
+		label  string
+		amount string
+	}{
+		{"Hours", fmt.Sprintf("%.2f", invoice.TotalHours)},
+		{"Fees", fmt.Sprintf("$%.2f", invoice.TotalFees)},
+		{"Adjustments", fmt.Sprintf("$%.2f", invoice.TotalAdjustments)},
+	} {
+		pdf.CellFormat(160, 6, total.label, "", 0, "R", false, 0, "")
+		pdf.CellFormat(26, 6, total.amount, "", 1, "R", false, 0, "")
+	}
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(160, 8, "Total due", "T", 0, "R", false, 0, "")
+	pdf.CellFormat(26, 8, fmt.Sprintf("$%.2f", invoice.TotalAmount), "T", 1, "R", false, 0, "")
+
+	if paymentURL != "" {
+		pdf.Ln(8)
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(0, 7, "Pay online", "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "U", 10)
+		pdf.SetTextColor(0, 0, 238)
+		pdf.CellFormat(0, 6, paymentURL, "", 1, "L", false, 0, paymentURL)
+		pdf.SetTextColor(0, 0, 0)
+	}
+
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ClientInvoicePDFHandler downloads an invoice as a PDF for the client it belongs to, including the link to pay it
+func (a *App) ClientInvoicePDFHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	_, invoice, ok := a.clientInvoice(r, vars["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	file, err := a.renderClientInvoicePDF(invoice, a.invoicePaymentURL(invoice.ID))
+	if err != nil {
+		http.Error(w, "Error rendering invoice", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "invoice_"+invoice.Name+".pdf"))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(file)
+}
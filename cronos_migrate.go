@@ -0,0 +1,46 @@
+package main
+
+import "log"
+
+// MigrateModels creates or updates the tables for the models owned by the website rather than by cronos.
+// These models share the cronos database connection.
+func (a *App) MigrateModels() {
+	err := a.cronosApp.DB.AutoMigrate(
+		&InvoiceVersion{},
+		&InvoiceClientReview{},
+		&InvoiceDisputeItem{},
+		&InvoiceComment{},
+		&Payment{},
+		&PaymentWebhookEvent{},
+		&InvoicePaymentLink{},
+		&RetainerSchedule{},
+		&RetainerInvoice{},
+		&EntryTimer{},
+		&Timesheet{},
+		&TimesheetReview{},
+		&TimesheetReminder{},
+		&AccountingPeriod{},
+		&PeriodEvent{},
+		&BillingCodeRounding{},
+		&RecurringEntryTemplate{},
+		&RecurringEntryRun{},
+		&CalendarMappingRule{},
+		&CalendarImportedEvent{},
+		&ProjectLead{},
+		&BudgetAlert{},
+		&EmployeeCapacity{},
+		&FixedFeeContract{},
+		&RevenueMilestone{},
+		&Allocation{},
+		&ProjectTemplate{},
+		&ProjectTemplateBillingCode{},
+		&BillStatus{},
+		&BillEvent{},
+		&EmployeeBankAccount{},
+		&PayoutBatch{},
+		&PayoutItem{},
+	)
+	if err != nil {
+		log.Printf("Error migrating website models: %v", err)
+	}
+}
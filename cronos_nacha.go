@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nachaRecordLength is the fixed width of every record in a NACHA file
+const nachaRecordLength = 94
+
+// nachaBlockingFactor is the number of records in a block. Files are padded with filler records to a whole block.
+const nachaBlockingFactor = 10
+
+// nachaFileIDModifiers are the file ID modifiers in the order they are used. The modifier tells apart files sent to
+// the same bank on the same day, so a bank rejects a second file with the same date and modifier as a duplicate.
+const nachaFileIDModifiers = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// NACHA transaction codes for credits to the receiver's account
+const (
+	nachaCheckingCredit = "22"
+	nachaSavingsCredit  = "32"
+)
+
+// NACHAConfig identifies our bank and company in the file and batch headers
+type NACHAConfig struct {
+	ImmediateDestination     string
+	ImmediateDestinationName string
+	ImmediateOrigin          string
+	ImmediateOriginName      string
+	CompanyName              string
+	CompanyID                string
+	OriginatingDFI           string
+}
+
+// NACHAEntry is a single credit to a receiver's bank account
+type NACHAEntry struct {
+	RoutingNumber string
+	AccountNumber string
+	Savings       bool
+	AmountCents   int64
+	IndividualID  string
+	Name          string
+}
+
+// nachaAlpha formats an alphanumeric field left justified and space padded to its width
+func nachaAlpha(value string, width int) string {
+	value = strings.ToUpper(strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value))
+	if len(value) > width {
+		value = value[:width]
+	}
+	return value + strings.Repeat(" ", width-len(value))
+}
+
+// nachaNumeric formats a numeric field right justified and zero padded to its width
+func nachaNumeric(value int64, width int) string {
+	formatted := strconv.FormatInt(value, 10)
+	if len(formatted) > width {
+		formatted = formatted[len(formatted)-width:]
+	}
+	return strings.Repeat("0", width-len(formatted)) + formatted
+}
+
+// validRoutingNumber checks the length and ABA check digit of a routing number
+func validRoutingNumber(routing string) bool {
+	if len(routing) != 9 {
+		return false
+	}
+	weights := []int{3, 7, 1, 3, 7, 1, 3, 7, 1}
+	sum := 0
+	for i, r := range routing {
+		if r < '0' || r > '9' {
+			return false
+		}
+		sum += int(r-'0') * weights[i]
+	}
+	return sum%10 == 0
+}
+
+// BuildNACHA generates a NACHA file with a single PPD batch crediting every entry, effective on the given date.
+// fileIDModifier is the index into nachaFileIDModifiers of the file among those created on the same day. The file
+// is validated before it is returned so that a file whose control totals do not add up is never sent to the bank.
+func BuildNACHA(config NACHAConfig, entries []NACHAEntry, batchNumber int64, fileIDModifier int, effective, now time.Time) ([]byte, error) {
+	if !validRoutingNumber(config.ImmediateDestination) {
+		return nil, errors.New("the immediate destination must be a valid routing number")
+	}
+	if len(config.OriginatingDFI) != 8 {
+		return nil, errors.New("the originating DFI must be the first 8 digits of our routing number")
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("a payout file needs at least one entry")
+	}
+	if fileIDModifier < 0 || fileIDModifier >= len(nachaFileIDModifiers) {
+		return nil, fmt.Errorf("no more than %d payout files can be created in a day", len(nachaFileIDModifiers))
+	}
+
+	var records []string
+	records = append(records, "101"+
+		" "+config.ImmediateDestination+
+		nachaAlpha(config.ImmediateOrigin, 10)+
+		now.Format("060102")+
+		now.Format("1504")+
+		nachaFileIDModifiers[fileIDModifier:fileIDModifier+1]+
+		"094"+
+		nachaNumeric(nachaBlockingFactor, 2)+
+		"1"+
+		nachaAlpha(config.ImmediateDestinationName, 23)+
+		nachaAlpha(config.ImmediateOriginName, 23)+
+		nachaAlpha("", 8))
+	records = append(records, "5220"+
+		nachaAlpha(config.CompanyName, 16)+
+		nachaAlpha("", 20)+
+		nachaAlpha(config.CompanyID, 10)+
+		"PPD"+
+		nachaAlpha("PAYROLL", 10)+
+		effective.Format("060102")+
+		effective.Format("060102")+
+		"   "+
+		"1"+
+		config.OriginatingDFI+
+		nachaNumeric(batchNumber, 7))
+
+	var entryHash, totalCredit int64
+	for i, entry := range entries {
+		if !validRoutingNumber(entry.RoutingNumber) {
+			return nil, fmt.Errorf("entry for %s has an invalid routing number", entry.Name)
+		}
+		if entry.AccountNumber == "" || len(entry.AccountNumber) > 17 {
+			return nil, fmt.Errorf("entry for %s has an invalid account number", entry.Name)
+		}
+		if entry.AmountCents <= 0 {
+			return nil, fmt.Errorf("entry for %s must be for a positive amount", entry.Name)
+		}
+		receivingDFI, _ := strconv.ParseInt(entry.RoutingNumber[:8], 10, 64)
+		entryHash += receivingDFI
+		totalCredit += entry.AmountCents
+		transactionCode := nachaCheckingCredit
+		if entry.Savings {
+			transactionCode = nachaSavingsCredit
+		}
+		records = append(records, "6"+
+			transactionCode+
+			entry.RoutingNumber+
+			nachaAlpha(entry.AccountNumber, 17)+
+			nachaNumeric(entry.AmountCents, 10)+
+			nachaAlpha(entry.IndividualID, 15)+
+			nachaAlpha(entry.Name, 22)+
+			"  "+
+			"0"+
+			config.OriginatingDFI+
+			nachaNumeric(int64(i+1), 7))
+	}
+
+	records = append(records, "8220"+
+		nachaNumeric(int64(len(entries)), 6)+
+		nachaNumeric(entryHash, 10)+
+		nachaNumeric(0, 12)+
+		nachaNumeric(totalCredit, 12)+
+		nachaAlpha(config.CompanyID, 10)+
+		nachaAlpha("", 19)+
+		nachaAlpha("", 6)+
+		config.OriginatingDFI+
+		nachaNumeric(batchNumber, 7))
+	blocks := (len(records) + 1 + nachaBlockingFactor - 1) / nachaBlockingFactor
+	records = append(records, "9"+
+		nachaNumeric(1, 6)+
+		nachaNumeric(int64(blocks), 6)+
+		nachaNumeric(int64(len(entries)), 8)+
+		nachaNumeric(entryHash, 10)+
+		nachaNumeric(0, 12)+
+		nachaNumeric(totalCredit, 12)+
+		nachaAlpha("", 39))
+	for len(records)%nachaBlockingFactor != 0 {
+		records = append(records, strings.Repeat("9", nachaRecordLength))
+	}
+
+	file := []byte(strings.Join(records, "\n") + "\n")
+	if err := ValidateNACHA(file); err != nil {
+		return nil, fmt.Errorf("generated an invalid NACHA file: %w", err)
+	}
+	return file, nil
+}
+
+// ValidateNACHA checks the record lengths, blocking and the batch and file control totals of a NACHA file: entry
+// counts, entry hashes and debit and credit totals must match the entries they summarize
+func ValidateNACHA(file []byte) error {
+	lines := strings.Split(strings.TrimRight(string(file), "\n"), "\n")
+	if len(lines)%nachaBlockingFactor != 0 {
+		return fmt.Errorf("%d records is not a whole number of blocks", len(lines))
+	}
+	field := func(line string, start, end int) int64 {
+		value, _ := strconv.ParseInt(strings.TrimSpace(line[start-1:end]), 10, 64)
+		return value
+	}
+
+	var batches, fileEntries, fileHash, fileDebit, fileCredit int64
+	var batchEntries, batchHash, batchDebit, batchCredit int64
+	var sawFileHeader, sawFileControl, inBatch bool
+	for i, line := range lines {
+		if len(line) != nachaRecordLength {
+			return fmt.Errorf("record %d is %d characters long", i+1, len(line))
+		}
+		if sawFileControl {
+			if line != strings.Repeat("9", nachaRecordLength) {
+				return fmt.Errorf("record %d follows the file control record but is not filler", i+1)
+			}
+			continue
+		}
+		switch line[0] {
+		case '1':
+			if i != 0 {
+				return errors.New("the file header must be the first record")
+			}
+			sawFileHeader = true
+		case '5':
+			if inBatch {
+				return fmt.Errorf("record %d starts a batch before the previous batch was closed", i+1)
+			}
+			inBatch = true
+			batchEntries, batchHash, batchDebit, batchCredit = 0, 0, 0, 0
+		case '6':
+			if !inBatch {
+				return fmt.Errorf("record %d is an entry outside of a batch", i+1)
+			}
+			amount := field(line, 30, 39)
+			switch line[1:3] {
+			case "22", "32":
+				batchCredit += amount
+			case "27", "37":
+				batchDebit += amount
+			default:
+				return fmt.Errorf("record %d has unsupported transaction code %s", i+1, line[1:3])
+			}
+			batchEntries++
+			batchHash += field(line, 4, 11)
+		case '8':
+			if !inBatch {
+				return fmt.Errorf("record %d closes a batch that was never opened", i+1)
+			}
+			if field(line, 5, 10) != batchEntries {
+				return fmt.Errorf("batch control entry count %d does not match %d entries", field(line, 5, 10), batchEntries)
+			}
+			if field(line, 11, 20) != batchHash%10000000000 {
+				return fmt.Errorf("batch control entry hash %d does not match %d", field(line, 11, 20), batchHash%10000000000)
+			}
+			if field(line, 21, 32) != batchDebit || field(line, 33, 44) != batchCredit {
+				return fmt.Errorf("batch control totals do not match the batch's entries")
+			}
+			inBatch = false
+			batches++
+			fileEntries += batchEntries
+			fileHash += batchHash
+			fileDebit += batchDebit
+			fileCredit += batchCredit
+		case '9':
+			if inBatch {
+				return errors.New("the file control record appears inside a batch")
+			}
+			if field(line, 2, 7) != batches {
+				return fmt.Errorf("file control batch count %d does not match %d batches", field(line, 2, 7), batches)
+			}
+			if field(line, 8, 13) != int64(len(lines)/nachaBlockingFactor) {
+				return fmt.Errorf("file control block count %d does not match %d blocks", field(line, 8, 13), len(lines)/nachaBlockingFactor)
+			}
+			if field(line, 14, 21) != fileEntries {
+				return fmt.Errorf("file control entry count %d does not match %d entries", field(line, 14, 21), fileEntries)
+			}
+			if field(line, 22, 31) != fileHash%10000000000 {
+				return fmt.Errorf("file control entry hash %d does not match %d", field(line, 22, 31), fileHash%10000000000)
+			}
+			if field(line, 32, 43) != fileDebit || field(line, 44, 55) != fileCredit {
+				return errors.New("file control totals do not match the file's batches")
+			}
+			sawFileControl = true
+		default:
+			return fmt.Errorf("record %d has unknown record type %c", i+1, line[0])
+		}
+	}
+	if !sawFileHeader || !sawFileControl {
+		return errors.New("the file must start with a file header and end with a file control record")
+	}
+	return nil
+}
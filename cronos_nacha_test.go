@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNACHAConfig = NACHAConfig{
+	ImmediateDestination:     "021000021",
+	ImmediateDestinationName: "JPMorgan Chase",
+	ImmediateOrigin:          "1234567890",
+	ImmediateOriginName:      "Snowpack Data",
+	CompanyName:              "Snowpack Data",
+	CompanyID:                "1234567890",
+	OriginatingDFI:           "02100002",
+}
+
+var testNACHAEntries = []NACHAEntry{
+	{RoutingNumber: "011000015", AccountNumber: "123456789", AmountCents: 150000, IndividualID: "BILL12", Name: "Jane Doe"},
+	{RoutingNumber: "021000021", AccountNumber: "987654321", Savings: true, AmountCents: 72550, IndividualID: "BILL13", Name: "John Smith"},
+}
+
+var (
+	testNACHAEffective = time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)
+	testNACHANow       = time.Date(2024, 3, 15, 14, 30, 0, 0, time.UTC)
+)
+
+// nachaRecords splits a NACHA file into its records
+func nachaRecords(file []byte) []string {
+	return strings.Split(strings.TrimRight(string(file), "\n"), "\n")
+}
+
+// nachaField returns the characters of a record between the 1 based start and end positions of the NACHA spec
+func nachaField(record string, start, end int) string {
+	return record[start-1 : end]
+}
+
+func TestBuildNACHAMatchesFixture(t *testing.T) {
+	file, err := BuildNACHA(testNACHAConfig, testNACHAEntries, 7, 1, testNACHAEffective, testNACHANow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := os.ReadFile("testdata/nacha/payout.ach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file, fixture) {
+		t.Fatalf("generated file does not match testdata/nacha/payout.ach:\n%s", file)
+	}
+
+	records := nachaRecords(fixture)
+	fields := []struct {
+		record     int
+		start, end int
+		name, want string
+	}{
+		{0, 1, 1, "file header record type", "1"},
+		{0, 2, 3, "priority code", "01"},
+		{0, 4, 13, "immediate destination", " 021000021"},
+		{0, 14, 23, "immediate origin", "1234567890"},
+		{0, 24, 29, "file creation date", "240315"},
+		{0, 30, 33, "file creation time", "1430"},
+		{0, 34, 34, "file ID modifier", "B"},
+		{0, 35, 37, "record size", "094"},
+		{0, 38, 39, "blocking factor", "10"},
+		{0, 40, 40, "format code", "1"},
+		{0, 41, 63, "immediate destination name", "JPMORGAN CHASE         "},
+		{0, 64, 86, "immediate origin name", "SNOWPACK DATA          "},
+		{1, 1, 1, "batch header record type", "5"},
+		{1, 2, 4, "batch header service class", "220"},
+		{1, 5, 20, "company name", "SNOWPACK DATA   "},
+		{1, 41, 50, "company identification", "1234567890"},
+		{1, 51, 53, "standard entry class", "PPD"},
+		{1, 54, 63, "company entry description", "PAYROLL   "},
+		{1, 70, 75, "effective entry date", "240318"},
+		{1, 79, 79, "originator status code", "1"},
+		{1, 80, 87, "batch header originating DFI", "02100002"},
+		{1, 88, 94, "batch header batch number", "0000007"},
+		{2, 2, 3, "checking transaction code", "22"},
+		{2, 4, 11, "receiving DFI", "01100001"},
+		{2, 12, 12, "check digit", "5"},
+		{2, 13, 29, "account number", "123456789        "},
+		{2, 30, 39, "amount", "0000150000"},
+		{2, 40, 54, "individual identification", "BILL12         "},
+		{2, 55, 76, "individual name", "JANE DOE              "},
+		{2, 79, 79, "addenda indicator", "0"},
+		{2, 80, 94, "trace number", "021000020000001"},
+		{3, 2, 3, "savings transaction code", "32"},
+		{3, 30, 39, "second amount", "0000072550"},
+		{3, 80, 94, "second trace number", "021000020000002"},
+		{4, 1, 4, "batch control record type and service class", "8220"},
+		{4, 5, 10, "batch entry count", "000002"},
+		{4, 11, 20, "batch entry hash", "0003200003"},
+		{4, 21, 32, "batch total debit", "000000000000"},
+		{4, 33, 44, "batch total credit", "000000222550"},
+		{4, 45, 54, "batch control company identification", "1234567890"},
+		{4, 80, 87, "batch control originating DFI", "02100002"},
+		{4, 88, 94, "batch control batch number", "0000007"},
+		{5, 1, 1, "file control record type", "9"},
+		{5, 2, 7, "file batch count", "000001"},
+		{5, 8, 13, "file block count", "000001"},
+		{5, 14, 21, "file entry count", "00000002"},
+		{5, 22, 31, "file entry hash", "0003200003"},
+		{5, 32, 43, "file total debit", "000000000000"},
+		{5, 44, 55, "file total credit", "000000222550"},
+	}
+	for _, field := range fields {
+		if got := nachaField(records[field.record], field.start, field.end); got != field.want {
+			t.Errorf("%s (record %d, %d-%d): got %q, want %q", field.name, field.record+1, field.start, field.end, got, field.want)
+		}
+	}
+}
+
+func TestBuildNACHATruncatesEntryHash(t *testing.T) {
+	// 101 receiving DFIs of 99999999 add up to 10099999899, one digit more than the entry hash field holds
+	entries := make([]NACHAEntry, 101)
+	for i := range entries {
+		entries[i] = NACHAEntry{RoutingNumber: "999999992", AccountNumber: "123456789", AmountCents: 100, IndividualID: "BILL1", Name: "Jane Doe"}
+	}
+	file, err := BuildNACHA(testNACHAConfig, entries, 1, 0, testNACHAEffective, testNACHANow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := nachaRecords(file)
+	batchControl, fileControl := records[len(entries)+2], records[len(entries)+3]
+	if got := nachaField(batchControl, 11, 20); got != "0099999899" {
+		t.Errorf("batch entry hash: got %s, want 0099999899", got)
+	}
+	if got := nachaField(fileControl, 22, 31); got != "0099999899" {
+		t.Errorf("file entry hash: got %s, want 0099999899", got)
+	}
+}
+
+func TestBuildNACHAPadsToWholeBlocks(t *testing.T) {
+	for _, test := range []struct {
+		entries, records, blocks int
+	}{
+		// The headers and controls take 4 records on top of the entries
+		{1, 10, 1},
+		{6, 10, 1},
+		{7, 20, 2},
+		{16, 20, 2},
+	} {
+		entries := make([]NACHAEntry, test.entries)
+		for i := range entries {
+			entries[i] = testNACHAEntries[i%len(testNACHAEntries)]
+		}
+		file, err := BuildNACHA(testNACHAConfig, entries, 1, 0, testNACHAEffective, testNACHANow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := nachaRecords(file)
+		if len(records) != test.records {
+			t.Errorf("%d entries: got %d records, want %d", test.entries, len(records), test.records)
+			continue
+		}
+		fillers := test.records - test.entries - 4
+		for _, record := range records[len(records)-fillers:] {
+			if record != strings.Repeat("9", nachaRecordLength) {
+				t.Errorf("%d entries: got padding record %q, want filler", test.entries, record)
+			}
+		}
+		fileControl := records[len(records)-fillers-1]
+		if got := nachaField(fileControl, 8, 13); got != nachaNumeric(int64(test.blocks), 6) {
+			t.Errorf("%d entries: got block count %s, want %d", test.entries, got, test.blocks)
+		}
+	}
+}
+
+func TestValidateNACHARejectsTamperedControl(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/nacha/payout.ach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateNACHA(fixture); err != nil {
+		t.Fatalf("fixture should be valid: %v", err)
+	}
+	tamper := func(record, start int, value string) []byte {
+		records := nachaRecords(fixture)
+		records[record] = records[record][:start-1] + value + records[record][start-1+len(value):]
+		return []byte(strings.Join(records, "\n") + "\n")
+	}
+	for name, file := range map[string][]byte{
+		"file control credit total": tamper(5, 44, "000000222551"),
+		"file control entry hash":   tamper(5, 22, "0003200004"),
+		"file control entry count":  tamper(5, 14, "00000003"),
+		"file control block count":  tamper(5, 8, "000002"),
+		"batch control credit":      tamper(4, 33, "000000999999"),
+		"entry amount":              tamper(2, 30, "0000150001"),
+		"filler record":             tamper(9, 1, "8"),
+	} {
+		if err := ValidateNACHA(file); err == nil {
+			t.Errorf("%s: tampered file was accepted", name)
+		}
+	}
+}
+
+func TestBuildNACHAFileIDModifier(t *testing.T) {
+	for modifier, want := range map[int]string{0: "A", 25: "Z", 26: "0", 35: "9"} {
+		file, err := BuildNACHA(testNACHAConfig, testNACHAEntries, 1, modifier, testNACHAEffective, testNACHANow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nachaField(nachaRecords(file)[0], 34, 34); got != want {
+			t.Errorf("modifier %d: got %s, want %s", modifier, got, want)
+		}
+	}
+	if _, err := BuildNACHA(testNACHAConfig, testNACHAEntries, 1, 36, testNACHAEffective, testNACHANow); err == nil {
+		t.Error("a 37th file in a day was accepted")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// PaymentProvider generates hosted payment pages that clients can use to pay an invoice
+type PaymentProvider interface {
+	// Name identifies the provider that issued a link
+	Name() string
+	// CreatePaymentLink creates a hosted payment page for the full amount of the invoice
+	CreatePaymentLink(invoice cronos.Invoice) (InvoicePaymentLink, error)
+}
+
+// InvoicePaymentLink is the hosted payment page generated for an invoice when it is sent
+type InvoicePaymentLink struct {
+	gorm.Model
+	InvoiceID  uint    `json:"invoice_id" gorm:"uniqueIndex"`
+	Provider   string  `json:"provider"`
+	ProviderID string  `json:"provider_id"`
+	URL        string  `json:"url"`
+	Amount     float64 `json:"amount"`
+}
+
+// NewPaymentProvider selects the payment provider from the PAYMENT_PROVIDER environment variable. Anything other
+// than "stripe" uses the fake provider so that local and development environments never create real payment links.
+func NewPaymentProvider() PaymentProvider {
+	if os.Getenv("PAYMENT_PROVIDER") == "stripe" {
+		return &StripePaymentProvider{
+			APIKey:  os.Getenv("STRIPE_API_KEY"),
+			BaseURL: "https://api.stripe.com/v1",
+			Client:  &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	baseURL := os.Getenv("PAYMENT_LINK_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return &FakePaymentProvider{BaseURL: baseURL}
+}
+
+// FakePaymentProvider issues predictable links without contacting any external service, for local and dev use
+type FakePaymentProvider struct {
+	BaseURL string
+}
+
+// Name identifies the fake provider
+func (p *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+// CreatePaymentLink returns a link derived from the invoice ID
+func (p *FakePaymentProvider) CreatePaymentLink(invoice cronos.Invoice) (InvoicePaymentLink, error) {
+	return InvoicePaymentLink{
+		InvoiceID:  invoice.ID,
+		Provider:   p.Name(),
+		ProviderID: fmt.Sprintf("fake_%d", invoice.ID),
+		URL:        fmt.Sprintf("%s/pay/%d", strings.TrimRight(p.BaseURL, "/"), invoice.ID),
+		Amount:     invoice.TotalAmount,
+	}, nil
+}
+
+// StripePaymentProvider creates Stripe Payment Links. The invoice ID and name are attached as metadata to the
+// resulting payment so that PaymentWebhookHandler can match the payment back to the invoice.
+type StripePaymentProvider struct {
+	APIKey  string
+	BaseURL string
+	Client  *http.Client
+}
+
+// Name identifies the Stripe provider
+func (p *StripePaymentProvider) Name() string {
+	return "stripe"
+}
+
+// post sends a form encoded request to the Stripe API and decodes the response into out
+func (p *StripePaymentProvider) post(path string, form url.Values, out interface{}) error {
+	req, err := http.NewRequest("POST", p.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create Stripe request: %w", err)
+	}
+	req.SetBasicAuth(p.APIKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to Stripe: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stripe request to %s failed with status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// CreatePaymentLink creates a one-off price for the invoice total and a payment link for that price
+func (p *StripePaymentProvider) CreatePaymentLink(invoice cronos.Invoice) (InvoicePaymentLink, error) {
+	if p.APIKey == "" {
+		return InvoicePaymentLink{}, errors.New("STRIPE_API_KEY not set")
+	}
+	invoiceID := strconv.FormatUint(uint64(invoice.ID), 10)
+
+	var price struct {
+		ID string `json:"id"`
+	}
+	priceForm := url.Values{}
+	priceForm.Set("currency", "usd")
+	priceForm.Set("unit_amount", strconv.FormatInt(int64(math.Round(invoice.TotalAmount*100)), 10))
+	priceForm.Set("product_data[name]", "Invoice "+invoice.Name)
+	if err := p.post("/prices", priceForm, &price); err != nil {
+		return InvoicePaymentLink{}, err
+	}
+
+	var link struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	linkForm := url.Values{}
+	linkForm.Set("line_items[0][price]", price.ID)
+	linkForm.Set("line_items[0][quantity]", "1")
+	linkForm.Set("restrictions[completed_sessions][limit]", "1")
+	linkForm.Set("metadata[invoice_id]", invoiceID)
+	linkForm.Set("metadata[invoice_number]", invoice.Name)
+	linkForm.Set("payment_intent_data[metadata][invoice_id]", invoiceID)
+	linkForm.Set("payment_intent_data[metadata][invoice_number]", invoice.Name)
+	if err := p.post("/payment_links", linkForm, &link); err != nil {
+		return InvoicePaymentLink{}, err
+	}
+
+	return InvoicePaymentLink{
+		InvoiceID:  invoice.ID,
+		Provider:   p.Name(),
+		ProviderID: link.ID,
+		URL:        link.URL,
+		Amount:     invoice.TotalAmount,
+	}, nil
+}
+
+// CreateInvoicePaymentLink generates and stores a payment link for an invoice, replacing any previous link
+func (a *App) CreateInvoicePaymentLink(invoice *cronos.Invoice) (InvoicePaymentLink, error) {
+	if invoice.TotalAmount <= 0 {
+		return InvoicePaymentLink{}, fmt.Errorf("invoice %d has nothing to pay", invoice.ID)
+	}
+	link, err := a.paymentProvider.CreatePaymentLink(*invoice)
+	if err != nil {
+		return link, err
+	}
+	a.cronosApp.DB.Unscoped().Where("invoice_id = ?", invoice.ID).Delete(&InvoicePaymentLink{})
+	if err := a.cronosApp.DB.Create(&link).Error; err != nil {
+		return link, err
+	}
+	return link, nil
+}
+
+// invoicePaymentURL returns the stored payment link for an invoice, or an empty string if there is none
+func (a *App) invoicePaymentURL(invoiceID uint) string {
+	var link InvoicePaymentLink
+	a.cronosApp.DB.Where("invoice_id = ?", invoiceID).Limit(1).Find(&link)
+	return link.URL
+}
+
+// emailInvoicePaymentLink sends the invoice's account the sent invoice along with the link to pay it
+func (a *App) emailInvoicePaymentLink(invoice *cronos.Invoice, link InvoicePaymentLink) {
+	var account cronos.Account
+	a.cronosApp.DB.Where("id = ?", invoice.AccountID).Limit(1).Find(&account)
+	if account.Email == "" {
+		log.Printf("No billing email on file for invoice %d, payment link not emailed", invoice.ID)
+		return
+	}
+	email := cronos.Email{
+		SenderEmail:    "accounts@snowpack-data.io",
+		SenderName:     "Snowpack Data",
+		RecipientEmail: account.Email,
+		RecipientName:  account.Name,
+		Subject:        fmt.Sprintf("Invoice %s from Snowpack Data", invoice.Name),
+		PlainTextContent: fmt.Sprintf("Invoice %s for $%.2f is due on %s.\r\n\r\nYou can pay online at: %s\r\n",
+			invoice.Name, invoice.TotalAmount, invoice.DueAt.Format("January 2, 2006"), link.URL),
+	}
+	if err := a.cronosApp.SendTextEmail(email); err != nil {
+		log.Printf("Error emailing payment link for invoice %d: %v", invoice.ID, err)
+	}
+}
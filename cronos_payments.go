@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// webhookTolerance is how far a signed webhook timestamp may drift from our clock before we treat it as a replay
+const webhookTolerance = 5 * time.Minute
+
+// Payment webhook event statuses
+const (
+	PaymentEventProcessed = "processed"
+	PaymentEventUnmatched = "unmatched"
+	PaymentEventIgnored   = "ignored"
+)
+
+var (
+	errMissingSignature = errors.New("missing webhook signature")
+	errInvalidSignature = errors.New("invalid webhook signature")
+	errStaleSignature   = errors.New("webhook timestamp outside of tolerance")
+)
+
+// Payment is a payment received against an invoice from an external payment provider. A provider payment is only
+// ever recorded once, however many events the provider sends about it.
+type Payment struct {
+	gorm.Model
+	InvoiceID         uint      `json:"invoice_id" gorm:"index"`
+	Provider          string    `json:"provider" gorm:"uniqueIndex:idx_payments_provider_payment"`
+	ProviderPaymentID string    `json:"provider_payment_id" gorm:"uniqueIndex:idx_payments_provider_payment"`
+	ProviderEventID   string    `json:"provider_event_id"`
+	Amount            float64   `json:"amount"`
+	Currency          string    `json:"currency"`
+	ReceivedAt        time.Time `json:"received_at"`
+}
+
+// PaymentWebhookEvent records every webhook event we have accepted. The unique event ID gives us replay protection
+// and the stored payload lets us reconcile events that could not be matched to an invoice.
+type PaymentWebhookEvent struct {
+	gorm.Model
+	EventID   string `json:"event_id" gorm:"uniqueIndex"`
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	InvoiceID *uint  `json:"invoice_id"`
+	Payload   string `json:"-" gorm:"type:text"`
+}
+
+// PaymentEvent is the subset of a Stripe-compatible webhook event that we need to reconcile a payment
+type PaymentEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object PaymentEventObject `json:"object"`
+	} `json:"data"`
+}
+
+// PaymentEventObject is the payment intent, charge or checkout session carried by a PaymentEvent
+type PaymentEventObject struct {
+	ID                string            `json:"id"`
+	Object            string            `json:"object"`
+	Amount            int64             `json:"amount"`
+	AmountReceived    int64             `json:"amount_received"`
+	AmountTotal       int64             `json:"amount_total"`
+	Currency          string            `json:"currency"`
+	Description       string            `json:"description"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	Metadata          map[string]string `json:"metadata"`
+}
+
+// AmountPaid returns the amount collected in major currency units, preferring the most specific field available
+func (o PaymentEventObject) AmountPaid() float64 {
+	cents := o.Amount
+	if o.AmountTotal != 0 {
+		cents = o.AmountTotal
+	}
+	if o.AmountReceived != 0 {
+		cents = o.AmountReceived
+	}
+	return float64(cents) / 100
+}
+
+// isPaymentSucceededEvent reports whether an event type represents money that has been collected. A single payment
+// also fires charge.succeeded and checkout.session.completed, each with its own event ID and the invoice metadata,
+// so only the payment intent is counted.
+func isPaymentSucceededEvent(eventType string) bool {
+	return eventType == "payment_intent.succeeded"
+}
+
+// VerifyWebhookSignature checks a Stripe-compatible signature header of the form `t=<unix>,v1=<hex hmac>` against
+// the raw request payload. The HMAC is computed over `<t>.<payload>` with SHA-256.
+func VerifyWebhookSignature(payload []byte, header string, secret string, now time.Time) error {
+	if header == "" {
+		return errMissingSignature
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errMissingSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if math.Abs(now.Sub(time.Unix(unix, 0)).Seconds()) > webhookTolerance.Seconds() {
+		return errStaleSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errInvalidSignature
+}
+
+// matchInvoiceForPayment finds the invoice a payment belongs to using, in order, the invoice_id metadata,
+// the invoice_number metadata, the client reference and finally the description
+func (a *App) matchInvoiceForPayment(object PaymentEventObject) (cronos.Invoice, bool) {
+	var invoice cronos.Invoice
+	if invoiceID := object.Metadata["invoice_id"]; invoiceID != "" {
+		if a.cronosApp.DB.Where("id = ? and type = ?", invoiceID, cronos.InvoiceTypeAR).Limit(1).Find(&invoice).RowsAffected != 0 {
+			return invoice, true
+		}
+	}
+	for _, invoiceNumber := range []string{object.Metadata["invoice_number"], object.ClientReferenceID, object.Description} {
+		if invoiceNumber == "" {
+			continue
+		}
+		if a.cronosApp.DB.Where("name = ? and type = ?", invoiceNumber, cronos.InvoiceTypeAR).Limit(1).Find(&invoice).RowsAffected != 0 {
+			return invoice, true
+		}
+	}
+	return invoice, false
+}
+
+// PaymentWebhookHandler receives signed payment events from our payment provider, records the payment against the
+// matching invoice and marks the invoice paid once payments cover the invoice total. The endpoint sits outside of
+// the JWT protected API and is authenticated by its HMAC signature instead.
+func (a *App) PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Println("Payment webhook received but PAYMENT_WEBHOOK_SECRET is not set")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if err := VerifyWebhookSignature(payload, r.Header.Get("Stripe-Signature"), secret, time.Now()); err != nil {
+		log.Printf("Rejected payment webhook: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		http.Error(w, "Invalid event payload", http.StatusBadRequest)
+		return
+	}
+
+	status, err := a.ProcessPaymentEvent(event, payload)
+	if err != nil {
+		log.Printf("Error processing payment event %s: %v", event.ID, err)
+		http.Error(w, "Error processing event", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// ProcessPaymentEvent records a verified payment event exactly once and returns the resulting event status.
+// Replayed events are acknowledged with their original status without being processed again.
+func (a *App) ProcessPaymentEvent(event PaymentEvent, payload []byte) (string, error) {
+	var existing PaymentWebhookEvent
+	if a.cronosApp.DB.Where("event_id = ?", event.ID).Limit(1).Find(&existing).RowsAffected != 0 {
+		return existing.Status, nil
+	}
+
+	record := PaymentWebhookEvent{EventID: event.ID, Type: event.Type, Payload: string(payload)}
+	if !isPaymentSucceededEvent(event.Type) {
+		record.Status = PaymentEventIgnored
+		return record.Status, a.cronosApp.DB.Create(&record).Error
+	}
+
+	object := event.Data.Object
+	invoice, ok := a.matchInvoiceForPayment(object)
+	if !ok {
+		log.Printf("Payment event %s could not be matched to an invoice", event.ID)
+		record.Status = PaymentEventUnmatched
+		return record.Status, a.cronosApp.DB.Create(&record).Error
+	}
+
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		record.Status = PaymentEventProcessed
+		record.InvoiceID = &invoice.ID
+		// The unique event ID index makes concurrent deliveries of the same event fail here
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		// A payment can still arrive twice under different event IDs, for example when an event is resent
+		if tx.Where("provider = ? and provider_payment_id = ?", "stripe", object.ID).Limit(1).Find(&Payment{}).RowsAffected != 0 {
+			return nil
+		}
+		payment := Payment{
+			InvoiceID:         invoice.ID,
+			Provider:          "stripe",
+			ProviderPaymentID: object.ID,
+			ProviderEventID:   event.ID,
+			Amount:            object.AmountPaid(),
+			Currency:          strings.ToUpper(object.Currency),
+			ReceivedAt:        time.Unix(event.Created, 0),
+		}
+		return tx.Create(&payment).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	a.settleInvoicePayments(&invoice)
+	return record.Status, nil
+}
+
+// settleInvoicePayments marks a sent invoice paid once the payments recorded against it cover its total. It runs
+// when a payment arrives and again when the invoice is sent, so that a payment made while the invoice was still
+// approved is applied once it goes out.
+func (a *App) settleInvoicePayments(invoice *cronos.Invoice) {
+	if invoice.State != cronos.InvoiceStateSent.String() {
+		return
+	}
+	var totalPaid float64
+	a.cronosApp.DB.Model(&Payment{}).Where("invoice_id = ?", invoice.ID).Select("coalesce(sum(amount), 0)").Scan(&totalPaid)
+	// Allow half a cent of slack for the rounding of provider amounts to cents
+	if totalPaid+0.005 < invoice.TotalAmount {
+		return
+	}
+	// The payment is already recorded, so a retry of the event would be treated as a replay. Log the failure for
+	// manual follow up rather than asking the provider to redeliver.
+	if err := a.MarkInvoicePaid(invoice, 0); err != nil {
+		log.Printf("Payments recorded but invoice %d could not be marked paid: %v", invoice.ID, err)
+	}
+}
+
+// InvoicePaymentsListHandler lists the payments recorded against an invoice
+func (a *App) InvoicePaymentsListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var payments []Payment
+	a.cronosApp.DB.Where("invoice_id = ?", vars["id"]).Order("received_at ASC").Find(&payments)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&payments)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+// deliverFixture signs a recorded webhook event as the provider would and delivers it to the webhook handler,
+// returning the response status code and the event status reported in the body
+func deliverFixture(t *testing.T, a *App, name string) (int, string) {
+	t.Helper()
+	payload, err := os.ReadFile(filepath.Join("testdata", "payments", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", name, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	req := httptest.NewRequest("POST", "/webhooks/payments", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	a.PaymentWebhookHandler(w, req)
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&body)
+	return w.Code, body.Status
+}
+
+// newPaymentsTestApp creates an App with a sent invoice 42 for the given total, matching the fixture metadata
+func newPaymentsTestApp(t *testing.T, total float64) *App {
+	t.Helper()
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", testWebhookSecret)
+	a := newTestApp(t, &cronos.Invoice{}, &Payment{}, &PaymentWebhookEvent{})
+	invoice := cronos.Invoice{
+		Name:        "SNOW-2024-0042",
+		Type:        cronos.InvoiceTypeAR.String(),
+		State:       cronos.InvoiceStateSent.String(),
+		TotalAmount: total,
+	}
+	invoice.ID = 42
+	if err := a.cronosApp.DB.Create(&invoice).Error; err != nil {
+		t.Fatalf("failed to create invoice: %v", err)
+	}
+	return a
+}
+
+func paymentsFor(t *testing.T, a *App, invoiceID uint) []Payment {
+	t.Helper()
+	var payments []Payment
+	a.cronosApp.DB.Where("invoice_id = ?", invoiceID).Find(&payments)
+	return payments
+}
+
+func TestPaymentWebhookDuplicateDelivery(t *testing.T) {
+	a := newPaymentsTestApp(t, 1500)
+	for i := 0; i < 2; i++ {
+		code, status := deliverFixture(t, a, "payment_intent_succeeded.json")
+		if code != http.StatusOK || status != PaymentEventProcessed {
+			t.Fatalf("delivery %d: got %d %q, want 200 %q", i+1, code, status, PaymentEventProcessed)
+		}
+	}
+	if payments := paymentsFor(t, a, 42); len(payments) != 1 {
+		t.Fatalf("got %d payments after a duplicate delivery, want 1", len(payments))
+	}
+}
+
+func TestPaymentWebhookSiblingEvents(t *testing.T) {
+	a := newPaymentsTestApp(t, 1500)
+	want := map[string]string{
+		"payment_intent_succeeded.json":   PaymentEventProcessed,
+		"charge_succeeded.json":           PaymentEventIgnored,
+		"checkout_session_completed.json": PaymentEventIgnored,
+	}
+	for _, name := range []string{"checkout_session_completed.json", "charge_succeeded.json", "payment_intent_succeeded.json"} {
+		if code, status := deliverFixture(t, a, name); code != http.StatusOK || status != want[name] {
+			t.Errorf("%s: got %d %q, want 200 %q", name, code, status, want[name])
+		}
+	}
+	payments := paymentsFor(t, a, 42)
+	if len(payments) != 1 {
+		t.Fatalf("got %d payments for one payment's events, want 1", len(payments))
+	}
+	if payments[0].ProviderPaymentID != "pi_3PbX2kHy7nQfL0aB1Wm8sQ2d" || payments[0].Amount != 1000 {
+		t.Errorf("got payment %s for %.2f, want the payment intent for 1000.00", payments[0].ProviderPaymentID, payments[0].Amount)
+	}
+	var events int64
+	a.cronosApp.DB.Model(&PaymentWebhookEvent{}).Count(&events)
+	if events != 3 {
+		t.Errorf("got %d recorded events, want 3", events)
+	}
+}
+
+func TestPaymentWebhookPartialPayment(t *testing.T) {
+	a := newPaymentsTestApp(t, 1500)
+	if code, status := deliverFixture(t, a, "payment_intent_succeeded.json"); code != http.StatusOK || status != PaymentEventProcessed {
+		t.Fatalf("got %d %q, want 200 %q", code, status, PaymentEventProcessed)
+	}
+	var invoice cronos.Invoice
+	a.cronosApp.DB.First(&invoice, 42)
+	if invoice.State != cronos.InvoiceStateSent.String() {
+		t.Errorf("got invoice state %q after a partial payment, want it to stay sent", invoice.State)
+	}
+	if payments := paymentsFor(t, a, 42); len(payments) != 1 || payments[0].Amount != 1000 {
+		t.Errorf("got %+v, want a single payment of 1000.00", payments)
+	}
+}
+
+func TestPaymentWebhookUnmatched(t *testing.T) {
+	a := newPaymentsTestApp(t, 1500)
+	if code, status := deliverFixture(t, a, "payment_intent_unmatched.json"); code != http.StatusOK || status != PaymentEventUnmatched {
+		t.Fatalf("got %d %q, want 200 %q", code, status, PaymentEventUnmatched)
+	}
+	var payments int64
+	a.cronosApp.DB.Model(&Payment{}).Count(&payments)
+	if payments != 0 {
+		t.Errorf("got %d payments for an unmatched event, want 0", payments)
+	}
+	var event PaymentWebhookEvent
+	a.cronosApp.DB.Where("event_id = ?", "evt_3PcA9qHy7nQfL0aB0Rt2Zx8M").First(&event)
+	if event.Status != PaymentEventUnmatched || event.Payload == "" {
+		t.Errorf("got event %+v, want the unmatched event stored with its payload for reconciliation", event)
+	}
+}
+
+func TestPaymentWebhookRejectsBadSignature(t *testing.T) {
+	a := newPaymentsTestApp(t, 1500)
+	req := httptest.NewRequest("POST", "/webhooks/payments", bytes.NewReader([]byte(`{"id":"evt_forged"}`)))
+	req.Header.Set("Stripe-Signature", "t="+strconv.FormatInt(time.Now().Unix(), 10)+",v1=00")
+	w := httptest.NewRecorder()
+	a.PaymentWebhookHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a forged signature, want 400", w.Code)
+	}
+}
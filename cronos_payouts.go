@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Payout batch states. A batch is generated from approved bills, its file is uploaded to the bank, and it is
+// confirmed once the bank accepts it, which marks its bills paid.
+const (
+	PayoutStateGenerated = "generated"
+	PayoutStateConfirmed = "confirmed"
+	PayoutStateCancelled = "cancelled"
+)
+
+// Bank account types
+const (
+	BankAccountChecking = "checking"
+	BankAccountSavings  = "savings"
+)
+
+// errBankDetailsKey is returned when BANK_DETAILS_KEY is missing or is not a base64 encoded 32 byte key
+var errBankDetailsKey = errors.New("BANK_DETAILS_KEY must be a base64 encoded 32 byte key")
+
+// EmployeeBankAccount holds the account an employee is paid into. The routing and account numbers are encrypted at
+// rest and are never included in API responses.
+type EmployeeBankAccount struct {
+	gorm.Model
+	EmployeeID             uint   `json:"employee_id" gorm:"uniqueIndex"`
+	AccountHolder          string `json:"account_holder"`
+	AccountType            string `json:"account_type"`
+	AccountLast4           string `json:"account_last4"`
+	EncryptedRoutingNumber string `json:"-"`
+	EncryptedAccountNumber string `json:"-"`
+}
+
+// PayoutBatch is a set of approved bills paid together through one ACH file. The file is generated when the batch
+// is created and stored encrypted, so that every download is the same file whatever changes to bank details are
+// made afterwards.
+type PayoutBatch struct {
+	gorm.Model
+	State         string       `json:"state"`
+	EffectiveDate time.Time    `json:"effective_date"`
+	TotalAmount   float64      `json:"total_amount"`
+	ConfirmedAt   *time.Time   `json:"confirmed_at"`
+	EncryptedFile string       `json:"-" gorm:"type:text"`
+	Items         []PayoutItem `json:"items"`
+}
+
+// PayoutItem is a bill included in a payout batch
+type PayoutItem struct {
+	gorm.Model
+	PayoutBatchID uint    `json:"payout_batch_id" gorm:"index"`
+	BillID        uint    `json:"bill_id" gorm:"index"`
+	EmployeeID    uint    `json:"employee_id"`
+	EmployeeName  string  `json:"employee_name"`
+	Amount        float64 `json:"amount"`
+}
+
+// bankDetailsCipher builds the AES-GCM cipher used to encrypt bank details from BANK_DETAILS_KEY
+func bankDetailsCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("BANK_DETAILS_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, errBankDetailsKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBankDetail encrypts a value with a random nonce, returning the nonce and ciphertext base64 encoded
+func encryptBankDetail(value string) (string, error) {
+	gcm, err := bankDetailsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// decryptBankDetail reverses encryptBankDetail
+func decryptBankDetail(encrypted string) (string, error) {
+	gcm, err := bankDetailsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("bank details are corrupted")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("bank details could not be decrypted")
+	}
+	return string(plain), nil
+}
+
+// generatedPayoutBatch finds the batch a bill is waiting to be paid in, if its file has been generated but the batch
+// has not yet been confirmed or cancelled
+func (a *App) generatedPayoutBatch(billID uint) (PayoutBatch, bool) {
+	var batch PayoutBatch
+	found := a.cronosApp.DB.Where("state = ? and id in (?)", PayoutStateGenerated,
+		a.cronosApp.DB.Model(&PayoutItem{}).Select("payout_batch_id").Where("bill_id = ?", billID)).
+		Limit(1).Find(&batch).RowsAffected > 0
+	return batch, found
+}
+
+// nachaConfig reads our bank and company details for ACH files from the environment
+func nachaConfig() NACHAConfig {
+	return NACHAConfig{
+		ImmediateDestination:     os.Getenv("ACH_IMMEDIATE_DESTINATION"),
+		ImmediateDestinationName: os.Getenv("ACH_IMMEDIATE_DESTINATION_NAME"),
+		ImmediateOrigin:          os.Getenv("ACH_IMMEDIATE_ORIGIN"),
+		ImmediateOriginName:      os.Getenv("ACH_IMMEDIATE_ORIGIN_NAME"),
+		CompanyName:              os.Getenv("ACH_COMPANY_NAME"),
+		CompanyID:                os.Getenv("ACH_COMPANY_ID"),
+		OriginatingDFI:           os.Getenv("ACH_ORIGINATING_DFI"),
+	}
+}
+
+// EmployeeBankAccountHandler shows and updates the bank account an employee is paid into, for admins or the
+// employee themselves. Updates take `account_holder`, `account_type`, `routing_number` and `account_number`.
+func (a *App) EmployeeBankAccountHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("id = ?", vars["id"]).Limit(1).Find(&employee).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if self, found := a.contextEmployee(r); !a.contextUserIsAdmin(r) && (!found || self.ID != employee.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	account := EmployeeBankAccount{EmployeeID: employee.ID}
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Limit(1).Find(&account)
+
+	switch {
+	case r.Method == "GET":
+		if account.ID == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&account)
+		return
+	case r.Method == "PUT":
+		var errs ValidationErrors
+		routingNumber, accountNumber := r.FormValue("routing_number"), r.FormValue("account_number")
+		if !validRoutingNumber(routingNumber) {
+			errs.Add("routing_number", "Expected a valid 9 digit routing number")
+		}
+		if _, err := strconv.ParseUint(accountNumber, 10, 64); err != nil || len(accountNumber) < 4 || len(accountNumber) > 17 {
+			errs.Add("account_number", "Expected an account number of 4 to 17 digits")
+		}
+		if accountType := r.FormValue("account_type"); accountType != BankAccountChecking && accountType != BankAccountSavings {
+			errs.Add("account_type", fmt.Sprintf("Expected %s or %s", BankAccountChecking, BankAccountSavings))
+		}
+		if r.FormValue("account_holder") == "" {
+			errs.Add("account_holder", "The account holder's name is required")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		encryptedRouting, err := encryptBankDetail(routingNumber)
+		if err == nil {
+			account.EncryptedAccountNumber, err = encryptBankDetail(accountNumber)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		account.EncryptedRoutingNumber = encryptedRouting
+		account.AccountHolder = r.FormValue("account_holder")
+		account.AccountType = r.FormValue("account_type")
+		account.AccountLast4 = accountNumber[len(accountNumber)-4:]
+		a.cronosApp.DB.Save(&account)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&account)
+		return
+	}
+}
+
+// PayoutBatchesListHandler lists payout batches for admins, most recent first
+func (a *App) PayoutBatchesListHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var batches []PayoutBatch
+	a.cronosApp.DB.Preload("Items").Order("created_at DESC").Find(&batches)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&batches)
+}
+
+// PayoutBatchHandler shows a payout batch and the bills in it to admins
+func (a *App) PayoutBatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var batch PayoutBatch
+	if a.cronosApp.DB.Preload("Items").Where("id = ?", vars["id"]).Limit(1).Find(&batch).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&batch)
+}
+
+// CreatePayoutBatchHandler creates a payout batch from approved bills, either the given `bill_id` values or every
+// approved bill not already in a batch, paid on the `effective_date`. Every bill must be approved, have a positive
+// amount and belong to an employee with bank details on file.
+func (a *App) CreatePayoutBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var errs ValidationErrors
+	effective, err := time.Parse("2006-01-02", r.FormValue("effective_date"))
+	if err != nil {
+		errs.Add("effective_date", "Expected a date in the format YYYY-MM-DD")
+	}
+
+	// Bills already in a batch that has not been cancelled cannot be paid twice
+	batchedBillIDs := a.cronosApp.DB.Model(&PayoutItem{}).Select("payout_items.bill_id").
+		Joins("JOIN payout_batches ON payout_batches.id = payout_items.payout_batch_id").
+		Where("payout_batches.state != ? and payout_batches.deleted_at is null", PayoutStateCancelled)
+	query := a.cronosApp.DB.Preload("Employee").
+		Where("id in (?) and id not in (?)", a.cronosApp.DB.Model(&BillStatus{}).Select("bill_id").Where("state = ?", BillStateApproved), batchedBillIDs)
+	if len(r.Form["bill_id"]) > 0 {
+		query = query.Where("id in ?", r.Form["bill_id"])
+	}
+	var bills []cronos.Bill
+	query.Order("id ASC").Find(&bills)
+	if len(r.Form["bill_id"]) > 0 && len(bills) != len(r.Form["bill_id"]) {
+		errs.Add("bill_id", "Every bill must be approved and not already in a payout batch")
+	}
+	if len(bills) == 0 {
+		errs.Add("bill_id", "There are no approved bills to pay")
+	}
+	batch := PayoutBatch{State: PayoutStateGenerated, EffectiveDate: effective}
+	for _, bill := range bills {
+		if bill.TotalAmount <= 0 {
+			errs.Add("bill_id", fmt.Sprintf("Bill %d has nothing to pay", bill.ID))
+		}
+		if a.cronosApp.DB.Where("employee_id = ?", bill.Employee.ID).Limit(1).Find(&EmployeeBankAccount{}).RowsAffected == 0 {
+			errs.Add("bill_id", fmt.Sprintf("%s %s has no bank details on file", bill.Employee.FirstName, bill.Employee.LastName))
+		}
+		batch.TotalAmount += bill.TotalAmount
+		batch.Items = append(batch.Items, PayoutItem{
+			BillID:       bill.ID,
+			EmployeeID:   bill.Employee.ID,
+			EmployeeName: bill.Employee.FirstName + " " + bill.Employee.LastName,
+			Amount:       bill.TotalAmount,
+		})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	// The file is generated along with the batch so that a batch that cannot be paid is never created
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+		file, err := a.payoutFile(tx, batch)
+		if err != nil {
+			return err
+		}
+		if batch.EncryptedFile, err = encryptBankDetail(string(file)); err != nil {
+			return err
+		}
+		return tx.Model(&batch).Update("encrypted_file", batch.EncryptedFile).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(&batch)
+}
+
+// payoutFile generates the NACHA file for a batch that has just been created, paying each bill into the bank
+// account on file. The file ID modifier counts the batches created earlier the same day.
+func (a *App) payoutFile(tx *gorm.DB, batch PayoutBatch) ([]byte, error) {
+	entries := make([]NACHAEntry, len(batch.Items))
+	for i, item := range batch.Items {
+		var account EmployeeBankAccount
+		if tx.Where("employee_id = ?", item.EmployeeID).Limit(1).Find(&account).RowsAffected == 0 {
+			return nil, fmt.Errorf("%s has no bank details on file", item.EmployeeName)
+		}
+		routingNumber, err := decryptBankDetail(account.EncryptedRoutingNumber)
+		if err != nil {
+			return nil, err
+		}
+		accountNumber, err := decryptBankDetail(account.EncryptedAccountNumber)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = NACHAEntry{
+			RoutingNumber: routingNumber,
+			AccountNumber: accountNumber,
+			Savings:       account.AccountType == BankAccountSavings,
+			AmountCents:   int64(math.Round(item.Amount * 100)),
+			IndividualID:  "BILL" + strconv.Itoa(int(item.BillID)),
+			Name:          account.AccountHolder,
+		}
+	}
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var earlier int64
+	tx.Unscoped().Model(&PayoutBatch{}).Where("created_at >= ? and id < ?", day, batch.ID).Count(&earlier)
+	return BuildNACHA(nachaConfig(), entries, int64(batch.ID), int(earlier), batch.EffectiveDate, now)
+}
+
+// PayoutBatchFileHandler downloads the NACHA file of a payout batch for upload to the bank, exactly as it was
+// generated when the batch was created
+func (a *App) PayoutBatchFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var batch PayoutBatch
+	if a.cronosApp.DB.Preload("Items").Where("id = ?", vars["id"]).Limit(1).Find(&batch).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if batch.State == PayoutStateCancelled {
+		http.Error(w, "This payout batch was cancelled", http.StatusConflict)
+		return
+	}
+	if batch.EncryptedFile == "" {
+		http.Error(w, "This payout batch has no stored file, cancel it and create a new batch", http.StatusConflict)
+		return
+	}
+	file, err := decryptBankDetail(batch.EncryptedFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=US-ASCII")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("payout_%d.ach", batch.ID)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(file))
+}
+
+// PayoutBatchStateHandler confirms a generated batch once the bank has accepted its file, marking every bill in
+// it paid, or cancels it so that its bills can be included in another batch
+func (a *App) PayoutBatchStateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var batch PayoutBatch
+	if a.cronosApp.DB.Preload("Items").Where("id = ?", vars["id"]).Limit(1).Find(&batch).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if batch.State != PayoutStateGenerated {
+		http.Error(w, fmt.Sprintf("This payout batch is already %s", batch.State), http.StatusConflict)
+		return
+	}
+
+	if vars["action"] == "confirm" {
+		// The bills are paid today, however long ago the periods they cover were closed
+		now := time.Now()
+		if period, closed := a.closedPeriod(now); closed {
+			writePeriodClosed(w, period)
+			return
+		}
+		bills := make([]cronos.Bill, len(batch.Items))
+		for i, item := range batch.Items {
+			if err := a.cronosApp.DB.First(&bills[i], item.BillID).Error; err != nil {
+				http.Error(w, fmt.Sprintf("bill %d: %v", item.BillID, err), http.StatusConflict)
+				return
+			}
+			// Bills paid by an earlier attempt that stopped part way through are left as they are
+			if status := a.billStatus(bills[i]); status.State != BillStatePaid {
+				if _, err := billTransition(BillActionPaid, status); err != nil {
+					http.Error(w, fmt.Sprintf("bill %d: %v", bills[i].ID, err), http.StatusConflict)
+					return
+				}
+			}
+		}
+		// Each bill is closed in cronos before its paid transition is recorded, and the batch is only confirmed
+		// once every bill is paid, so confirming again after a failure picks up where it stopped
+		for i := range bills {
+			status := a.billStatus(bills[i])
+			if status.State == BillStatePaid {
+				continue
+			}
+			if err := a.markBillPaid(&bills[i]); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+				return a.recordBillTransition(tx, &status, BillActionPaid, BillStatePaid, r)
+			})
+			if err != nil {
+				log.Printf("Bill %d was marked paid but its status could not be recorded: %v", bills[i].ID, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		batch.State = PayoutStateConfirmed
+		batch.ConfirmedAt = &now
+		a.cronosApp.DB.Omit("Items").Save(&batch)
+	} else {
+		batch.State = PayoutStateCancelled
+		a.cronosApp.DB.Omit("Items").Save(&batch)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&batch)
+}
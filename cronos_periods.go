@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Period actions recorded in the period history
+const (
+	PeriodActionClose  = "close"
+	PeriodActionReopen = "reopen"
+)
+
+// AccountingPeriod is a calendar month that can be closed once it has been invoiced and reported. Entries,
+// adjustments and bills dated in a closed period cannot be created or modified until an admin reopens it.
+type AccountingPeriod struct {
+	gorm.Model
+	Month    time.Time     `json:"month" gorm:"uniqueIndex"`
+	Closed   bool          `json:"closed"`
+	ClosedAt *time.Time    `json:"closed_at"`
+	Events   []PeriodEvent `json:"events"`
+}
+
+// PeriodEvent records who closed or reopened a period and why
+type PeriodEvent struct {
+	gorm.Model
+	AccountingPeriodID uint   `json:"accounting_period_id" gorm:"index"`
+	Action             string `json:"action"`
+	UserID             uint   `json:"user_id"`
+	UserName           string `json:"user_name"`
+	Reason             string `json:"reason"`
+}
+
+// periodMonth returns midnight on the first of the month containing t
+func periodMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// closedPeriod returns the closed period containing t, if there is one
+func (a *App) closedPeriod(t time.Time) (AccountingPeriod, bool) {
+	var period AccountingPeriod
+	found := a.cronosApp.DB.Where("month = ? and closed = ?", periodMonth(t), true).Limit(1).Find(&period).RowsAffected > 0
+	return period, found
+}
+
+// closedPeriodMessage explains why a record cannot be changed
+func closedPeriodMessage(period AccountingPeriod) string {
+	return fmt.Sprintf("The %s accounting period is closed", period.Month.Format("January 2006"))
+}
+
+// PeriodClosedError is returned when an action would add to or change a closed period
+type PeriodClosedError struct {
+	Period AccountingPeriod
+}
+
+func (e PeriodClosedError) Error() string {
+	return closedPeriodMessage(e.Period)
+}
+
+// validateEntryPeriod adds a field error if the entry is dated in a closed period
+func (a *App) validateEntryPeriod(entry *cronos.Entry, errs *ValidationErrors) {
+	if period, closed := a.closedPeriod(entry.Start); closed {
+		errs.Add("start", closedPeriodMessage(period))
+	}
+}
+
+// invoicePeriodClosed reports whether an invoice bills a closed period, returning the period if so
+func (a *App) invoicePeriodClosed(invoiceID *uint) (AccountingPeriod, bool) {
+	if invoiceID == nil {
+		return AccountingPeriod{}, false
+	}
+	var invoice cronos.Invoice
+	if a.cronosApp.DB.Where("id = ?", *invoiceID).Limit(1).Find(&invoice).RowsAffected == 0 {
+		return AccountingPeriod{}, false
+	}
+	return a.closedPeriod(invoice.PeriodEnd)
+}
+
+// writePeriodClosed responds with a 409 explaining that the period is closed
+func writePeriodClosed(w http.ResponseWriter, period AccountingPeriod) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": closedPeriodMessage(period)})
+}
+
+// PeriodsListHandler provides every period that has been closed or reopened along with its history
+func (a *App) PeriodsListHandler(w http.ResponseWriter, r *http.Request) {
+	var periods []AccountingPeriod
+	a.cronosApp.DB.Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC")
+	}).Order("month DESC").Find(&periods)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&periods)
+}
+
+// PeriodStateHandler lets an admin close or reopen the month given as YYYY-MM. Reopening requires a `reason`, and
+// both actions are recorded in the period history.
+func (a *App) PeriodStateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		http.Error(w, "Only admins can close or reopen periods", http.StatusForbidden)
+		return
+	}
+	month, err := time.Parse("2006-01", vars["month"])
+	if err != nil {
+		http.Error(w, "Expected a month in the format YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	if vars["action"] == PeriodActionReopen && r.FormValue("reason") == "" {
+		writeValidationErrors(w, ValidationErrors{{Field: "reason", Message: "A reason is required to reopen a period"}})
+		return
+	}
+
+	period := AccountingPeriod{Month: month}
+	a.cronosApp.DB.Where("month = ?", month).Limit(1).Find(&period)
+	if vars["action"] == PeriodActionClose && period.Closed {
+		http.Error(w, fmt.Sprintf("The %s period is already closed", month.Format("January 2006")), http.StatusConflict)
+		return
+	}
+	if vars["action"] == PeriodActionReopen && !period.Closed {
+		http.Error(w, fmt.Sprintf("The %s period is not closed", month.Format("January 2006")), http.StatusConflict)
+		return
+	}
+
+	var user cronos.User
+	a.cronosApp.DB.Where("id = ?", contextUserID(r)).First(&user)
+	userName, _ := a.userDisplayName(user)
+	now := time.Now()
+	if vars["action"] == PeriodActionClose {
+		period.Closed = true
+		period.ClosedAt = &now
+	} else {
+		period.Closed = false
+		period.ClosedAt = nil
+	}
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&period).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PeriodEvent{
+			AccountingPeriodID: period.ID,
+			Action:             vars["action"],
+			UserID:             user.ID,
+			UserName:           userName,
+			Reason:             r.FormValue("reason"),
+		}).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.cronosApp.DB.Where("accounting_period_id = ?", period.ID).Order("created_at ASC").Find(&period.Events)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&period)
+}
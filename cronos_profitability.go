@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+)
+
+// Profitability can be grouped by project, account or billing code
+const (
+	ProfitabilityByProject     = "project"
+	ProfitabilityByAccount     = "account"
+	ProfitabilityByBillingCode = "billing_code"
+)
+
+// adjustmentTypeCredit matches the credit adjustment type used by the admin UI, which reduces an invoice total
+const adjustmentTypeCredit = "ADJUSTMENT_TYPE_CREDIT"
+
+// commissionRates reads the AE and SDR commissions as percentages of revenue from AE_COMMISSION_PERCENT and
+// SDR_COMMISSION_PERCENT. They are only used to estimate commissions on time that has not been paid yet, as the
+// commissions on paid invoices are known from the bills they were added to.
+func commissionRates() (ae, sdr float64) {
+	ae, _ = strconv.ParseFloat(os.Getenv("AE_COMMISSION_PERCENT"), 64)
+	sdr, _ = strconv.ParseFloat(os.Getenv("SDR_COMMISSION_PERCENT"), 64)
+	return ae / 100, sdr / 100
+}
+
+// billedCommissions totals the commission adjustments on the bills, other than voided bills, for periods ending
+// between start and end. Commission adjustments are told apart from other adjustments by type, as on the bill detail.
+func (a *App) billedCommissions(start, end time.Time) float64 {
+	var adjustments []cronos.Adjustment
+	a.cronosApp.DB.Model(&cronos.Adjustment{}).Select("adjustments.type, adjustments.amount").
+		Joins("JOIN bills ON bills.id = adjustments.bill_id").
+		Where("adjustments.state != ? and bills.deleted_at is null and bills.period_end >= ? and bills.period_end < ? and bills.id not in (?)",
+			cronos.AdjustmentStateVoid.String(), start, end, a.voidBillIDs()).
+		Find(&adjustments)
+	var total float64
+	for _, adjustment := range adjustments {
+		if strings.Contains(strings.ToUpper(adjustment.Type), "COMMISSION") {
+			total += adjustment.Amount
+		}
+	}
+	return total
+}
+
+// paidInvoiceIDs returns which of the invoices the entries are on have been paid
+func (a *App) paidInvoiceIDs(entries []cronos.Entry) map[uint]bool {
+	var invoiceIDs []uint
+	for _, entry := range entries {
+		if entry.InvoiceID != nil {
+			invoiceIDs = append(invoiceIDs, *entry.InvoiceID)
+		}
+	}
+	paid := make(map[uint]bool)
+	if len(invoiceIDs) == 0 {
+		return paid
+	}
+	var paidIDs []uint
+	a.cronosApp.DB.Model(&cronos.Invoice{}).Where("id in ? and state = ?", invoiceIDs, cronos.InvoiceStatePaid.String()).Pluck("id", &paidIDs)
+	for _, id := range paidIDs {
+		paid[id] = true
+	}
+	return paid
+}
+
+// ProfitabilityEntry is an entry's contribution to revenue, cost and commissions
+type ProfitabilityEntry struct {
+	EntryID       uint      `json:"entry_id"`
+	ProjectID     uint      `json:"project_id"`
+	AccountID     uint      `json:"account_id"`
+	BillingCodeID uint      `json:"billing_code_id"`
+	BillingCode   string    `json:"billing_code"`
+	EmployeeID    uint      `json:"employee_id"`
+	Start         time.Time `json:"start"`
+	Internal      bool      `json:"internal"`
+	BilledHours   float64   `json:"billed_hours"`
+	RawHours      float64   `json:"raw_hours"`
+	Revenue       float64   `json:"revenue"`
+	Cost          float64   `json:"cost"`
+	Commissions   float64   `json:"commissions"`
+}
+
+// ProfitabilityLine is the profitability of a single project, account or billing code over a period
+type ProfitabilityLine struct {
+	GroupBy       string  `json:"group_by"`
+	ID            uint    `json:"id"`
+	Name          string  `json:"name"`
+	Hours         float64 `json:"hours"`
+	Revenue       float64 `json:"revenue"`
+	Adjustments   float64 `json:"adjustments"`
+	Cost          float64 `json:"cost"`
+	Commissions   float64 `json:"commissions"`
+	GrossMargin   float64 `json:"gross_margin"`
+	MarginPercent float64 `json:"margin_percent"`
+}
+
+// ProfitabilityDetail is a profitability line along with the entries that contributed to it
+type ProfitabilityDetail struct {
+	ProfitabilityLine
+	Entries []ProfitabilityEntry `json:"entries"`
+}
+
+// profitabilityEntries works out the revenue, cost and commissions of every non-void entry that started between
+// start and end. Revenue is the billed amount at the external rate after rounding, cost is the logged time at the
+// internal rate, and internal time carries cost but no revenue. The commissions billed for the period are shared
+// across the revenue of paid entries on projects with an AE or SDR, while unpaid entries carry an estimate.
+func (a *App) profitabilityEntries(start, end time.Time, projectsByID map[uint]cronos.Project) []ProfitabilityEntry {
+	var entries []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").
+		Where("start >= ? and start < ? and state != ?", start, end, cronos.EntryStateVoid.String()).
+		Order("start ASC").Find(&entries)
+	billingCodeIDs := make([]uint, len(entries))
+	for i, entry := range entries {
+		billingCodeIDs[i] = entry.BillingCodeID
+	}
+	modes := a.roundingModes(billingCodeIDs)
+	aeRate, sdrRate := commissionRates()
+	paidInvoices := a.paidInvoiceIDs(entries)
+	var paidCommissionable []int
+	var paidRevenue float64
+
+	contributions := make([]ProfitabilityEntry, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		project := projectsByID[entry.ProjectID]
+		amounts := billedAmounts(entry.Start, entry.End, entry.BillingCode, modes[entry.BillingCodeID])
+		contribution := ProfitabilityEntry{
+			EntryID:       entry.ID,
+			ProjectID:     entry.ProjectID,
+			AccountID:     project.AccountID,
+			BillingCodeID: entry.BillingCodeID,
+			BillingCode:   entry.BillingCode.Code,
+			EmployeeID:    entryWorkerID(entry),
+			Start:         entry.Start,
+			Internal:      entry.Internal || project.Internal,
+			BilledHours:   amounts.BilledHours,
+			RawHours:      amounts.RawHours,
+			Cost:          amounts.RawHours * entry.BillingCode.InternalRate.Amount,
+		}
+		if !contribution.Internal {
+			contribution.Revenue = amounts.BilledAmount
+			switch {
+			case project.AEID == nil && project.SDRID == nil:
+			case entry.InvoiceID != nil && paidInvoices[*entry.InvoiceID]:
+				paidCommissionable = append(paidCommissionable, i)
+				paidRevenue += contribution.Revenue
+			default:
+				if project.AEID != nil {
+					contribution.Commissions += contribution.Revenue * aeRate
+				}
+				if project.SDRID != nil {
+					contribution.Commissions += contribution.Revenue * sdrRate
+				}
+			}
+		}
+		contributions[i] = contribution
+	}
+	if paidRevenue > 0 {
+		commissions := a.billedCommissions(start, end)
+		for _, i := range paidCommissionable {
+			contributions[i].Commissions = commissions * contributions[i].Revenue / paidRevenue
+		}
+	}
+	return contributions
+}
+
+// projectAdjustments totals the fees less credits of the non-void adjustments on each project's invoices for
+// periods ending between start and end
+func (a *App) projectAdjustments(start, end time.Time) map[uint]float64 {
+	var rows []struct {
+		ProjectID uint
+		Type      string
+		Amount    float64
+	}
+	a.cronosApp.DB.Model(&cronos.Adjustment{}).
+		Select("invoices.project_id, adjustments.type, adjustments.amount").
+		Joins("JOIN invoices ON invoices.id = adjustments.invoice_id").
+		Where("adjustments.state != ? and invoices.state != ? and invoices.type = ? and invoices.period_end >= ? and invoices.period_end < ?",
+			cronos.AdjustmentStateVoid.String(), cronos.InvoiceStateVoid, cronos.InvoiceTypeAR, start, end).
+		Scan(&rows)
+	totals := make(map[uint]float64)
+	for _, row := range rows {
+		if row.Type == adjustmentTypeCredit {
+			totals[row.ProjectID] -= row.Amount
+		} else {
+			totals[row.ProjectID] += row.Amount
+		}
+	}
+	return totals
+}
+
+// profitabilityKey returns the id of the group an entry belongs to
+func profitabilityKey(groupBy string, entry ProfitabilityEntry) uint {
+	switch groupBy {
+	case ProfitabilityByAccount:
+		return entry.AccountID
+	case ProfitabilityByBillingCode:
+		return entry.BillingCodeID
+	default:
+		return entry.ProjectID
+	}
+}
+
+// ProfitabilityReport computes the profitability of every project, account or billing code with time or
+// adjustments between start and end. Adjustments are made to invoices rather than billing codes, so they are only
+// included when grouping by project or account.
+func (a *App) ProfitabilityReport(groupBy string, start, end time.Time) []ProfitabilityDetail {
+	var projects []cronos.Project
+	a.cronosApp.DB.Find(&projects)
+	projectsByID := make(map[uint]cronos.Project, len(projects))
+	for _, project := range projects {
+		projectsByID[project.ID] = project
+	}
+
+	details := make(map[uint]*ProfitabilityDetail)
+	detailFor := func(id uint) *ProfitabilityDetail {
+		if details[id] == nil {
+			details[id] = &ProfitabilityDetail{ProfitabilityLine: ProfitabilityLine{GroupBy: groupBy, ID: id}, Entries: []ProfitabilityEntry{}}
+		}
+		return details[id]
+	}
+	for _, entry := range a.profitabilityEntries(start, end, projectsByID) {
+		detail := detailFor(profitabilityKey(groupBy, entry))
+		detail.Hours += entry.BilledHours
+		detail.Revenue += entry.Revenue
+		detail.Cost += entry.Cost
+		detail.Commissions += entry.Commissions
+		detail.Entries = append(detail.Entries, entry)
+	}
+	if groupBy != ProfitabilityByBillingCode {
+		for projectID, amount := range a.projectAdjustments(start, end) {
+			id := projectID
+			if groupBy == ProfitabilityByAccount {
+				id = projectsByID[projectID].AccountID
+			}
+			detailFor(id).Adjustments += amount
+		}
+	}
+
+	report := make([]ProfitabilityDetail, 0, len(details))
+	for id, detail := range details {
+		switch groupBy {
+		case ProfitabilityByAccount:
+			var account cronos.Account
+			a.cronosApp.DB.Where("id = ?", id).Limit(1).Find(&account)
+			detail.Name = account.Name
+		case ProfitabilityByBillingCode:
+			var billingCode cronos.BillingCode
+			a.cronosApp.DB.Where("id = ?", id).Limit(1).Find(&billingCode)
+			detail.Name = billingCode.Code
+		default:
+			detail.Name = projectsByID[id].Name
+		}
+		netRevenue := detail.Revenue + detail.Adjustments
+		detail.GrossMargin = netRevenue - detail.Cost - detail.Commissions
+		if netRevenue != 0 {
+			detail.MarginPercent = detail.GrossMargin / netRevenue * 100
+		}
+		report = append(report, *detail)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Revenue+report[i].Adjustments > report[j].Revenue+report[j].Adjustments
+	})
+	return report
+}
+
+// ProfitabilityReportHandler provides the profitability report for admins over the `start` and `end` dates, grouped
+// by `group_by` (project, account or billing_code), as JSON or as CSV when `format=csv`
+func (a *App) ProfitabilityReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	start, end, errs := reportRange(r)
+	groupBy := r.URL.Query().Get("group_by")
+	switch groupBy {
+	case "":
+		groupBy = ProfitabilityByProject
+	case ProfitabilityByProject, ProfitabilityByAccount, ProfitabilityByBillingCode:
+	default:
+		errs.Add("group_by", "Expected one of project, account or billing_code")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	report := a.ProfitabilityReport(groupBy, start, end)
+	lines := make([]ProfitabilityLine, len(report))
+	for i := range report {
+		lines[i] = report[i].ProfitabilityLine
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{groupBy + "_id", groupBy, "hours", "revenue", "adjustments", "cost", "commissions", "gross_margin", "margin_percent"}}
+		for _, line := range lines {
+			rows = append(rows, []string{strconv.Itoa(int(line.ID)), line.Name, formatDecimal(line.Hours), formatDecimal(line.Revenue),
+				formatDecimal(line.Adjustments), formatDecimal(line.Cost), formatDecimal(line.Commissions),
+				formatDecimal(line.GrossMargin), formatDecimal(line.MarginPercent)})
+		}
+		writeCSV(w, "profitability_by_"+groupBy, start, end, rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&lines)
+}
+
+// ProfitabilityDetailHandler drills down into the profitability of one project, account or billing code, listing
+// the entries that contributed to it over the `start` and `end` dates
+func (a *App) ProfitabilityDetailHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	start, end, errs := reportRange(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	id, _ := strconv.ParseUint(vars["id"], 10, 64)
+	for _, detail := range a.ProfitabilityReport(vars["group"], start, end) {
+		if detail.ID != uint(id) {
+			continue
+		}
+		if wantsCSV(r) {
+			rows := [][]string{{"entry_id", "project_id", "billing_code", "employee_id", "start", "internal", "raw_hours", "billed_hours", "revenue", "cost", "commissions"}}
+			for _, entry := range detail.Entries {
+				rows = append(rows, []string{strconv.Itoa(int(entry.EntryID)), strconv.Itoa(int(entry.ProjectID)), entry.BillingCode,
+					strconv.Itoa(int(entry.EmployeeID)), entry.Start.Format(time.RFC3339), strconv.FormatBool(entry.Internal),
+					formatDecimal(entry.RawHours), formatDecimal(entry.BilledHours), formatDecimal(entry.Revenue),
+					formatDecimal(entry.Cost), formatDecimal(entry.Commissions)})
+			}
+			writeCSV(w, "profitability_"+vars["group"]+"_"+vars["id"], start, end, rows)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&detail)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// ProjectTemplate is the standard setup of a kind of engagement: its project type, budget defaults and the billing
+// codes it is billed under. Instantiating a template creates a project and all of its billing codes at once.
+type ProjectTemplate struct {
+	gorm.Model
+	Name           string                       `json:"name"`
+	ProjectType    string                       `json:"project_type"`
+	Internal       bool                         `json:"internal"`
+	BudgetHours    int                          `json:"budget_hours"`
+	BudgetDollars  int                          `json:"budget_dollars"`
+	DurationMonths int                          `json:"duration_months"`
+	BillingCodes   []ProjectTemplateBillingCode `json:"billing_codes"`
+}
+
+// ProjectTemplateBillingCode is a billing code created for every project instantiated from a template. The code is
+// prefixed with the project's code prefix so that it is unique to the project.
+type ProjectTemplateBillingCode struct {
+	gorm.Model
+	ProjectTemplateID uint   `json:"project_template_id" gorm:"index"`
+	Name              string `json:"name"`
+	Code              string `json:"code"`
+	Category          string `json:"category"`
+	RateType          string `json:"type"`
+	RoundedTo         int    `json:"rounded_to"`
+	RoundingMode      string `json:"rounding_mode"`
+	RateID            uint   `json:"rate_id"`
+	InternalRateID    uint   `json:"internal_rate_id"`
+}
+
+// errBillingCodeExists is returned when instantiating a template would duplicate an existing billing code
+var errBillingCodeExists = errors.New("billing code already exists")
+
+// ProjectTemplatesListHandler provides every project template along with its billing codes
+func (a *App) ProjectTemplatesListHandler(w http.ResponseWriter, r *http.Request) {
+	var templates []ProjectTemplate
+	a.cronosApp.DB.Preload("BillingCodes").Order("name ASC").Find(&templates)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&templates)
+}
+
+// ProjectTemplateHandler Provides CRUD interface for the project template object
+func (a *App) ProjectTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var template ProjectTemplate
+	if r.Method != "GET" && !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.Preload("BillingCodes").First(&template, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&template)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.Preload("BillingCodes").First(&template, vars["id"])
+		if r.FormValue("name") != "" {
+			template.Name = r.FormValue("name")
+		}
+		if r.FormValue("project_type") != "" {
+			template.ProjectType = r.FormValue("project_type")
+		}
+		if r.FormValue("internal") != "" {
+			template.Internal, _ = strconv.ParseBool(r.FormValue("internal"))
+		}
+		if r.FormValue("budget_hours") != "" {
+			template.BudgetHours, _ = strconv.Atoi(r.FormValue("budget_hours"))
+		}
+		if r.FormValue("budget_dollars") != "" {
+			template.BudgetDollars, _ = strconv.Atoi(r.FormValue("budget_dollars"))
+		}
+		if r.FormValue("duration_months") != "" {
+			template.DurationMonths, _ = strconv.Atoi(r.FormValue("duration_months"))
+		}
+		a.cronosApp.DB.Omit("BillingCodes").Save(&template)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&template)
+		return
+	case r.Method == "POST":
+		template.Name = r.FormValue("name")
+		template.ProjectType = r.FormValue("project_type")
+		template.Internal, _ = strconv.ParseBool(r.FormValue("internal"))
+		template.BudgetHours, _ = strconv.Atoi(r.FormValue("budget_hours"))
+		template.BudgetDollars, _ = strconv.Atoi(r.FormValue("budget_dollars"))
+		template.DurationMonths, _ = strconv.Atoi(r.FormValue("duration_months"))
+		if template.Name == "" {
+			writeValidationErrors(w, ValidationErrors{{Field: "name", Message: "A name is required"}})
+			return
+		}
+		a.cronosApp.DB.Create(&template)
+		template.BillingCodes = []ProjectTemplateBillingCode{}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&template)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("project_template_id = ?", vars["id"]).Delete(&ProjectTemplateBillingCode{})
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&ProjectTemplate{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// validateTemplateBillingCode checks a template billing code's code, rates and rounding mode
+func (a *App) validateTemplateBillingCode(billingCode ProjectTemplateBillingCode) ValidationErrors {
+	var errs ValidationErrors
+	if billingCode.Code == "" {
+		errs.Add("code", "A code is required")
+	}
+	if billingCode.RoundingMode != "" && !validRoundingMode(billingCode.RoundingMode) {
+		errs = append(errs, roundingModeError(billingCode.RoundingMode)...)
+	}
+	if a.cronosApp.DB.Where("id = ?", billingCode.RateID).Limit(1).Find(&cronos.Rate{}).RowsAffected == 0 {
+		errs.Add("rate_id", "Rate does not exist")
+	}
+	if a.cronosApp.DB.Where("id = ?", billingCode.InternalRateID).Limit(1).Find(&cronos.Rate{}).RowsAffected == 0 {
+		errs.Add("internal_rate_id", "Rate does not exist")
+	}
+	return errs
+}
+
+// ProjectTemplateBillingCodeHandler Provides CRUD interface for the billing codes of a project template
+func (a *App) ProjectTemplateBillingCodeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var billingCode ProjectTemplateBillingCode
+	if r.Method != "GET" && !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	setFields := func(partial bool) {
+		if !partial || r.FormValue("name") != "" {
+			billingCode.Name = r.FormValue("name")
+		}
+		if !partial || r.FormValue("code") != "" {
+			billingCode.Code = r.FormValue("code")
+		}
+		if !partial || r.FormValue("category") != "" {
+			billingCode.Category = r.FormValue("category")
+		}
+		if !partial || r.FormValue("type") != "" {
+			billingCode.RateType = r.FormValue("type")
+		}
+		if !partial || r.FormValue("rounded_to") != "" {
+			billingCode.RoundedTo, _ = strconv.Atoi(r.FormValue("rounded_to"))
+		}
+		if !partial || r.FormValue("rounding_mode") != "" {
+			billingCode.RoundingMode = r.FormValue("rounding_mode")
+		}
+		if !partial || r.FormValue("rate_id") != "" {
+			rateID, _ := strconv.ParseUint(r.FormValue("rate_id"), 10, 64)
+			billingCode.RateID = uint(rateID)
+		}
+		if !partial || r.FormValue("internal_rate_id") != "" {
+			internalRateID, _ := strconv.ParseUint(r.FormValue("internal_rate_id"), 10, 64)
+			billingCode.InternalRateID = uint(internalRateID)
+		}
+	}
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.First(&billingCode, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&billingCode)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.First(&billingCode, vars["id"])
+		setFields(true)
+		if errs := a.validateTemplateBillingCode(billingCode); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Save(&billingCode)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&billingCode)
+		return
+	case r.Method == "POST":
+		templateID, _ := strconv.ParseUint(r.FormValue("project_template_id"), 10, 64)
+		billingCode.ProjectTemplateID = uint(templateID)
+		setFields(false)
+		errs := a.validateTemplateBillingCode(billingCode)
+		if a.cronosApp.DB.Where("id = ?", billingCode.ProjectTemplateID).Limit(1).Find(&ProjectTemplate{}).RowsAffected == 0 {
+			errs.Add("project_template_id", "Project template does not exist")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Create(&billingCode)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&billingCode)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&ProjectTemplateBillingCode{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// templateBillingCode returns the code a template billing code is given on a project with the code prefix
+func templateBillingCode(prefix, code string) string {
+	if prefix == "" {
+		return code
+	}
+	return strings.ToUpper(prefix) + "_" + code
+}
+
+// InstantiateProjectTemplateHandler creates a project for an account from a template in a single transaction,
+// along with its billing codes at the template's rates and rounding modes. The request takes an `account_id`,
+// `name`, `active_start` and a `code_prefix` for the billing codes, and may override `active_end`, the budgets,
+// `ae_id`, `sdr_id` and `lead_id`. Templates without a duration require `active_end`, as billing codes without an
+// end date are never listed as active. Nothing is created if any billing code would duplicate an existing code.
+func (a *App) InstantiateProjectTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var template ProjectTemplate
+	if a.cronosApp.DB.Preload("BillingCodes").Where("id = ?", vars["id"]).Limit(1).Find(&template).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var errs ValidationErrors
+	var account cronos.Account
+	if a.cronosApp.DB.Where("id = ?", r.FormValue("account_id")).Limit(1).Find(&account).RowsAffected == 0 {
+		errs.Add("account_id", "Account does not exist")
+	}
+	if r.FormValue("name") == "" {
+		errs.Add("name", "A name is required")
+	}
+	activeStart, err := time.Parse("2006-01-02", r.FormValue("active_start"))
+	if err != nil {
+		errs.Add("active_start", "Expected a date in the format YYYY-MM-DD")
+	}
+	activeEnd := activeStart.AddDate(0, template.DurationMonths, -1)
+	if r.FormValue("active_end") != "" {
+		if activeEnd, err = time.Parse("2006-01-02", r.FormValue("active_end")); err != nil {
+			errs.Add("active_end", "Expected a date in the format YYYY-MM-DD")
+		}
+	} else if template.DurationMonths == 0 {
+		errs.Add("active_end", "An end date is required as the template has no duration")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	project := cronos.Project{
+		Name:          r.FormValue("name"),
+		AccountID:     account.ID,
+		ActiveStart:   activeStart,
+		ActiveEnd:     activeEnd,
+		BudgetHours:   template.BudgetHours,
+		BudgetDollars: template.BudgetDollars,
+		Internal:      template.Internal,
+		ProjectType:   template.ProjectType,
+	}
+	if r.FormValue("budget_hours") != "" {
+		project.BudgetHours, _ = strconv.Atoi(r.FormValue("budget_hours"))
+	}
+	if r.FormValue("budget_dollars") != "" {
+		project.BudgetDollars, _ = strconv.Atoi(r.FormValue("budget_dollars"))
+	}
+	if r.FormValue("ae_id") != "" && r.FormValue("ae_id") != "null" {
+		aeID, _ := strconv.ParseUint(r.FormValue("ae_id"), 10, 64)
+		uintAEID := uint(aeID)
+		project.AEID = &uintAEID
+	}
+	if r.FormValue("sdr_id") != "" && r.FormValue("sdr_id") != "null" {
+		sdrID, _ := strconv.ParseUint(r.FormValue("sdr_id"), 10, 64)
+		uintSDRID := uint(sdrID)
+		project.SDRID = &uintSDRID
+	}
+
+	var duplicate string
+	err = a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&project).Error; err != nil {
+			return err
+		}
+		for _, templateCode := range template.BillingCodes {
+			code := templateBillingCode(r.FormValue("code_prefix"), templateCode.Code)
+			if tx.Where("code = ?", code).Limit(1).Find(&cronos.BillingCode{}).RowsAffected > 0 {
+				duplicate = code
+				return errBillingCodeExists
+			}
+			billingCode := cronos.BillingCode{
+				Name:           templateCode.Name,
+				RateType:       templateCode.RateType,
+				Category:       templateCode.Category,
+				Code:           code,
+				RoundedTo:      templateCode.RoundedTo,
+				ProjectID:      project.ID,
+				ActiveStart:    project.ActiveStart,
+				ActiveEnd:      project.ActiveEnd,
+				RateID:         templateCode.RateID,
+				InternalRateID: templateCode.InternalRateID,
+			}
+			if err := tx.Create(&billingCode).Error; err != nil {
+				return err
+			}
+			if templateCode.RoundingMode != "" {
+				err := tx.Create(&BillingCodeRounding{BillingCodeID: billingCode.ID, Mode: templateCode.RoundingMode}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if leadID, _ := strconv.ParseUint(r.FormValue("lead_id"), 10, 64); leadID != 0 {
+			return tx.Create(&ProjectLead{ProjectID: project.ID, EmployeeID: uint(leadID)}).Error
+		}
+		return nil
+	})
+	if errors.Is(err, errBillingCodeExists) {
+		writeValidationErrors(w, ValidationErrors{{Field: "code_prefix", Message: fmt.Sprintf("Billing code %s already exists", duplicate)}})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.cronosApp.DB.Preload("BillingCodes").First(&project, project.ID)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(&project)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// reportRange reads the `start` and `end` dates of a report, both YYYY-MM-DD and inclusive. The range defaults to
+// the previous calendar month when neither is given. The returned end is midnight after the last day.
+func reportRange(r *http.Request) (time.Time, time.Time, ValidationErrors) {
+	var errs ValidationErrors
+	startValue, endValue := r.URL.Query().Get("start"), r.URL.Query().Get("end")
+	if startValue == "" && endValue == "" {
+		thisMonth := periodMonth(time.Now())
+		return thisMonth.AddDate(0, -1, 0), thisMonth, nil
+	}
+	start, err := time.Parse("2006-01-02", startValue)
+	if err != nil {
+		errs.Add("start", "Expected a date in the format YYYY-MM-DD")
+	}
+	end, err := time.Parse("2006-01-02", endValue)
+	if err != nil {
+		errs.Add("end", "Expected a date in the format YYYY-MM-DD")
+	}
+	if len(errs) == 0 && end.Before(start) {
+		errs.Add("end", "End date must not be before the start date")
+	}
+	return start, end.AddDate(0, 0, 1), errs
+}
+
+// wantsCSV reports whether a report was requested with `format=csv`
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv"
+}
+
+// writeCSV responds with the rows as a CSV attachment named after the report and its date range
+func writeCSV(w http.ResponseWriter, name string, start, end time.Time, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("%s_%s_%s.csv", name, start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"))))
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	_ = writer.WriteAll(rows)
+}
+
+// formatDecimal formats hours and amounts to two decimal places for a CSV cell
+func formatDecimal(value float64) string {
+	return fmt.Sprintf("%.2f", value)
+}
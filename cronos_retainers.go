@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Retainer billing frequencies
+const (
+	RetainerFrequencyMonthly   = "monthly"
+	RetainerFrequencyQuarterly = "quarterly"
+	RetainerFrequencyAnnually  = "annually"
+)
+
+// adjustmentTypeFee matches the fee adjustment type used by the admin UI when adding adjustments to an invoice
+const adjustmentTypeFee = "ADJUSTMENT_TYPE_FEE"
+
+// retainerMu prevents the scheduler and a manual run from generating the same period twice
+var retainerMu sync.Mutex
+
+// RetainerSchedule bills a project a fixed amount every period. The retainer is billed against a billing code so
+// that hours logged on the retainer can be reconciled against the hours it includes. That billing code should carry
+// a zero external rate so that the same hours are not also billed hourly.
+type RetainerSchedule struct {
+	gorm.Model
+	ProjectID      uint      `json:"project_id" gorm:"index"`
+	BillingCodeID  uint      `json:"billing_code_id"`
+	Amount         float64   `json:"amount"`
+	Frequency      string    `json:"frequency"`
+	StartDate      time.Time `json:"start_date"`
+	EndDate        time.Time `json:"end_date"`
+	ReconcileHours bool      `json:"reconcile_hours"`
+	IncludedHours  float64   `json:"included_hours"`
+	OverageRate    float64   `json:"overage_rate"`
+	Active         bool      `json:"active"`
+}
+
+// RetainerInvoice links a generated draft invoice to the retainer period it bills. The unique index on the schedule
+// and period start stops several instances of the scheduler from invoicing the same period twice. Periods that fall
+// in a closed accounting period are marked skipped so that they are not retried: without an invoice if the period
+// closed before it was invoiced, or without an overage if it closed before it was reconciled.
+type RetainerInvoice struct {
+	gorm.Model
+	RetainerScheduleID uint      `json:"retainer_schedule_id" gorm:"uniqueIndex:idx_retainer_invoices_schedule_period"`
+	InvoiceID          uint      `json:"invoice_id"`
+	PeriodStart        time.Time `json:"period_start" gorm:"uniqueIndex:idx_retainer_invoices_schedule_period"`
+	PeriodEnd          time.Time `json:"period_end"`
+	Reconciled         bool      `json:"reconciled"`
+	LoggedHours        float64   `json:"logged_hours"`
+	OverageHours       float64   `json:"overage_hours"`
+	Skipped            bool      `json:"skipped"`
+}
+
+// retainerPeriod is a half open [Start, End) billing period
+type retainerPeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+// frequencyMonths converts a retainer frequency into the number of months in each period
+func frequencyMonths(frequency string) (int, error) {
+	switch frequency {
+	case RetainerFrequencyMonthly:
+		return 1, nil
+	case RetainerFrequencyQuarterly:
+		return 3, nil
+	case RetainerFrequencyAnnually:
+		return 12, nil
+	}
+	return 0, fmt.Errorf("unknown retainer frequency %q", frequency)
+}
+
+// addMonthsClamped adds months to a date, clamping the day to the end of the resulting month so that a schedule
+// starting on the 31st bills on the last day of shorter months rather than spilling into the next one
+func addMonthsClamped(date time.Time, months int) time.Time {
+	year, month, day := date.Date()
+	lastDay := time.Date(year, month+time.Month(months)+1, 0, 0, 0, 0, 0, date.Location()).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month+time.Month(months), day, date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), date.Location())
+}
+
+// retainerPeriods lists every period of the schedule that has started on or before now. Periods are anchored on
+// the schedule start date and stop at the end date when one is set.
+func retainerPeriods(schedule RetainerSchedule, now time.Time) ([]retainerPeriod, error) {
+	months, err := frequencyMonths(schedule.Frequency)
+	if err != nil {
+		return nil, err
+	}
+	var periods []retainerPeriod
+	for i := 0; ; i++ {
+		start := addMonthsClamped(schedule.StartDate, months*i)
+		if start.After(now) || (!schedule.EndDate.IsZero() && !start.Before(schedule.EndDate)) {
+			break
+		}
+		periods = append(periods, retainerPeriod{Start: start, End: addMonthsClamped(schedule.StartDate, months*(i+1))})
+	}
+	return periods, nil
+}
+
+// GenerateRetainerInvoices creates a draft AR invoice for every retainer period that has started and has not yet
+// been invoiced, and reconciles logged hours against the included hours once a period has ended
+func (a *App) GenerateRetainerInvoices(now time.Time) error {
+	retainerMu.Lock()
+	defer retainerMu.Unlock()
+
+	var schedules []RetainerSchedule
+	a.cronosApp.DB.Where("active = ?", true).Find(&schedules)
+	var errs []error
+	for _, schedule := range schedules {
+		periods, err := retainerPeriods(schedule, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("retainer %d: %w", schedule.ID, err))
+			continue
+		}
+		for _, period := range periods {
+			var retainerInvoice RetainerInvoice
+			if a.cronosApp.DB.Where("retainer_schedule_id = ? and period_start = ?", schedule.ID, period.Start).
+				Limit(1).Find(&retainerInvoice).RowsAffected == 0 {
+				retainerInvoice, err = a.createRetainerInvoice(schedule, period)
+				if err != nil {
+					// Another instance invoicing the same period loses on the unique index and leaves it to the winner
+					if a.cronosApp.DB.Where("retainer_schedule_id = ? and period_start = ?", schedule.ID, period.Start).
+						Limit(1).Find(&RetainerInvoice{}).RowsAffected == 0 {
+						errs = append(errs, fmt.Errorf("retainer %d: %w", schedule.ID, err))
+					}
+					continue
+				}
+			}
+			if schedule.ReconcileHours && !retainerInvoice.Reconciled && !retainerInvoice.Skipped && !period.End.After(now) {
+				if err := a.reconcileRetainerInvoice(schedule, &retainerInvoice); err != nil {
+					errs = append(errs, fmt.Errorf("retainer %d: %w", schedule.ID, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// createRetainerInvoice creates the draft invoice for one retainer period with the retainer fee as an adjustment.
+// A period ending in a closed accounting period is recorded as skipped instead.
+func (a *App) createRetainerInvoice(schedule RetainerSchedule, period retainerPeriod) (RetainerInvoice, error) {
+	if accountingPeriod, closed := a.closedPeriod(period.End.AddDate(0, 0, -1)); closed {
+		log.Printf("Skipping retainer %d period %s: %s", schedule.ID, period.Start.Format("2006-01-02"), closedPeriodMessage(accountingPeriod))
+		retainerInvoice := RetainerInvoice{
+			RetainerScheduleID: schedule.ID,
+			PeriodStart:        period.Start,
+			PeriodEnd:          period.End,
+			Skipped:            true,
+		}
+		return retainerInvoice, a.cronosApp.DB.Create(&retainerInvoice).Error
+	}
+	var project cronos.Project
+	if err := a.cronosApp.DB.First(&project, schedule.ProjectID).Error; err != nil {
+		return RetainerInvoice{}, err
+	}
+
+	var invoice cronos.Invoice
+	var retainerInvoice RetainerInvoice
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		invoice = cronos.Invoice{
+			Name:        fmt.Sprintf("%s Retainer %s", project.Name, period.Start.Format("January 2006")),
+			PeriodStart: period.Start,
+			PeriodEnd:   period.End.AddDate(0, 0, -1),
+			Type:        cronos.InvoiceTypeAR.String(),
+			State:       cronos.InvoiceStateDraft.String(),
+		}
+		if err := tx.Create(&invoice).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&invoice).Updates(map[string]interface{}{
+			"project_id": project.ID,
+			"account_id": project.AccountID,
+		}).Error
+		if err != nil {
+			return err
+		}
+		adjustment := cronos.Adjustment{
+			InvoiceID: &invoice.ID,
+			Type:      adjustmentTypeFee,
+			Amount:    schedule.Amount,
+			Notes:     fmt.Sprintf("%s retainer, %s", schedule.Frequency, period.Start.Format("January 2, 2006")),
+			State:     cronos.AdjustmentStateDraft.String(),
+		}
+		if err := tx.Create(&adjustment).Error; err != nil {
+			return err
+		}
+		retainerInvoice = RetainerInvoice{
+			RetainerScheduleID: schedule.ID,
+			InvoiceID:          invoice.ID,
+			PeriodStart:        period.Start,
+			PeriodEnd:          period.End,
+		}
+		return tx.Create(&retainerInvoice).Error
+	})
+	if err != nil {
+		return retainerInvoice, err
+	}
+	a.cronosApp.UpdateInvoiceTotals(&invoice)
+	log.Printf("Created retainer invoice %d for project %d period %s", invoice.ID, project.ID, period.Start.Format("2006-01-02"))
+	return retainerInvoice, nil
+}
+
+// reconcileRetainerInvoice compares the hours logged on the retainer billing code during the period against the
+// included hours and adds an overage fee to the invoice if it is still a draft
+func (a *App) reconcileRetainerInvoice(schedule RetainerSchedule, retainerInvoice *RetainerInvoice) error {
+	var invoice cronos.Invoice
+	if err := a.cronosApp.DB.First(&invoice, retainerInvoice.InvoiceID).Error; err != nil {
+		return err
+	}
+	if period, closed := a.closedPeriod(invoice.PeriodEnd); closed {
+		// The period can no longer change, so skip its overage rather than failing on every run
+		log.Printf("Skipping reconciliation of retainer invoice %d: %s", invoice.ID, closedPeriodMessage(period))
+		retainerInvoice.Reconciled = true
+		retainerInvoice.Skipped = true
+		return a.cronosApp.DB.Save(retainerInvoice).Error
+	}
+	if invoice.State != cronos.InvoiceStateDraft.String() {
+		// Once staff have approved the invoice we leave it alone and stop trying to reconcile it
+		retainerInvoice.Reconciled = true
+		return a.cronosApp.DB.Save(retainerInvoice).Error
+	}
+
+	var entries []cronos.Entry
+	a.cronosApp.DB.Where("billing_code_id = ? and start >= ? and start < ? and state != ?",
+		schedule.BillingCodeID, retainerInvoice.PeriodStart, retainerInvoice.PeriodEnd, cronos.EntryStateVoid.String()).
+		Find(&entries)
+	var loggedHours float64
+	for _, entry := range entries {
+		loggedHours += entry.Duration().Hours()
+	}
+
+	retainerInvoice.LoggedHours = loggedHours
+	retainerInvoice.Reconciled = true
+	if loggedHours > schedule.IncludedHours {
+		retainerInvoice.OverageHours = loggedHours - schedule.IncludedHours
+	}
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if retainerInvoice.OverageHours > 0 && schedule.OverageRate > 0 {
+			adjustment := cronos.Adjustment{
+				InvoiceID: &invoice.ID,
+				Type:      adjustmentTypeFee,
+				Amount:    retainerInvoice.OverageHours * schedule.OverageRate,
+				Notes: fmt.Sprintf("Retainer overage: %.2f hours logged, %.2f included, %.2f hours at $%.2f",
+					loggedHours, schedule.IncludedHours, retainerInvoice.OverageHours, schedule.OverageRate),
+				State: cronos.AdjustmentStateDraft.String(),
+			}
+			if err := tx.Create(&adjustment).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(retainerInvoice).Error
+	})
+	if err != nil {
+		return err
+	}
+	a.cronosApp.UpdateInvoiceTotals(&invoice)
+	a.SnapshotInvoice(invoice.ID, InvoiceVersionTriggerAdjustmentChange, 0)
+	return nil
+}
+
+// RunRetainerScheduler generates retainer invoices on a fixed interval until the process exits
+func (a *App) RunRetainerScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.GenerateRetainerInvoices(time.Now()); err != nil {
+			log.Printf("Error generating retainer invoices: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// RetainerRunHandler generates any outstanding retainer invoices immediately
+func (a *App) RetainerRunHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.GenerateRetainerInvoices(time.Now()); err != nil {
+		log.Printf("Error generating retainer invoices: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+}
+
+// ProjectRetainersListHandler provides the retainer schedules for a project
+func (a *App) ProjectRetainersListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var schedules []RetainerSchedule
+	a.cronosApp.DB.Where("project_id = ?", vars["id"]).Order("start_date ASC").Find(&schedules)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&schedules)
+}
+
+// RetainerHandler Provides CRUD interface for the retainer schedule object
+func (a *App) RetainerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var schedule RetainerSchedule
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.First(&schedule, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&schedule)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.First(&schedule, vars["id"])
+		if r.FormValue("amount") != "" {
+			schedule.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		}
+		if r.FormValue("frequency") != "" {
+			schedule.Frequency = r.FormValue("frequency")
+		}
+		if r.FormValue("billing_code_id") != "" {
+			billingCodeID, _ := strconv.ParseUint(r.FormValue("billing_code_id"), 10, 64)
+			schedule.BillingCodeID = uint(billingCodeID)
+		}
+		if r.FormValue("start_date") != "" {
+			start, err := time.Parse("2006-01-02", r.FormValue("start_date"))
+			if err != nil {
+				fmt.Println(err)
+			}
+			schedule.StartDate = start
+		}
+		if r.FormValue("end_date") != "" {
+			end, err := time.Parse("2006-01-02", r.FormValue("end_date"))
+			if err != nil {
+				fmt.Println(err)
+			}
+			schedule.EndDate = end
+		}
+		if r.FormValue("reconcile_hours") != "" {
+			schedule.ReconcileHours, _ = strconv.ParseBool(r.FormValue("reconcile_hours"))
+		}
+		if r.FormValue("included_hours") != "" {
+			schedule.IncludedHours, _ = strconv.ParseFloat(r.FormValue("included_hours"), 64)
+		}
+		if r.FormValue("overage_rate") != "" {
+			schedule.OverageRate, _ = strconv.ParseFloat(r.FormValue("overage_rate"), 64)
+		}
+		if r.FormValue("active") != "" {
+			schedule.Active, _ = strconv.ParseBool(r.FormValue("active"))
+		}
+		if _, err := frequencyMonths(schedule.Frequency); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.cronosApp.DB.Save(&schedule)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&schedule)
+		return
+	case r.Method == "POST":
+		projectID, _ := strconv.ParseUint(r.FormValue("project_id"), 10, 64)
+		billingCodeID, _ := strconv.ParseUint(r.FormValue("billing_code_id"), 10, 64)
+		schedule.ProjectID = uint(projectID)
+		schedule.BillingCodeID = uint(billingCodeID)
+		schedule.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		schedule.Frequency = r.FormValue("frequency")
+		schedule.StartDate, _ = time.Parse("2006-01-02", r.FormValue("start_date"))
+		schedule.EndDate, _ = time.Parse("2006-01-02", r.FormValue("end_date"))
+		schedule.ReconcileHours, _ = strconv.ParseBool(r.FormValue("reconcile_hours"))
+		schedule.IncludedHours, _ = strconv.ParseFloat(r.FormValue("included_hours"), 64)
+		schedule.OverageRate, _ = strconv.ParseFloat(r.FormValue("overage_rate"), 64)
+		schedule.Active = true
+		if _, err := frequencyMonths(schedule.Frequency); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if schedule.StartDate.IsZero() {
+			http.Error(w, "start_date is required", http.StatusBadRequest)
+			return
+		}
+		var billingCode cronos.BillingCode
+		if a.cronosApp.DB.Where("id = ? and project_id = ?", schedule.BillingCodeID, schedule.ProjectID).First(&billingCode).RowsAffected == 0 {
+			http.Error(w, "Billing code does not belong to this project", http.StatusBadRequest)
+			return
+		}
+		a.cronosApp.DB.Create(&schedule)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&schedule)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&RetainerSchedule{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetainerPeriodsClampToMonthEnd(t *testing.T) {
+	schedule := RetainerSchedule{Frequency: RetainerFrequencyMonthly, StartDate: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)}
+	periods, err := retainerPeriods(schedule, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"}
+	if len(periods) != len(want)-1 {
+		t.Fatalf("got %d periods, want %d", len(periods), len(want)-1)
+	}
+	for i, period := range periods {
+		if period.Start.Format("2006-01-02") != want[i] || period.End.Format("2006-01-02") != want[i+1] {
+			t.Errorf("period %d: got %s to %s, want %s to %s", i, period.Start.Format("2006-01-02"), period.End.Format("2006-01-02"), want[i], want[i+1])
+		}
+	}
+}
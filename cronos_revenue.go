@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Fixed fee recognition methods
+const (
+	RecognitionStraightLine = "straight_line"
+	RecognitionMilestone    = "milestone"
+)
+
+// FixedFeeContract is a fixed fee agreed for a project. Straight line contracts recognize the fee evenly across
+// every day from the start date through the end date, while milestone contracts recognize each milestone's amount
+// when it is completed.
+type FixedFeeContract struct {
+	gorm.Model
+	ProjectID   uint               `json:"project_id" gorm:"index"`
+	Name        string             `json:"name"`
+	Amount      float64            `json:"amount"`
+	Recognition string             `json:"recognition"`
+	StartDate   time.Time          `json:"start_date"`
+	EndDate     time.Time          `json:"end_date"`
+	Milestones  []RevenueMilestone `json:"milestones"`
+}
+
+// RevenueMilestone is a deliverable on a milestone contract whose amount is recognized once it is completed
+type RevenueMilestone struct {
+	gorm.Model
+	FixedFeeContractID uint       `json:"fixed_fee_contract_id" gorm:"index"`
+	Name               string     `json:"name"`
+	Amount             float64    `json:"amount"`
+	CompletedAt        *time.Time `json:"completed_at"`
+}
+
+// RevenueLine is the revenue recognized, billed and collected for an account in a month, along with the deferred
+// and unbilled balances at the end of the month
+type RevenueLine struct {
+	Month            string  `json:"month"`
+	AccountID        uint    `json:"account_id"`
+	AccountName      string  `json:"account_name"`
+	TimeAndMaterials float64 `json:"time_and_materials"`
+	Retainer         float64 `json:"retainer"`
+	FixedFee         float64 `json:"fixed_fee"`
+	Recognized       float64 `json:"recognized"`
+	Billed           float64 `json:"billed"`
+	Collected        float64 `json:"collected"`
+	DeferredBalance  float64 `json:"deferred_balance"`
+	UnbilledBalance  float64 `json:"unbilled_balance"`
+}
+
+// revenueMonth is the key revenue is aggregated under for the month containing t
+func revenueMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// spreadDaily divides an amount evenly across the days from start up to but not including end
+func spreadDaily(amount float64, start, end time.Time, add func(day time.Time, amount float64)) {
+	days := 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		days++
+	}
+	if days == 0 {
+		add(start, amount)
+		return
+	}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		add(day, amount/float64(days))
+	}
+}
+
+// revenueLedger accumulates revenue lines by account and month
+type revenueLedger map[uint]map[string]*RevenueLine
+
+// line returns the line for an account in the month containing t
+func (l revenueLedger) line(accountID uint, t time.Time) *RevenueLine {
+	month := revenueMonth(t)
+	if l[accountID] == nil {
+		l[accountID] = make(map[string]*RevenueLine)
+	}
+	if l[accountID][month] == nil {
+		l[accountID][month] = &RevenueLine{Month: month, AccountID: accountID}
+	}
+	return l[accountID][month]
+}
+
+// RevenueSchedule computes recognized, billed and collected revenue per account for each month from start up to
+// end. Time and materials revenue is recognized by entry date at the billed amount, retainers straight line across
+// each invoiced period with any overage in the period's last month, and fixed fees by their recognition method.
+// Time on a retainer's billing code or on a project with a fixed fee contract is already recognized through the
+// retainer or contract, so it is left out of time and materials. Revenue is billed in the month an approved invoice's period ends and collected when payment is received. The
+// balances are cumulative, so everything before start is included in them.
+func (a *App) RevenueSchedule(start, end time.Time) []RevenueLine {
+	ledger := make(revenueLedger)
+
+	var projects []cronos.Project
+	a.cronosApp.DB.Find(&projects)
+	projectsByID := make(map[uint]cronos.Project, len(projects))
+	for _, project := range projects {
+		projectsByID[project.ID] = project
+	}
+
+	var entries []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode.Rate").
+		Where("start < ? and state != ? and internal = ?", end, cronos.EntryStateVoid.String(), false).
+		Find(&entries)
+	billingCodeIDs := make([]uint, len(entries))
+	for i, entry := range entries {
+		billingCodeIDs[i] = entry.BillingCodeID
+	}
+	modes := a.roundingModes(billingCodeIDs)
+	var retainerCodeIDs, fixedFeeProjectIDs []uint
+	a.cronosApp.DB.Unscoped().Model(&RetainerSchedule{}).Pluck("billing_code_id", &retainerCodeIDs)
+	a.cronosApp.DB.Model(&FixedFeeContract{}).Pluck("project_id", &fixedFeeProjectIDs)
+	retainerCodes := make(map[uint]bool)
+	for _, id := range retainerCodeIDs {
+		retainerCodes[id] = true
+	}
+	fixedFeeProjects := make(map[uint]bool)
+	for _, id := range fixedFeeProjectIDs {
+		fixedFeeProjects[id] = true
+	}
+	for _, entry := range entries {
+		project := projectsByID[entry.ProjectID]
+		if project.Internal || retainerCodes[entry.BillingCodeID] || fixedFeeProjects[entry.ProjectID] {
+			continue
+		}
+		amounts := billedAmounts(entry.Start, entry.End, entry.BillingCode, modes[entry.BillingCodeID])
+		ledger.line(project.AccountID, entry.Start).TimeAndMaterials += amounts.BilledAmount
+	}
+
+	var retainerInvoices []RetainerInvoice
+	a.cronosApp.DB.Joins("JOIN invoices ON invoices.id = retainer_invoices.invoice_id").
+		Where("invoices.state != ? and retainer_invoices.period_start < ?", cronos.InvoiceStateVoid.String(), end).
+		Find(&retainerInvoices)
+	for _, retainerInvoice := range retainerInvoices {
+		var schedule RetainerSchedule
+		if a.cronosApp.DB.Unscoped().Where("id = ?", retainerInvoice.RetainerScheduleID).Limit(1).Find(&schedule).RowsAffected == 0 {
+			continue
+		}
+		accountID := projectsByID[schedule.ProjectID].AccountID
+		spreadDaily(schedule.Amount, retainerInvoice.PeriodStart, retainerInvoice.PeriodEnd, func(day time.Time, amount float64) {
+			ledger.line(accountID, day).Retainer += amount
+		})
+		if retainerInvoice.OverageHours > 0 && schedule.OverageRate > 0 {
+			ledger.line(accountID, retainerInvoice.PeriodEnd.AddDate(0, 0, -1)).Retainer += retainerInvoice.OverageHours * schedule.OverageRate
+		}
+	}
+
+	var contracts []FixedFeeContract
+	a.cronosApp.DB.Preload("Milestones").Where("start_date < ?", end).Find(&contracts)
+	for _, contract := range contracts {
+		accountID := projectsByID[contract.ProjectID].AccountID
+		if contract.Recognition == RecognitionMilestone {
+			for _, milestone := range contract.Milestones {
+				if milestone.CompletedAt != nil {
+					ledger.line(accountID, *milestone.CompletedAt).FixedFee += milestone.Amount
+				}
+			}
+			continue
+		}
+		spreadDaily(contract.Amount, contract.StartDate, contract.EndDate.AddDate(0, 0, 1), func(day time.Time, amount float64) {
+			ledger.line(accountID, day).FixedFee += amount
+		})
+	}
+
+	var invoices []struct {
+		ID          uint
+		AccountID   uint
+		State       string
+		PeriodEnd   time.Time
+		ClosedAt    time.Time
+		TotalAmount float64
+	}
+	a.cronosApp.DB.Model(&cronos.Invoice{}).Select("id, account_id, state, period_end, closed_at, total_amount").
+		Where("type = ? and state in ? and period_end < ?", cronos.InvoiceTypeAR.String(),
+			[]string{cronos.InvoiceStateApproved.String(), cronos.InvoiceStateSent.String(), cronos.InvoiceStatePaid.String()}, end).
+		Scan(&invoices)
+	for _, invoice := range invoices {
+		ledger.line(invoice.AccountID, invoice.PeriodEnd).Billed += invoice.TotalAmount
+
+		var payments []Payment
+		a.cronosApp.DB.Where("invoice_id = ?", invoice.ID).Find(&payments)
+		for _, payment := range payments {
+			if !payment.ReceivedAt.Before(end) {
+				continue
+			}
+			ledger.line(invoice.AccountID, payment.ReceivedAt).Collected += payment.Amount
+		}
+		// Invoices marked paid by hand have no payment records, so they are collected in full when they were closed
+		if len(payments) == 0 && invoice.State == cronos.InvoiceStatePaid.String() {
+			collectedAt := invoice.ClosedAt
+			if collectedAt.IsZero() {
+				collectedAt = invoice.PeriodEnd
+			}
+			if collectedAt.Before(end) {
+				ledger.line(invoice.AccountID, collectedAt).Collected += invoice.TotalAmount
+			}
+		}
+	}
+
+	var schedule []RevenueLine
+	for accountID, months := range ledger {
+		var account cronos.Account
+		a.cronosApp.DB.Where("id = ?", accountID).Limit(1).Find(&account)
+		var balance float64
+		for month := periodMonth(earliestRevenueMonth(months, start)); month.Before(end); month = month.AddDate(0, 1, 0) {
+			line, ok := months[revenueMonth(month)]
+			if !ok {
+				line = &RevenueLine{Month: revenueMonth(month), AccountID: accountID}
+			}
+			line.AccountName = account.Name
+			line.Recognized = line.TimeAndMaterials + line.Retainer + line.FixedFee
+			// A positive balance is revenue earned but not yet billed, a negative one is billed ahead of being earned
+			balance += line.Recognized - line.Billed
+			if balance > 0 {
+				line.UnbilledBalance = balance
+			} else {
+				line.DeferredBalance = -balance
+			}
+			if month.Before(periodMonth(start)) {
+				continue
+			}
+			if !ok && balance == 0 {
+				continue
+			}
+			schedule = append(schedule, *line)
+		}
+	}
+	sort.Slice(schedule, func(i, j int) bool {
+		if schedule[i].Month != schedule[j].Month {
+			return schedule[i].Month < schedule[j].Month
+		}
+		return schedule[i].AccountName < schedule[j].AccountName
+	})
+	return schedule
+}
+
+// earliestRevenueMonth finds the first month an account has any revenue activity, or start if it is earlier
+func earliestRevenueMonth(months map[string]*RevenueLine, start time.Time) time.Time {
+	earliest := start
+	for month := range months {
+		t, err := time.ParseInLocation("2006-01", month, start.Location())
+		if err == nil && t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+// RevenueScheduleHandler provides the revenue recognition schedule for admins over the months of the `start` and
+// `end` dates, optionally limited to one `account_id`, as JSON or as CSV when `format=csv`
+func (a *App) RevenueScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	start, end, errs := reportRange(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	start, end = periodMonth(start), periodMonth(end.AddDate(0, 0, -1)).AddDate(0, 1, 0)
+	schedule := a.RevenueSchedule(start, end)
+	if accountID := r.URL.Query().Get("account_id"); accountID != "" {
+		filtered := []RevenueLine{}
+		for _, line := range schedule {
+			if strconv.Itoa(int(line.AccountID)) == accountID {
+				filtered = append(filtered, line)
+			}
+		}
+		schedule = filtered
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{"month", "account_id", "account", "time_and_materials", "retainer", "fixed_fee", "recognized", "billed", "collected", "deferred_balance", "unbilled_balance"}}
+		for _, line := range schedule {
+			rows = append(rows, []string{line.Month, strconv.Itoa(int(line.AccountID)), line.AccountName,
+				formatDecimal(line.TimeAndMaterials), formatDecimal(line.Retainer), formatDecimal(line.FixedFee),
+				formatDecimal(line.Recognized), formatDecimal(line.Billed), formatDecimal(line.Collected),
+				formatDecimal(line.DeferredBalance), formatDecimal(line.UnbilledBalance)})
+		}
+		writeCSV(w, "revenue", start, end, rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&schedule)
+}
+
+// validateFixedFeeContract checks the recognition method and the dates it needs
+func validateFixedFeeContract(contract FixedFeeContract) ValidationErrors {
+	var errs ValidationErrors
+	switch contract.Recognition {
+	case RecognitionStraightLine:
+		if contract.StartDate.IsZero() || contract.EndDate.IsZero() {
+			errs.Add("end_date", "Straight line recognition requires a start and end date")
+		} else if contract.EndDate.Before(contract.StartDate) {
+			errs.Add("end_date", "End date must not be before the start date")
+		}
+	case RecognitionMilestone:
+	default:
+		errs.Add("recognition", fmt.Sprintf("Expected %s or %s", RecognitionStraightLine, RecognitionMilestone))
+	}
+	if contract.Amount < 0 {
+		errs.Add("amount", "Amount must not be negative")
+	}
+	return errs
+}
+
+// ProjectFixedFeesListHandler provides the fixed fee contracts for a project
+func (a *App) ProjectFixedFeesListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var contracts []FixedFeeContract
+	a.cronosApp.DB.Preload("Milestones").Where("project_id = ?", vars["id"]).Order("start_date ASC").Find(&contracts)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&contracts)
+}
+
+// FixedFeeHandler Provides CRUD interface for the fixed fee contract object
+func (a *App) FixedFeeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var contract FixedFeeContract
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.Preload("Milestones").First(&contract, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&contract)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.Preload("Milestones").First(&contract, vars["id"])
+		if r.FormValue("name") != "" {
+			contract.Name = r.FormValue("name")
+		}
+		if r.FormValue("amount") != "" {
+			contract.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		}
+		if r.FormValue("recognition") != "" {
+			contract.Recognition = r.FormValue("recognition")
+		}
+		if r.FormValue("start_date") != "" {
+			contract.StartDate, _ = time.Parse("2006-01-02", r.FormValue("start_date"))
+		}
+		if r.FormValue("end_date") != "" {
+			contract.EndDate, _ = time.Parse("2006-01-02", r.FormValue("end_date"))
+		}
+		if errs := validateFixedFeeContract(contract); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Omit("Milestones").Save(&contract)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&contract)
+		return
+	case r.Method == "POST":
+		projectID, _ := strconv.ParseUint(r.FormValue("project_id"), 10, 64)
+		contract.ProjectID = uint(projectID)
+		contract.Name = r.FormValue("name")
+		contract.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		contract.Recognition = r.FormValue("recognition")
+		contract.StartDate, _ = time.Parse("2006-01-02", r.FormValue("start_date"))
+		contract.EndDate, _ = time.Parse("2006-01-02", r.FormValue("end_date"))
+		errs := validateFixedFeeContract(contract)
+		if a.cronosApp.DB.Where("id = ?", contract.ProjectID).Limit(1).Find(&cronos.Project{}).RowsAffected == 0 {
+			errs.Add("project_id", "Project does not exist")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		a.cronosApp.DB.Create(&contract)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&contract)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("fixed_fee_contract_id = ?", vars["id"]).Delete(&RevenueMilestone{})
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&FixedFeeContract{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// RevenueMilestoneHandler Provides CRUD interface for the revenue milestone object. A milestone is recognized by
+// setting `completed_at`, and "null" marks it incomplete again.
+func (a *App) RevenueMilestoneHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var milestone RevenueMilestone
+	setCompletedAt := func() bool {
+		switch r.FormValue("completed_at") {
+		case "":
+		case "null":
+			milestone.CompletedAt = nil
+		default:
+			completedAt, err := time.Parse("2006-01-02", r.FormValue("completed_at"))
+			if err != nil {
+				writeValidationErrors(w, ValidationErrors{{Field: "completed_at", Message: "Expected a date in the format YYYY-MM-DD"}})
+				return false
+			}
+			milestone.CompletedAt = &completedAt
+		}
+		return true
+	}
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.First(&milestone, vars["id"])
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(&milestone)
+		return
+	case r.Method == "PUT":
+		a.cronosApp.DB.First(&milestone, vars["id"])
+		if r.FormValue("name") != "" {
+			milestone.Name = r.FormValue("name")
+		}
+		if r.FormValue("amount") != "" {
+			milestone.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		}
+		if !setCompletedAt() {
+			return
+		}
+		a.cronosApp.DB.Save(&milestone)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&milestone)
+		return
+	case r.Method == "POST":
+		contractID, _ := strconv.ParseUint(r.FormValue("fixed_fee_contract_id"), 10, 64)
+		var contract FixedFeeContract
+		if a.cronosApp.DB.Where("id = ? and recognition = ?", contractID, RecognitionMilestone).Limit(1).Find(&contract).RowsAffected == 0 {
+			writeValidationErrors(w, ValidationErrors{{Field: "fixed_fee_contract_id", Message: "Milestones can only be added to a milestone contract"}})
+			return
+		}
+		milestone.FixedFeeContractID = contract.ID
+		milestone.Name = r.FormValue("name")
+		milestone.Amount, _ = strconv.ParseFloat(r.FormValue("amount"), 64)
+		if !setCompletedAt() {
+			return
+		}
+		a.cronosApp.DB.Create(&milestone)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&milestone)
+		return
+	case r.Method == "DELETE":
+		a.cronosApp.DB.Where("id = ?", vars["id"]).Delete(&RevenueMilestone{})
+		_ = json.NewEncoder(w).Encode("Deleted Record")
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// RoundingModeDown rounds an entry's duration down to the billing code's RoundedTo increment. It is the only mode as
+// it matches cronos GetFee, which invoice line amounts are calculated with.
+const RoundingModeDown = "down"
+
+// BillingCodeRounding stores the rounding mode chosen for a billing code
+type BillingCodeRounding struct {
+	gorm.Model
+	BillingCodeID uint   `json:"billing_code_id" gorm:"uniqueIndex"`
+	Mode          string `json:"mode"`
+}
+
+// validRoundingMode reports whether mode is a supported rounding mode
+func validRoundingMode(mode string) bool {
+	return mode == RoundingModeDown
+}
+
+// roundDuration rounds a duration down to a whole number of increments of roundedTo minutes. A billing code without
+// an increment is billed exactly as logged.
+func roundDuration(raw time.Duration, roundedTo int) time.Duration {
+	if roundedTo <= 0 || raw <= 0 {
+		return raw
+	}
+	increment := time.Duration(roundedTo) * time.Minute
+	return raw / increment * increment
+}
+
+// roundingModes loads the rounding mode of each billing code, defaulting to rounding down
+func (a *App) roundingModes(billingCodeIDs []uint) map[uint]string {
+	modes := make(map[uint]string, len(billingCodeIDs))
+	for _, id := range billingCodeIDs {
+		modes[id] = RoundingModeDown
+	}
+	var roundings []BillingCodeRounding
+	a.cronosApp.DB.Where("billing_code_id in ?", billingCodeIDs).Find(&roundings)
+	for _, rounding := range roundings {
+		modes[rounding.BillingCodeID] = rounding.Mode
+	}
+	return modes
+}
+
+// setBillingCodeRounding creates or updates the rounding mode of a billing code. The row is removed along with its
+// billing code, so a deleted row is brought back rather than colliding with the unique billing code index.
+func (a *App) setBillingCodeRounding(billingCodeID uint, mode string) {
+	rounding := BillingCodeRounding{BillingCodeID: billingCodeID}
+	a.cronosApp.DB.Unscoped().Where("billing_code_id = ?", billingCodeID).Limit(1).Find(&rounding)
+	rounding.Mode = mode
+	rounding.DeletedAt = gorm.DeletedAt{}
+	a.cronosApp.DB.Unscoped().Save(&rounding)
+}
+
+// BillingCodeDetail is the API view of a billing code including its rounding mode
+type BillingCodeDetail struct {
+	cronos.BillingCode
+	RoundingMode string `json:"rounding_mode"`
+}
+
+// BilledAmounts compares the time and amount an entry records with what it is billed at after rounding
+type BilledAmounts struct {
+	RoundingMode string  `json:"rounding_mode"`
+	RoundedTo    int     `json:"rounded_to"`
+	RawHours     float64 `json:"raw_hours"`
+	BilledHours  float64 `json:"billed_hours"`
+	RawAmount    float64 `json:"raw_amount"`
+	BilledAmount float64 `json:"billed_amount"`
+}
+
+// billedAmounts works out the raw and billed duration and amount of a time range against a billing code, whose
+// Rate must be loaded
+func billedAmounts(start, end time.Time, billingCode cronos.BillingCode, mode string) BilledAmounts {
+	raw := end.Sub(start)
+	billed := roundDuration(raw, billingCode.RoundedTo)
+	return BilledAmounts{
+		RoundingMode: mode,
+		RoundedTo:    billingCode.RoundedTo,
+		RawHours:     raw.Hours(),
+		BilledHours:  billed.Hours(),
+		RawAmount:    raw.Hours() * billingCode.Rate.Amount,
+		BilledAmount: billed.Hours() * billingCode.Rate.Amount,
+	}
+}
+
+// BilledEntry is an ApiEntry along with the raw and billed duration and amount
+type BilledEntry struct {
+	cronos.ApiEntry
+	BilledAmounts
+}
+
+// billedEntries pairs API entries with their billed amounts. The entries must have BillingCode.Rate loaded.
+func (a *App) billedEntries(entries []cronos.Entry, apiEntries []cronos.ApiEntry) []BilledEntry {
+	billingCodeIDs := make([]uint, len(entries))
+	for i, entry := range entries {
+		billingCodeIDs[i] = entry.BillingCodeID
+	}
+	modes := a.roundingModes(billingCodeIDs)
+	billed := make([]BilledEntry, len(entries))
+	for i, entry := range entries {
+		billed[i] = BilledEntry{
+			ApiEntry:      apiEntries[i],
+			BilledAmounts: billedAmounts(entry.Start, entry.End, entry.BillingCode, modes[entry.BillingCodeID]),
+		}
+	}
+	return billed
+}
+
+// billedEntry pairs a single API entry with its billed amounts
+func (a *App) billedEntry(entry cronos.Entry, apiEntry cronos.ApiEntry) BilledEntry {
+	return a.billedEntries([]cronos.Entry{entry}, []cronos.ApiEntry{apiEntry})[0]
+}
+
+// EntryPreviewHandler shows how a proposed entry would be billed before it is saved, given a `billing_code_id`
+// and `start` and `end` times in the same format EntryHandler accepts
+func (a *App) EntryPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var errs ValidationErrors
+	start, _ := parseEntryTime(r.FormValue("start"), "start", &errs)
+	end, _ := parseEntryTime(r.FormValue("end"), "end", &errs)
+	var billingCode cronos.BillingCode
+	if a.cronosApp.DB.Preload("Rate").Where("id = ?", r.FormValue("billing_code_id")).Limit(1).Find(&billingCode).RowsAffected == 0 {
+		errs.Add("billing_code_id", "Billing code does not exist")
+	}
+	if len(errs) == 0 && !end.After(start) {
+		errs.Add("end", "End time must be after the start time")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	mode := a.roundingModes([]uint{billingCode.ID})[billingCode.ID]
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(billedAmounts(start, end, billingCode, mode))
+}
+
+// roundingModeError returns a validation error for an unsupported rounding mode
+func roundingModeError(mode string) ValidationErrors {
+	return ValidationErrors{{Field: "rounding_mode", Message: fmt.Sprintf("%q is not a rounding mode, expected %s", mode, RoundingModeDown)}}
+}
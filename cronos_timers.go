@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Timer states. A stopped timer has produced an entry, or was auto-stopped and could not produce a valid one. A
+// discarded timer was cleared by the employee, or stopped before a whole minute had been recorded, without an entry.
+const (
+	TimerStateRunning   = "running"
+	TimerStatePaused    = "paused"
+	TimerStateStopped   = "stopped"
+	TimerStateDiscarded = "discarded"
+)
+
+// timerMu serialises timer transitions so that an employee can never end up with two active timers
+var timerMu sync.Mutex
+
+// EntryTimer is a live timer an employee runs while working. It is persisted so that it survives the browser being
+// closed, and when stopped it is turned into a draft entry that starts when the timer was first started and lasts
+// for the time the timer was actually running. StartedAt is the actual instant, while the entry records the wall
+// clock time in the employee's Timezone like every other entry.
+type EntryTimer struct {
+	gorm.Model
+	EmployeeID     uint       `json:"employee_id" gorm:"index"`
+	BillingCodeID  uint       `json:"billing_code_id"`
+	Notes          string     `json:"notes"`
+	State          string     `json:"state"`
+	StartedAt      time.Time  `json:"started_at"`
+	Timezone       string     `json:"timezone"`
+	ResumedAt      *time.Time `json:"resumed_at"`
+	ElapsedSeconds int64      `json:"elapsed_seconds"`
+	StoppedAt      *time.Time `json:"stopped_at"`
+	AutoStopped    bool       `json:"auto_stopped"`
+	EntryID        *uint      `json:"entry_id"`
+}
+
+// Elapsed returns how long the timer has been running as of now, excluding any time it spent paused
+func (t *EntryTimer) Elapsed(now time.Time) time.Duration {
+	elapsed := time.Duration(t.ElapsedSeconds) * time.Second
+	if t.State == TimerStateRunning && t.ResumedAt != nil {
+		elapsed += now.Sub(*t.ResumedAt)
+	}
+	return elapsed
+}
+
+// location returns the time zone the timer's employee logs time in, defaulting to UTC
+func (t *EntryTimer) location() *time.Location {
+	if loc, err := time.LoadLocation(t.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// timerAutoStopAfter returns how long a timer may run before it is stopped automatically. TIMER_AUTO_STOP_HOURS
+// overrides the default, which matches the longest entry we accept.
+func timerAutoStopAfter() time.Duration {
+	hours, err := strconv.ParseFloat(os.Getenv("TIMER_AUTO_STOP_HOURS"), 64)
+	if err != nil || hours <= 0 {
+		return maxEntryDuration()
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// activeTimer loads the running or paused timer for an employee, returning false if there is none
+func (a *App) activeTimer(employeeID uint) (EntryTimer, bool) {
+	var timer EntryTimer
+	found := a.cronosApp.DB.Where("employee_id = ? and state in ?", employeeID, []string{TimerStateRunning, TimerStatePaused}).
+		Order("started_at DESC").Limit(1).Find(&timer).RowsAffected > 0
+	return timer, found
+}
+
+// pauseTimer banks the time since the timer was last resumed
+func pauseTimer(timer *EntryTimer, now time.Time) {
+	timer.ElapsedSeconds = int64(timer.Elapsed(now) / time.Second)
+	timer.ResumedAt = nil
+	timer.State = TimerStatePaused
+}
+
+// discardTimer clears a timer without creating an entry
+func (a *App) discardTimer(timer *EntryTimer, now time.Time) {
+	if timer.State == TimerStateRunning {
+		pauseTimer(timer, now)
+	}
+	timer.State = TimerStateDiscarded
+	timer.StoppedAt = &now
+	a.cronosApp.DB.Save(timer)
+}
+
+// stopTimer stops the timer and creates a draft entry from it in the same way EntryHandler does. When the entry
+// fails validation the stored timer is left untouched and the errors are returned so the employee can correct the
+// timer or discard it. A timer stopped before a whole minute was recorded is discarded and returns an empty entry.
+func (a *App) stopTimer(timer *EntryTimer, now time.Time, userID uint) (cronos.Entry, ValidationErrors) {
+	if timer.State == TimerStateRunning {
+		pauseTimer(timer, now)
+	}
+	elapsed := time.Duration(timer.ElapsedSeconds) * time.Second
+	if limit := timerAutoStopAfter(); elapsed > limit {
+		elapsed = limit
+		timer.AutoStopped = true
+	}
+
+	// Entries are recorded to the minute
+	entry := cronos.Entry{
+		EmployeeID:    timer.EmployeeID,
+		BillingCodeID: timer.BillingCodeID,
+		Notes:         timer.Notes,
+		Start:         wallClock(timer.StartedAt, timer.location()).Truncate(time.Minute),
+		Internal:      false,
+		State:         cronos.EntryStateDraft.String(),
+	}
+	entry.End = entry.Start.Add(elapsed.Round(time.Minute))
+	if !entry.End.After(entry.Start) {
+		a.discardTimer(timer, now)
+		return cronos.Entry{}, nil
+	}
+	var billingCode cronos.BillingCode
+	a.cronosApp.DB.Preload("Rate").Preload("InternalRate").Where("id = ?", timer.BillingCodeID).First(&billingCode)
+	entry.BillingCode = billingCode
+	entry.ProjectID = billingCode.ProjectID
+
+	if errs := a.ValidateEntry(&entry); len(errs) > 0 {
+		return entry, errs
+	}
+	a.cronosApp.DB.Create(&entry)
+	if err := a.AssociateApprovedEntry(&entry); err != nil {
+		fmt.Println(err)
+	}
+	a.SnapshotDraftInvoiceForEntry(entry.ID, userID)
+
+	timer.State = TimerStateStopped
+	timer.StoppedAt = &now
+	timer.EntryID = &entry.ID
+	a.cronosApp.DB.Save(timer)
+	return entry, nil
+}
+
+// AutoStopTimers stops every timer that has run past the auto-stop limit. The resulting entry is capped at the
+// limit. If the entry cannot be created the timer is still stopped so that it does not keep accruing time.
+func (a *App) AutoStopTimers(now time.Time) {
+	timerMu.Lock()
+	defer timerMu.Unlock()
+
+	limit := timerAutoStopAfter()
+	var timers []EntryTimer
+	a.cronosApp.DB.Where("state = ?", TimerStateRunning).Find(&timers)
+	for i := range timers {
+		if timers[i].Elapsed(now) >= limit {
+			a.autoStopTimer(&timers[i], now)
+		}
+	}
+}
+
+// autoStopTimer stops a timer that has run past the auto-stop limit, callers must hold timerMu
+func (a *App) autoStopTimer(timer *EntryTimer, now time.Time) {
+	if _, errs := a.stopTimer(timer, now, 0); len(errs) > 0 {
+		log.Printf("Timer %d auto-stopped without creating an entry: %v", timer.ID, errs)
+		timer.State = TimerStateStopped
+		timer.StoppedAt = &now
+		timer.AutoStopped = true
+		a.cronosApp.DB.Save(timer)
+	}
+}
+
+// RunTimerAutoStop checks for timers to auto-stop on a fixed interval until the process exits
+func (a *App) RunTimerAutoStop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.AutoStopTimers(time.Now())
+		<-ticker.C
+	}
+}
+
+// TimerStatus is the API view of a timer, including the time elapsed so far
+type TimerStatus struct {
+	EntryTimer
+	ElapsedHours float64          `json:"elapsed_hours"`
+	Entry        *cronos.ApiEntry `json:"entry,omitempty"`
+}
+
+// TimerHandler returns the current employee's running or paused timer, or null if there is none
+func (a *App) TimerHandler(w http.ResponseWriter, r *http.Request) {
+	var employee cronos.Employee
+	a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).First(&employee)
+
+	// Apply any pending auto-stop before reporting the timer so a timer left running overnight never shows as active
+	a.AutoStopTimers(time.Now())
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	timer, found := a.activeTimer(employee.ID)
+	if !found {
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(nil)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(TimerStatus{EntryTimer: timer, ElapsedHours: timer.Elapsed(time.Now()).Hours()})
+}
+
+// TimerActionHandler starts, pauses, stops or discards the current employee's timer. Starting while a timer is paused
+// resumes it, and starting while one is already running is a conflict. A new timer takes the `timezone` the employee
+// logs time in, defaulting to UTC. Stopping creates a draft entry from the timer, while discarding clears it without
+// one, for a timer whose entry cannot be saved.
+func (a *App) TimerActionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff can track time", http.StatusForbidden)
+		return
+	}
+
+	timerMu.Lock()
+	defer timerMu.Unlock()
+
+	now := time.Now()
+	timer, found := a.activeTimer(employee.ID)
+	if found && vars["action"] != "stop" && vars["action"] != "discard" && timer.State == TimerStateRunning && timer.Elapsed(now) >= timerAutoStopAfter() {
+		// The timer should already have been auto-stopped, so stop it before starting or pausing. Stopping it
+		// explicitly produces the same capped entry.
+		a.autoStopTimer(&timer, now)
+		found = false
+	}
+
+	switch vars["action"] {
+	case "start":
+		if found && timer.State == TimerStateRunning {
+			http.Error(w, "A timer is already running", http.StatusConflict)
+			return
+		}
+		if !found {
+			var errs ValidationErrors
+			loc := time.UTC
+			if r.FormValue("timezone") != "" {
+				var err error
+				if loc, err = time.LoadLocation(r.FormValue("timezone")); err != nil {
+					errs.Add("timezone", "Unknown time zone")
+				}
+			}
+			var billingCode cronos.BillingCode
+			if a.cronosApp.DB.Where("id = ?", r.FormValue("billing_code_id")).Limit(1).Find(&billingCode).RowsAffected == 0 {
+				errs.Add("billing_code_id", "Billing code does not exist")
+			} else if today := wallClock(now, loc); !withinActiveWindow(today, today, billingCode.ActiveStart, billingCode.ActiveEnd) {
+				errs.Add("billing_code_id", fmt.Sprintf("Billing code %s is not active", billingCode.Code))
+			}
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+			timer = EntryTimer{
+				EmployeeID:    employee.ID,
+				BillingCodeID: billingCode.ID,
+				StartedAt:     now,
+				Timezone:      loc.String(),
+			}
+		}
+		if r.FormValue("notes") != "" {
+			timer.Notes = r.FormValue("notes")
+		}
+		timer.State = TimerStateRunning
+		timer.ResumedAt = &now
+		a.cronosApp.DB.Save(&timer)
+	case "pause":
+		if !found || timer.State != TimerStateRunning {
+			http.Error(w, "No running timer to pause", http.StatusConflict)
+			return
+		}
+		pauseTimer(&timer, now)
+		a.cronosApp.DB.Save(&timer)
+	case "stop":
+		if !found {
+			http.Error(w, "No timer to stop", http.StatusConflict)
+			return
+		}
+		if r.FormValue("notes") != "" {
+			timer.Notes = r.FormValue("notes")
+		}
+		entry, errs := a.stopTimer(&timer, now, contextUserID(r))
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		if entry.ID == 0 {
+			// Too short to record, the timer was discarded
+			break
+		}
+		a.setOverlapWarning(w, &entry)
+		a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser").First(&entry, entry.ID)
+		apiEntry := entry.GetAPIEntry()
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(TimerStatus{EntryTimer: timer, ElapsedHours: timer.Elapsed(now).Hours(), Entry: &apiEntry})
+		return
+	case "discard":
+		if !found {
+			http.Error(w, "No timer to discard", http.StatusConflict)
+			return
+		}
+		a.discardTimer(&timer, now)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(TimerStatus{EntryTimer: timer, ElapsedHours: timer.Elapsed(now).Hours()})
+}
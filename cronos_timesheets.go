@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// Timesheet states. Open and rejected timesheets can still be edited, submitted and approved timesheets are locked.
+const (
+	TimesheetStateOpen      = "open"
+	TimesheetStateSubmitted = "submitted"
+	TimesheetStateApproved  = "approved"
+	TimesheetStateRejected  = "rejected"
+)
+
+// Timesheet groups an employee's entries for a week running Monday to Sunday. Entries only reach draft invoices
+// once the timesheet covering them has been submitted by the employee and approved by a manager.
+type Timesheet struct {
+	gorm.Model
+	EmployeeID  uint              `json:"employee_id" gorm:"uniqueIndex:idx_timesheet_week"`
+	WeekStart   time.Time         `json:"week_start" gorm:"uniqueIndex:idx_timesheet_week"`
+	State       string            `json:"state"`
+	SubmittedAt *time.Time        `json:"submitted_at"`
+	ReviewedAt  *time.Time        `json:"reviewed_at"`
+	Reviews     []TimesheetReview `json:"reviews"`
+}
+
+// TimesheetReview records a manager approving or rejecting a timesheet along with their comments
+type TimesheetReview struct {
+	gorm.Model
+	TimesheetID  uint   `json:"timesheet_id" gorm:"index"`
+	ReviewerID   uint   `json:"reviewer_id"`
+	ReviewerName string `json:"reviewer_name"`
+	Action       string `json:"action"`
+	Comment      string `json:"comment"`
+}
+
+// TimesheetReminder records that an employee was reminded about a missing timesheet so they are only reminded once
+type TimesheetReminder struct {
+	gorm.Model
+	EmployeeID uint      `json:"employee_id" gorm:"uniqueIndex:idx_timesheet_reminder"`
+	WeekStart  time.Time `json:"week_start" gorm:"uniqueIndex:idx_timesheet_reminder"`
+}
+
+// TimesheetDetail is the API view of a timesheet with its entries and totals
+type TimesheetDetail struct {
+	Timesheet
+	EmployeeName string            `json:"employee_name"`
+	WeekEnd      time.Time         `json:"week_end"`
+	TotalHours   float64           `json:"total_hours"`
+	Entries      []cronos.ApiEntry `json:"entries"`
+}
+
+// weekStart returns midnight on the Monday of the week containing t
+func weekStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// timesheetLocked reports whether the entries are frozen because they fall in a week the employee has already
+// submitted or that has been approved
+func timesheetLocked(state string) bool {
+	return state == TimesheetStateSubmitted || state == TimesheetStateApproved
+}
+
+// timesheetFor loads an employee's timesheet for the week containing t. A week without a stored timesheet is open.
+func (a *App) timesheetFor(employeeID uint, t time.Time) Timesheet {
+	timesheet := Timesheet{EmployeeID: employeeID, WeekStart: weekStart(t), State: TimesheetStateOpen}
+	a.cronosApp.DB.Where("employee_id = ? and week_start = ?", employeeID, timesheet.WeekStart).Limit(1).Find(&timesheet)
+	return timesheet
+}
+
+// validateEntryTimesheet adds a field error if the entry falls in a locked timesheet
+func (a *App) validateEntryTimesheet(entry *cronos.Entry, errs *ValidationErrors) {
+	if timesheet := a.timesheetFor(entryWorkerID(entry), entry.Start); timesheetLocked(timesheet.State) {
+		errs.Add("start", fmt.Sprintf("The timesheet for the week of %s has been %s", timesheet.WeekStart.Format("2006-01-02"), timesheet.State))
+	}
+}
+
+// entryTimesheetLocked reports whether an existing entry sits in a locked timesheet and so cannot be edited or deleted
+func (a *App) entryTimesheetLocked(entry *cronos.Entry) bool {
+	return timesheetLocked(a.timesheetFor(entryWorkerID(entry), entry.Start).State)
+}
+
+// AssociateApprovedEntry associates an entry with its draft invoice if its timesheet has been approved. Entries in
+// weeks that are not yet approved are left unassociated and are picked up when the timesheet is approved.
+func (a *App) AssociateApprovedEntry(entry *cronos.Entry) error {
+	if a.timesheetFor(entryWorkerID(entry), entry.Start).State != TimesheetStateApproved {
+		return nil
+	}
+	return a.cronosApp.AssociateEntry(entry, entry.ProjectID)
+}
+
+// BackfillApprovedEntriesForProject associates the project's unbilled entries with their draft invoices, leaving
+// out entries in weeks whose timesheet has not been approved
+func (a *App) BackfillApprovedEntriesForProject(projectID string) {
+	var entries []cronos.Entry
+	a.cronosApp.DB.Where("project_id = ? and invoice_id is null and state = ? and internal = ?", projectID, cronos.EntryStateDraft.String(), false).
+		Order("start ASC").Find(&entries)
+	for i := range entries {
+		if err := a.AssociateApprovedEntry(&entries[i]); err != nil {
+			log.Printf("Error backfilling entry %d: %v", entries[i].ID, err)
+			continue
+		}
+		a.SnapshotDraftInvoiceForEntry(entries[i].ID, 0)
+	}
+}
+
+// timesheetEntries loads the non-void entries recording the employee's time during the timesheet week
+func (a *App) timesheetEntries(timesheet Timesheet) []cronos.Entry {
+	var entries []cronos.Entry
+	a.cronosApp.DB.Preload("BillingCode.Rate").Preload("BillingCode.InternalRate").Preload("Employee").Preload("ImpersonateAsUser").
+		Where("(impersonate_as_user_id = ? or (employee_id = ? and impersonate_as_user_id is null)) and state != ?",
+			timesheet.EmployeeID, timesheet.EmployeeID, cronos.EntryStateVoid.String()).
+		Where("start >= ? and start < ?", timesheet.WeekStart, timesheet.WeekStart.AddDate(0, 0, 7)).
+		Order("start ASC").Find(&entries)
+	return entries
+}
+
+// timesheetDetail builds the API view of a timesheet
+func (a *App) timesheetDetail(timesheet Timesheet) TimesheetDetail {
+	var employee cronos.Employee
+	a.cronosApp.DB.First(&employee, timesheet.EmployeeID)
+	detail := TimesheetDetail{
+		Timesheet:    timesheet,
+		EmployeeName: employee.FirstName + " " + employee.LastName,
+		WeekEnd:      timesheet.WeekStart.AddDate(0, 0, 6),
+		Entries:      []cronos.ApiEntry{},
+	}
+	for _, entry := range a.timesheetEntries(timesheet) {
+		detail.TotalHours += entry.Duration().Hours()
+		detail.Entries = append(detail.Entries, entry.GetAPIEntry())
+	}
+	return detail
+}
+
+// TimesheetsListHandler provides the current employee's timesheets, or with `state` set and an admin user, every
+// timesheet in that state so that managers can find those awaiting approval
+func (a *App) TimesheetsListHandler(w http.ResponseWriter, r *http.Request) {
+	var timesheets []Timesheet
+	query := a.cronosApp.DB.Preload("Reviews").Order("week_start DESC")
+	if state := r.URL.Query().Get("state"); state != "" && a.contextUserIsAdmin(r) {
+		query = query.Where("state = ?", state)
+	} else {
+		var employee cronos.Employee
+		a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).First(&employee)
+		query = query.Where("employee_id = ?", employee.ID)
+		if state != "" {
+			query = query.Where("state = ?", state)
+		}
+	}
+	query.Find(&timesheets)
+
+	details := make([]TimesheetDetail, len(timesheets))
+	for i := range timesheets {
+		details[i] = a.timesheetDetail(timesheets[i])
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&details)
+}
+
+// TimesheetWeekHandler shows or submits the current employee's timesheet for the week containing the date in the
+// URL. Submitting locks the week's entries until a manager approves or rejects the timesheet.
+func (a *App) TimesheetWeekHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	date, err := time.Parse("2006-01-02", vars["date"])
+	if err != nil {
+		http.Error(w, "Expected a date in the format YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).Limit(1).Find(&employee).RowsAffected == 0 {
+		http.Error(w, "Only staff have timesheets", http.StatusForbidden)
+		return
+	}
+	timesheet := a.timesheetFor(employee.ID, date)
+
+	switch {
+	case r.Method == "GET":
+		a.cronosApp.DB.Where("timesheet_id = ?", timesheet.ID).Find(&timesheet.Reviews)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(a.timesheetDetail(timesheet))
+		return
+	case r.Method == "POST":
+		if timesheetLocked(timesheet.State) {
+			http.Error(w, "Timesheet has already been "+timesheet.State, http.StatusConflict)
+			return
+		}
+		now := time.Now()
+		timesheet.State = TimesheetStateSubmitted
+		timesheet.SubmittedAt = &now
+		a.cronosApp.DB.Save(&timesheet)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(a.timesheetDetail(timesheet))
+		return
+	default:
+		fmt.Println("Fatal Error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// TimesheetHandler provides a single timesheet to its employee or to an admin
+func (a *App) TimesheetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var timesheet Timesheet
+	if a.cronosApp.DB.Preload("Reviews").First(&timesheet, vars["id"]).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var employee cronos.Employee
+	a.cronosApp.DB.Where("user_id = ?", r.Context().Value("user_id")).First(&employee)
+	if timesheet.EmployeeID != employee.ID && !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.timesheetDetail(timesheet))
+}
+
+// TimesheetReviewHandler lets an admin approve or reject a submitted timesheet with an optional `comment`.
+// Approving associates the week's entries with their draft invoices, rejecting reopens the week for editing.
+func (a *App) TimesheetReviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		http.Error(w, "Only managers can review timesheets", http.StatusForbidden)
+		return
+	}
+	var timesheet Timesheet
+	if a.cronosApp.DB.First(&timesheet, vars["id"]).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if timesheet.State != TimesheetStateSubmitted {
+		http.Error(w, "Only submitted timesheets can be reviewed", http.StatusConflict)
+		return
+	}
+	var reviewer cronos.User
+	a.cronosApp.DB.Where("id = ?", contextUserID(r)).First(&reviewer)
+	reviewerName, _ := a.userDisplayName(reviewer)
+	if r.FormValue("comment") == "" && vars["action"] == "reject" {
+		writeValidationErrors(w, ValidationErrors{{Field: "comment", Message: "A comment is required when rejecting a timesheet"}})
+		return
+	}
+
+	now := time.Now()
+	review := TimesheetReview{
+		TimesheetID:  timesheet.ID,
+		ReviewerID:   reviewer.ID,
+		ReviewerName: reviewerName,
+		Action:       vars["action"],
+		Comment:      r.FormValue("comment"),
+	}
+	timesheet.ReviewedAt = &now
+	if vars["action"] == "approve" {
+		timesheet.State = TimesheetStateApproved
+	} else {
+		timesheet.State = TimesheetStateRejected
+	}
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&timesheet).Error; err != nil {
+			return err
+		}
+		return tx.Create(&review).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if timesheet.State == TimesheetStateApproved {
+		entries := a.timesheetEntries(timesheet)
+		for i := range entries {
+			if entries[i].Internal {
+				continue
+			}
+			if err := a.cronosApp.AssociateEntry(&entries[i], entries[i].ProjectID); err != nil {
+				fmt.Println(err)
+			}
+			a.SnapshotDraftInvoiceForEntry(entries[i].ID, reviewer.ID)
+		}
+	}
+	go a.notifyTimesheetReviewed(timesheet, review)
+
+	a.cronosApp.DB.Where("timesheet_id = ?", timesheet.ID).Find(&timesheet.Reviews)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.timesheetDetail(timesheet))
+}
+
+// TimesheetReopenHandler lets an admin reopen an approved timesheet to correct a mistake, with an optional
+// `comment`. The week's entries are taken back off their draft invoices until the timesheet is approved again, so a
+// timesheet whose entries are already on an approved or sent invoice cannot be reopened.
+func (a *App) TimesheetReopenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !a.contextUserIsAdmin(r) {
+		http.Error(w, "Only managers can reopen timesheets", http.StatusForbidden)
+		return
+	}
+	var timesheet Timesheet
+	if a.cronosApp.DB.First(&timesheet, vars["id"]).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if timesheet.State != TimesheetStateApproved {
+		http.Error(w, "Only approved timesheets can be reopened", http.StatusConflict)
+		return
+	}
+	entries := a.timesheetEntries(timesheet)
+	var entryIDs []uint
+	for _, entry := range entries {
+		entryIDs = append(entryIDs, entry.ID)
+	}
+	var invoices []cronos.Invoice
+	if len(entryIDs) > 0 {
+		a.cronosApp.DB.Where("id in (?)", a.cronosApp.DB.Model(&cronos.Entry{}).Select("invoice_id").Where("id in ?", entryIDs)).Find(&invoices)
+	}
+	for _, invoice := range invoices {
+		if invoice.State != cronos.InvoiceStateDraft.String() {
+			http.Error(w, fmt.Sprintf("Entries in this timesheet are already on invoice %s, which is no longer a draft", invoice.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	var reviewer cronos.User
+	a.cronosApp.DB.Where("id = ?", contextUserID(r)).First(&reviewer)
+	reviewerName, _ := a.userDisplayName(reviewer)
+	review := TimesheetReview{
+		TimesheetID:  timesheet.ID,
+		ReviewerID:   reviewer.ID,
+		ReviewerName: reviewerName,
+		Action:       "reopen",
+		Comment:      r.FormValue("comment"),
+	}
+	now := time.Now()
+	timesheet.State = TimesheetStateOpen
+	timesheet.ReviewedAt = &now
+	err := a.cronosApp.DB.Transaction(func(tx *gorm.DB) error {
+		if len(entryIDs) > 0 {
+			if err := tx.Model(&cronos.Entry{}).Where("id in ?", entryIDs).Update("invoice_id", nil).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(&timesheet).Error; err != nil {
+			return err
+		}
+		return tx.Create(&review).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range invoices {
+		a.cronosApp.UpdateInvoiceTotals(&invoices[i])
+		a.SnapshotInvoice(invoices[i].ID, InvoiceVersionTriggerEntryChange, reviewer.ID)
+	}
+	go a.notifyTimesheetReviewed(timesheet, review)
+
+	a.cronosApp.DB.Where("timesheet_id = ?", timesheet.ID).Find(&timesheet.Reviews)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(a.timesheetDetail(timesheet))
+}
+
+// employeeEmail looks up the login email of an employee
+func (a *App) employeeEmail(employee cronos.Employee) string {
+	var user cronos.User
+	a.cronosApp.DB.Where("id = ?", employee.UserID).Limit(1).Find(&user)
+	return user.Email
+}
+
+// notifyTimesheetReviewed emails the employee the outcome of their timesheet review
+func (a *App) notifyTimesheetReviewed(timesheet Timesheet, review TimesheetReview) {
+	var employee cronos.Employee
+	a.cronosApp.DB.First(&employee, timesheet.EmployeeID)
+	recipient := a.employeeEmail(employee)
+	if recipient == "" {
+		return
+	}
+	outcome := timesheet.State
+	if review.Action == "reopen" {
+		outcome = "reopened"
+	}
+	content := fmt.Sprintf("Your timesheet for the week of %s was %s by %s.\r\n",
+		timesheet.WeekStart.Format("January 2, 2006"), outcome, review.ReviewerName)
+	if review.Comment != "" {
+		content += "\r\nComments: " + review.Comment + "\r\n"
+	}
+	email := cronos.Email{
+		SenderEmail:      "accounts@snowpack-data.io",
+		SenderName:       "Cronos",
+		RecipientEmail:   recipient,
+		RecipientName:    employee.FirstName + " " + employee.LastName,
+		Subject:          fmt.Sprintf("Timesheet for the week of %s %s", timesheet.WeekStart.Format("January 2"), outcome),
+		PlainTextContent: content,
+	}
+	if err := a.cronosApp.SendTextEmail(email); err != nil {
+		log.Printf("Error emailing timesheet review for timesheet %d: %v", timesheet.ID, err)
+	}
+}
+
+// SendTimesheetReminders reminds every active employee who has not submitted a timesheet for the week before now.
+// Each employee is reminded at most once per week, and a summary of the missing timesheets is posted to Slack.
+func (a *App) SendTimesheetReminders(now time.Time) {
+	lastWeek := weekStart(now).AddDate(0, 0, -7)
+	var employees []cronos.Employee
+	a.cronosApp.DB.Where("is_active = ?", true).Find(&employees)
+
+	var missing []string
+	for _, employee := range employees {
+		if !employee.StartDate.IsZero() && employee.StartDate.After(lastWeek.AddDate(0, 0, 6)) {
+			continue
+		}
+		if state := a.timesheetFor(employee.ID, lastWeek).State; state != TimesheetStateOpen && state != TimesheetStateRejected {
+			continue
+		}
+		reminder := TimesheetReminder{EmployeeID: employee.ID, WeekStart: lastWeek}
+		if a.cronosApp.DB.Where(&reminder).Limit(1).Find(&TimesheetReminder{}).RowsAffected > 0 {
+			continue
+		}
+		name := employee.FirstName + " " + employee.LastName
+		missing = append(missing, name)
+		a.cronosApp.DB.Create(&reminder)
+
+		recipient := a.employeeEmail(employee)
+		if recipient == "" {
+			continue
+		}
+		email := cronos.Email{
+			SenderEmail:    "accounts@snowpack-data.io",
+			SenderName:     "Cronos",
+			RecipientEmail: recipient,
+			RecipientName:  name,
+			Subject:        fmt.Sprintf("Reminder: submit your timesheet for the week of %s", lastWeek.Format("January 2")),
+			PlainTextContent: fmt.Sprintf("Your timesheet for the week of %s has not been submitted yet. Entries are not "+
+				"invoiced until the timesheet is submitted and approved.\r\n", lastWeek.Format("January 2, 2006")),
+		}
+		if err := a.cronosApp.SendTextEmail(email); err != nil {
+			log.Printf("Error emailing timesheet reminder to employee %d: %v", employee.ID, err)
+		}
+	}
+
+	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
+	if len(missing) > 0 && webhookURL != "" {
+		message := fmt.Sprintf("Timesheets missing for the week of %s: %s", lastWeek.Format("January 2"), strings.Join(missing, ", "))
+		a.sendSlackNotification(map[string]string{"text": message}, webhookURL)
+	}
+}
+
+// RunTimesheetReminders checks for missing timesheets on a fixed interval until the process exits
+func (a *App) RunTimesheetReminders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.SendTimesheetReminders(time.Now())
+		<-ticker.C
+	}
+}
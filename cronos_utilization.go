@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/snowpackdata/cronos"
+	"gorm.io/gorm"
+)
+
+// EmployeeCapacity stores the hours per week an employee is expected to be available. Employees without one use
+// the default from defaultWeeklyCapacity.
+type EmployeeCapacity struct {
+	gorm.Model
+	EmployeeID  uint    `json:"employee_id" gorm:"uniqueIndex"`
+	WeeklyHours float64 `json:"weekly_hours"`
+}
+
+// defaultWeeklyCapacity reads DEFAULT_WEEKLY_CAPACITY_HOURS, defaulting to a 40 hour week
+func defaultWeeklyCapacity() float64 {
+	hours, err := strconv.ParseFloat(os.Getenv("DEFAULT_WEEKLY_CAPACITY_HOURS"), 64)
+	if err != nil || hours <= 0 {
+		return 40
+	}
+	return hours
+}
+
+// weeklyCapacities loads the weekly capacity of each employee, falling back to the default
+func (a *App) weeklyCapacities(employeeIDs []uint) map[uint]float64 {
+	capacities := make(map[uint]float64, len(employeeIDs))
+	for _, id := range employeeIDs {
+		capacities[id] = defaultWeeklyCapacity()
+	}
+	var stored []EmployeeCapacity
+	a.cronosApp.DB.Where("employee_id in ?", employeeIDs).Find(&stored)
+	for _, capacity := range stored {
+		capacities[capacity.EmployeeID] = capacity.WeeklyHours
+	}
+	return capacities
+}
+
+// workdays counts the weekdays from start up to but not including end on which the employee was employed
+func workdays(start, end time.Time, employee cronos.Employee) int {
+	days := 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		if !employee.StartDate.IsZero() && !employee.StartDate.Before(day.AddDate(0, 0, 1)) {
+			continue
+		}
+		if !employee.EndDate.IsZero() && day.After(employee.EndDate) {
+			continue
+		}
+		days++
+	}
+	return days
+}
+
+// ProjectHours is the time an employee logged to a single project
+type ProjectHours struct {
+	ProjectID     uint    `json:"project_id"`
+	ProjectName   string  `json:"project_name"`
+	Internal      bool    `json:"internal"`
+	TotalHours    float64 `json:"total_hours"`
+	BillableHours float64 `json:"billable_hours"`
+	InternalHours float64 `json:"internal_hours"`
+}
+
+// EmployeeUtilization summarizes how much of an employee's capacity was spent on billable work over a range
+type EmployeeUtilization struct {
+	EmployeeID    uint           `json:"employee_id"`
+	EmployeeName  string         `json:"employee_name"`
+	CapacityHours float64        `json:"capacity_hours"`
+	TotalHours    float64        `json:"total_hours"`
+	BillableHours float64        `json:"billable_hours"`
+	InternalHours float64        `json:"internal_hours"`
+	Utilization   float64        `json:"utilization"`
+	Projects      []ProjectHours `json:"projects"`
+}
+
+// UtilizationReport computes the utilization of every employee who was active or logged time between start and
+// end. Time is internal when either the entry or its project is internal, and utilization is billable hours as a
+// percentage of capacity.
+func (a *App) UtilizationReport(start, end time.Time) []EmployeeUtilization {
+	var entries []cronos.Entry
+	a.cronosApp.DB.Where("start >= ? and start < ? and state != ?", start, end, cronos.EntryStateVoid.String()).
+		Order("start ASC").Find(&entries)
+
+	var projects []cronos.Project
+	a.cronosApp.DB.Find(&projects)
+	projectsByID := make(map[uint]cronos.Project, len(projects))
+	for _, project := range projects {
+		projectsByID[project.ID] = project
+	}
+
+	var employees []cronos.Employee
+	a.cronosApp.DB.Where("is_active = ? or id in (?)", true,
+		a.cronosApp.DB.Model(&cronos.Entry{}).Select("coalesce(impersonate_as_user_id, employee_id)").
+			Where("start >= ? and start < ? and state != ?", start, end, cronos.EntryStateVoid.String())).
+		Order("last_name ASC, first_name ASC").Find(&employees)
+	employeeIDs := make([]uint, len(employees))
+	for i, employee := range employees {
+		employeeIDs[i] = employee.ID
+	}
+	capacities := a.weeklyCapacities(employeeIDs)
+
+	report := make([]EmployeeUtilization, len(employees))
+	reportIndexes := make(map[uint]int, len(employees))
+	projectIndexes := make([]map[uint]int, len(employees))
+	for i, employee := range employees {
+		reportIndexes[employee.ID] = i
+		report[i] = EmployeeUtilization{
+			EmployeeID:    employee.ID,
+			EmployeeName:  employee.FirstName + " " + employee.LastName,
+			CapacityHours: capacities[employee.ID] * float64(workdays(start, end, employee)) / 5,
+			Projects:      []ProjectHours{},
+		}
+		projectIndexes[i] = make(map[uint]int)
+	}
+
+	for i := range entries {
+		index, ok := reportIndexes[entryWorkerID(&entries[i])]
+		if !ok {
+			continue
+		}
+		utilization := &report[index]
+		project := projectsByID[entries[i].ProjectID]
+		projectIndex, ok := projectIndexes[index][project.ID]
+		if !ok {
+			projectIndex = len(utilization.Projects)
+			projectIndexes[index][project.ID] = projectIndex
+			utilization.Projects = append(utilization.Projects, ProjectHours{
+				ProjectID:   project.ID,
+				ProjectName: project.Name,
+				Internal:    project.Internal,
+			})
+		}
+		projectHours := &utilization.Projects[projectIndex]
+
+		hours := entries[i].Duration().Hours()
+		utilization.TotalHours += hours
+		projectHours.TotalHours += hours
+		if entries[i].Internal || project.Internal {
+			utilization.InternalHours += hours
+			projectHours.InternalHours += hours
+		} else {
+			utilization.BillableHours += hours
+			projectHours.BillableHours += hours
+		}
+	}
+
+	for i := range report {
+		if report[i].CapacityHours > 0 {
+			report[i].Utilization = report[i].BillableHours / report[i].CapacityHours * 100
+		}
+		sort.SliceStable(report[i].Projects, func(x, y int) bool {
+			return report[i].Projects[x].TotalHours > report[i].Projects[y].TotalHours
+		})
+	}
+	return report
+}
+
+// UtilizationReportHandler provides the utilization report for admins over the `start` and `end` dates, as JSON or
+// as CSV with one row per employee and project when `format=csv`
+func (a *App) UtilizationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.contextUserIsAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	start, end, errs := reportRange(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	report := a.UtilizationReport(start, end)
+
+	if wantsCSV(r) {
+		rows := [][]string{{"employee_id", "employee", "capacity_hours", "utilization", "project_id", "project", "total_hours", "billable_hours", "internal_hours"}}
+		for _, utilization := range report {
+			employeeCells := []string{strconv.Itoa(int(utilization.EmployeeID)), utilization.EmployeeName,
+				formatDecimal(utilization.CapacityHours), formatDecimal(utilization.Utilization)}
+			rows = append(rows, append(append([]string{}, employeeCells...), "", "All projects", formatDecimal(utilization.TotalHours),
+				formatDecimal(utilization.BillableHours), formatDecimal(utilization.InternalHours)))
+			for _, project := range utilization.Projects {
+				rows = append(rows, append(append([]string{}, employeeCells...), strconv.Itoa(int(project.ProjectID)), project.ProjectName,
+					formatDecimal(project.TotalHours), formatDecimal(project.BillableHours), formatDecimal(project.InternalHours)))
+			}
+		}
+		writeCSV(w, "utilization", start, end, rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&report)
+}
+
+// EmployeeCapacityHandler shows an employee's weekly capacity, and lets admins change it with `weekly_hours`
+func (a *App) EmployeeCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var employee cronos.Employee
+	if a.cronosApp.DB.Where("id = ?", vars["id"]).Limit(1).Find(&employee).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	capacity := EmployeeCapacity{EmployeeID: employee.ID, WeeklyHours: defaultWeeklyCapacity()}
+	a.cronosApp.DB.Where("employee_id = ?", employee.ID).Limit(1).Find(&capacity)
+
+	switch {
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&capacity)
+		return
+	case r.Method == "PUT":
+		if !a.contextUserIsAdmin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		weeklyHours, err := strconv.ParseFloat(r.FormValue("weekly_hours"), 64)
+		if err != nil || weeklyHours < 0 || weeklyHours > 168 {
+			writeValidationErrors(w, ValidationErrors{{Field: "weekly_hours", Message: "Expected a number of hours between 0 and 168"}})
+			return
+		}
+		capacity.WeeklyHours = weeklyHours
+		a.cronosApp.DB.Save(&capacity)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(w).Encode(&capacity)
+		return
+	}
+}
@@ -16,9 +16,10 @@ import (
 
 // App holds our information for accessing various applications and methods across modules
 type App struct {
-	cronosApp *cronos.App
-	logger    *log.Logger
-	GitHash   string
+	cronosApp       *cronos.App
+	logger          *log.Logger
+	GitHash         string
+	paymentProvider PaymentProvider
 }
 
 func main() {
@@ -64,10 +65,13 @@ func main() {
 
 	// Add the cronos app to our webapp struct to access it across handlers
 	a := &App{
-		cronosApp: &cronosApp,
-		logger:    log.New(os.Stdout, "http: ", log.LstdFlags),
-		GitHash:   gitHash,
+		cronosApp:       &cronosApp,
+		logger:          log.New(os.Stdout, "http: ", log.LstdFlags),
+		GitHash:         gitHash,
+		paymentProvider: NewPaymentProvider(),
 	}
+	// Website owned models are purely additive tables, so unlike the cronos models we always migrate them
+	a.MigrateModels()
 
 	// Mux is a subrouter generator that allows us to handle requests and route them to the appropriate handler
 	// the router allows us to handle a couple high level subrouters and then specific routes.
@@ -109,21 +113,71 @@ func main() {
 	r.HandleFunc("/verify_email", a.VerifyEmail).Methods("POST")
 	r.HandleFunc("/surveys/new", a.SurveyUpsert).Methods("POST")
 	r.HandleFunc("/surveys/{id:[0-9]+}/response", a.SurveyResponse).Methods("POST")
+	// Payment provider webhooks are authenticated by their signature rather than by JWT
+	r.HandleFunc("/payments/webhook", a.PaymentWebhookHandler).Methods("POST")
 
 	// Our API routes are protected by JWT
 	api.HandleFunc("/invoices/draft", a.DraftInvoiceListHandler).Methods("GET")
 	api.HandleFunc("/invoices/accepted", a.InvoiceListHandler).Methods("GET")
 	api.HandleFunc("/invoices/{id:[0-9]+}/{state:(?:approve)|(?:send)|(?:paid)|(?:void)}", a.InvoiceStateHandler).Methods("POST")
+	api.HandleFunc("/invoices/{id:[0-9]+}/versions", a.InvoiceVersionsListHandler).Methods("GET")
+	api.HandleFunc("/invoices/{id:[0-9]+}/versions/diff", a.InvoiceVersionDiffHandler).Methods("GET")
+	api.HandleFunc("/invoices/{id:[0-9]+}/comments", a.InvoiceCommentHandler).Methods("GET", "POST")
+	api.HandleFunc("/invoices/{id:[0-9]+}/payments", a.InvoicePaymentsListHandler).Methods("GET")
 	api.HandleFunc("/projects", a.ProjectsListHandler).Methods("GET")
 	api.HandleFunc("/projects/{id:[0-9]+}", a.ProjectHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/projects/{id:[0-9]+}/backfill", a.BackfillProjectInvoicesHandler).Methods("POST")
+	api.HandleFunc("/projects/{id:[0-9]+}/retainers", a.ProjectRetainersListHandler).Methods("GET")
+	api.HandleFunc("/projects/{id:[0-9]+}/budget", a.ProjectBudgetHandler).Methods("GET")
+	api.HandleFunc("/retainers/{id:[0-9]+}", a.RetainerHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/retainers/run", a.RetainerRunHandler).Methods("POST")
+	api.HandleFunc("/projects/{id:[0-9]+}/fixed_fees", a.ProjectFixedFeesListHandler).Methods("GET")
+	api.HandleFunc("/project_templates", a.ProjectTemplatesListHandler).Methods("GET")
+	api.HandleFunc("/project_templates/{id:[0-9]+}", a.ProjectTemplateHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/project_templates/{id:[0-9]+}/instantiate", a.InstantiateProjectTemplateHandler).Methods("POST")
+	api.HandleFunc("/project_template_billing_codes/{id:[0-9]+}", a.ProjectTemplateBillingCodeHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/fixed_fees/{id:[0-9]+}", a.FixedFeeHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/revenue_milestones/{id:[0-9]+}", a.RevenueMilestoneHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/entries", a.EntriesListHandler).Methods("GET")
+	api.HandleFunc("/entries/all", a.AdminEntriesListHandler).Methods("GET")
+	api.HandleFunc("/entries/overlaps", a.EntryOverlapsListHandler).Methods("GET")
+	api.HandleFunc("/entries/import", a.EntryImportHandler).Methods("POST")
+	api.HandleFunc("/entries/preview", a.EntryPreviewHandler).Methods("GET", "POST")
+	api.HandleFunc("/entries/copy_week", a.CopyWeekHandler).Methods("POST")
+	api.HandleFunc("/entry_templates", a.EntryTemplatesListHandler).Methods("GET")
+	api.HandleFunc("/entry_templates/{id:[0-9]+}", a.EntryTemplateHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/entry_templates/generate", a.GenerateRecurringEntriesHandler).Methods("POST")
+	api.HandleFunc("/calendar/events", a.CalendarEventsHandler).Methods("POST")
+	api.HandleFunc("/calendar/import", a.CalendarImportHandler).Methods("POST")
+	api.HandleFunc("/calendar/rules", a.CalendarRulesListHandler).Methods("GET")
+	api.HandleFunc("/calendar/rules/{id:[0-9]+}", a.CalendarRuleHandler).Methods("GET", "PUT", "POST", "DELETE")
+	api.HandleFunc("/timer", a.TimerHandler).Methods("GET")
+	api.HandleFunc("/timer/{action:(?:start)|(?:pause)|(?:stop)|(?:discard)}", a.TimerActionHandler).Methods("POST")
 	api.HandleFunc("/entries/{id:[0-9]+}", a.EntryHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/entries/state/{id:[0-9]+}/{state:(?:void)|(?:draft)|(?:approve)}", a.EntryStateHandler).Methods("POST")
+	api.HandleFunc("/timesheets", a.TimesheetsListHandler).Methods("GET")
+	api.HandleFunc("/timesheets/{id:[0-9]+}", a.TimesheetHandler).Methods("GET")
+	api.HandleFunc("/timesheets/{id:[0-9]+}/{action:(?:approve)|(?:reject)}", a.TimesheetReviewHandler).Methods("POST")
+	api.HandleFunc("/timesheets/{id:[0-9]+}/reopen", a.TimesheetReopenHandler).Methods("POST")
+	api.HandleFunc("/timesheets/week/{date}", a.TimesheetWeekHandler).Methods("GET", "POST")
+	api.HandleFunc("/periods", a.PeriodsListHandler).Methods("GET")
+	api.HandleFunc("/trash", a.TrashListHandler).Methods("GET")
+	api.HandleFunc("/trash/{kind:(?:projects)|(?:accounts)|(?:rates)|(?:billing_codes)|(?:entries)|(?:adjustments)}/{id:[0-9]+}/restore", a.RestoreHandler).Methods("POST")
+	api.HandleFunc("/reports/utilization", a.UtilizationReportHandler).Methods("GET")
+	api.HandleFunc("/reports/profitability", a.ProfitabilityReportHandler).Methods("GET")
+	api.HandleFunc("/reports/profitability/{group:(?:project)|(?:account)|(?:billing_code)}/{id:[0-9]+}", a.ProfitabilityDetailHandler).Methods("GET")
+	api.HandleFunc("/reports/revenue", a.RevenueScheduleHandler).Methods("GET")
+	api.HandleFunc("/periods/{month:[0-9]{4}-[0-9]{2}}/{action:(?:close)|(?:reopen)}", a.PeriodStateHandler).Methods("POST")
 	api.HandleFunc("/staff", a.StaffListHandler).Methods("GET")
+	api.HandleFunc("/staff/{id:[0-9]+}/capacity", a.EmployeeCapacityHandler).Methods("GET", "PUT")
+	api.HandleFunc("/staff/{id:[0-9]+}/bank_account", a.EmployeeBankAccountHandler).Methods("GET", "PUT")
+	api.HandleFunc("/capacity", a.CapacityPlanHandler).Methods("GET")
+	api.HandleFunc("/allocations", a.AllocationsListHandler).Methods("GET")
+	api.HandleFunc("/allocations/{id:[0-9]+}", a.AllocationHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/accounts", a.AccountsListHandler).Methods("GET")
 	api.HandleFunc("/accounts/{id:[0-9]+}", a.AccountHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/accounts/{id:[0-9]+}/invite", a.InviteUserHandler).Methods("POST")
+	api.HandleFunc("/accounts/{id:[0-9]+}/budget", a.AccountBudgetHandler).Methods("GET")
 	api.HandleFunc("/rates", a.RatesListHandler).Methods("GET")
 	api.HandleFunc("/rates/{id:[0-9]+}", a.RateHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/billing_codes", a.BillingCodesListHandler).Methods("GET")
@@ -132,10 +186,22 @@ func main() {
 	api.HandleFunc("/adjustments/{id:[0-9]+}", a.AdjustmentHandler).Methods("GET", "PUT", "POST", "DELETE")
 	api.HandleFunc("/adjustments/state/{id:[0-9]+}/{state:(?:void)|(?:draft)|(?:approve)}", a.AdjustmentStateHandler).Methods("POST")
 	api.HandleFunc("/user/invoices", a.ClientInvoiceHandler).Methods("GET")
+	api.HandleFunc("/user/invoices/{id:[0-9]+}", a.ClientInvoiceDetailHandler).Methods("GET")
+	api.HandleFunc("/user/invoices/{id:[0-9]+}/pdf", a.ClientInvoicePDFHandler).Methods("GET")
+	api.HandleFunc("/user/invoices/{id:[0-9]+}/{action:(?:approve)|(?:dispute)}", a.ClientInvoiceReviewHandler).Methods("POST")
+	api.HandleFunc("/user/invoices/{id:[0-9]+}/comments", a.InvoiceCommentHandler).Methods("GET", "POST")
 	api.HandleFunc("/bills", a.BillListHandler).Methods("GET")
+	api.HandleFunc("/bills/mine", a.MyBillsListHandler).Methods("GET")
 	api.HandleFunc("/bills/{id:[0-9]+}", a.BillHandler).Methods("GET")
+	api.HandleFunc("/bills/{id:[0-9]+}/csv", a.BillCSVHandler).Methods("GET")
 	api.HandleFunc("/bills/{id:[0-9]+}/regenerate", a.RegenerateBillHandler).Methods("POST")
-	api.HandleFunc("/bills/{id:[0-9]+}/{state:(?:paid)|(?:void)}", a.BillStateHandler).Methods("POST")
+	api.HandleFunc("/bills/{id:[0-9]+}/{state:(?:approve)|(?:paid)|(?:void)}", a.BillStateHandler).Methods("POST")
+	api.HandleFunc("/bills/{id:[0-9]+}/acknowledge", a.BillAcknowledgeHandler).Methods("POST")
+	api.HandleFunc("/payouts", a.PayoutBatchesListHandler).Methods("GET")
+	api.HandleFunc("/payouts", a.CreatePayoutBatchHandler).Methods("POST")
+	api.HandleFunc("/payouts/{id:[0-9]+}", a.PayoutBatchHandler).Methods("GET")
+	api.HandleFunc("/payouts/{id:[0-9]+}/nacha", a.PayoutBatchFileHandler).Methods("GET")
+	api.HandleFunc("/payouts/{id:[0-9]+}/{action:(?:confirm)|(?:cancel)}", a.PayoutBatchStateHandler).Methods("POST")
 
 	// Logging for web server
 	f, _ := os.Create("/var/log/golang/golang-server.log")
@@ -163,6 +229,17 @@ func main() {
 		Handler:      logger, // Pass our instance of gorilla/mux in.
 	}
 
+	// Generate draft invoices for retainer periods as they begin
+	go a.RunRetainerScheduler(time.Hour)
+	// Stop timers that have been left running past the auto-stop limit
+	go a.RunTimerAutoStop(time.Minute)
+	// Remind staff who have not submitted last week's timesheet
+	go a.RunTimesheetReminders(time.Hour)
+	// Generate entries from recurring entry templates
+	go a.RunRecurringEntries(time.Hour)
+	// Alert AEs and project leads as project and account budgets are burned
+	go a.RunBudgetAlerts(time.Hour)
+
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
 		log.Printf("Server Running on %q\n", srv.Addr)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/snowpackdata/cronos"
 	"log"
 	"net/http"
 	"strings"
@@ -111,3 +112,23 @@ func JwtVerify(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// contextUserID returns the user ID that JwtVerify stored on the request context. The JWT claims are decoded
+// as generic JSON so the ID arrives as a float64.
+func contextUserID(r *http.Request) uint {
+	switch userID := r.Context().Value("user_id").(type) {
+	case float64:
+		return uint(userID)
+	case uint:
+		return userID
+	default:
+		return 0
+	}
+}
+
+// contextUserIsAdmin reports whether the user making the request has the admin role
+func (a *App) contextUserIsAdmin(r *http.Request) bool {
+	var user cronos.User
+	a.cronosApp.DB.Where("id = ?", contextUserID(r)).Limit(1).Find(&user)
+	return user.Role == cronos.UserRoleAdmin.String()
+}